@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"hemtjan.st/kraft/kaifa"
+	"net/http"
+	"sync"
+)
+
+// Meter is the identity of the meter
+type Meter struct {
+	MeterID   *string `json:",omitempty"`
+	MeterType *string `json:",omitempty"`
+	Version   *string `json:",omitempty"`
+}
+
+// Server serves the latest reading over HTTP and streams every decoded frame
+// to connected clients.
+type Server struct {
+	mu    sync.RWMutex
+	state *kaifa.Message
+	subs  map[chan []byte]struct{}
+	mux   *http.ServeMux
+	// health is nil until kraft has started up
+	health *Health
+}
+
+// New creates a new Server
+func New() *Server {
+	s := &Server{
+		state: &kaifa.Message{},
+		subs:  map[chan []byte]struct{}{},
+		mux:   http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/api/v1/state", s.handleState)
+	s.mux.HandleFunc("/api/v1/meter", s.handleMeter)
+	s.mux.HandleFunc("/api/v1/stream", s.handleStream)
+	s.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s.handleHealth(w, r, false)
+	})
+	s.mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s.handleHealth(w, r, true)
+	})
+	s.mux.HandleFunc("/", s.handleDashboard)
+	return s
+}
+
+// Handle registers an additional handler, e.g. for other modules exposing data
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Update merges msg into the current state and sends it to all stream subscribers
+func (s *Server) Update(msg *kaifa.Message) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Merge(msg)
+	for ch := range s.subs {
+		select {
+		case ch <- b:
+		default:
+			// Slow client, drop the frame rather than blocking the reader
+		}
+	}
+}
+
+func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	s.mu.RLock()
+	b, err := json.Marshal(s.state)
+	s.mu.RUnlock()
+	writeJSON(w, b, err)
+}
+
+func (s *Server) handleMeter(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	s.mu.RLock()
+	b, err := json.Marshal(&Meter{
+		MeterID:   s.state.MeterID,
+		MeterType: s.state.MeterType,
+		Version:   s.state.Version,
+	})
+	s.mu.RUnlock()
+	writeJSON(w, b, err)
+}
+
+// handleStream sends every decoded frame as a Server-Sent Event
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan []byte, 16)
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, ch)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fl.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case b := <-ch:
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			fl.Flush()
+		}
+	}
+}
+
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowGet(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(dashboard))
+}
+
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, b []byte, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/kaifa"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMessages() (*kaifa.Message, *kaifa.Message) {
+	id, typ, ver := "1234567890123456", "MA304H4D", "KFM_001"
+	in, out, short := int32(100), int32(0), int32(250)
+	ts := time.Date(2020, 8, 20, 11, 27, 15, 0, time.UTC)
+	full := &kaifa.Message{
+		Timestamp:           ts,
+		MeterID:             &id,
+		MeterType:           &typ,
+		Version:             &ver,
+		ActivePowerPositive: &in,
+		ActivePowerNegative: &out,
+		Phases:              []kaifa.Phase{{Index: 1, Current: 1.5, Voltage: 230.1}},
+	}
+	return full, &kaifa.Message{Timestamp: ts.Add(2 * time.Second), ActivePowerPositive: &short}
+}
+
+func TestState(t *testing.T) {
+	s := New()
+	full, short := testMessages()
+	s.Update(full)
+	s.Update(short)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/state", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var st kaifa.Message
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &st))
+	assert.Equal(t, int32(250), *st.ActivePowerPositive)
+	assert.Equal(t, int32(0), *st.ActivePowerNegative)
+	assert.Len(t, st.Phases, 1)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/meter", nil))
+	assert.JSONEq(t, `{"MeterID":"1234567890123456","MeterType":"MA304H4D","Version":"KFM_001"}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/state", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestStream(t *testing.T) {
+	s := New()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/v1/stream", nil)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	_, short := testMessages()
+	s.Update(short)
+
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "data: {"))
+	assert.Contains(t, line, `"ActivePowerPositive":250`)
+}
+
+func TestHealth(t *testing.T) {
+	s := New()
+	get := func(path string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var res map[string]interface{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		return rec.Code, res
+	}
+
+	// Starting up, e.g. while probing the serial settings
+	code, res := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	code, res = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []interface{}{"starting up"}, res["Problems"])
+
+	now := time.Now()
+	st := Status{LastLoop: now, SerialOpen: true, BrokerOnline: true}
+	s.SetHealth(Health{
+		Status:      func() Status { return st },
+		MaxFrameAge: 30 * time.Second,
+		MaxLoopAge:  30 * time.Second,
+	})
+
+	// Alive, but not ready before the first frame
+	code, res = get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, res["OK"])
+	code, res = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []interface{}{"no frame decoded yet"}, res["Problems"])
+
+	full, _ := testMessages()
+	s.Update(full)
+	st.LastFrame = now.Add(-time.Second)
+	code, res = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1234567890123456", res["MeterID"])
+
+	st.LastFrame = now.Add(-time.Minute)
+	st.BrokerOnline = false
+	code, res = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Len(t, res["Problems"], 2)
+	code, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	st.LastLoop = now.Add(-time.Minute)
+	code, _ = get("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
@@ -0,0 +1,94 @@
+package api
+
+// dashboard is a self-contained page showing live readings from /api/v1/stream
+const dashboard = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Kraft</title>
+<style>
+body { font-family: sans-serif; margin: 0; padding: 1em; background: #111; color: #eee; }
+h1 { font-size: 1.2em; margin: 0 0 .2em; }
+#meter { color: #888; font-size: .8em; margin-bottom: 1em; }
+.row { display: flex; flex-wrap: wrap; gap: 1em; margin-bottom: 1em; }
+.card { background: #222; border-radius: 8px; padding: .8em; flex: 1 1 8em; text-align: center; }
+.card .v { font-size: 1.6em; }
+.card .l { color: #888; font-size: .8em; }
+.gauge { width: 100%; max-width: 10em; }
+.in { color: #f80; }
+.out { color: #4c4; }
+canvas { width: 100%; height: 12em; background: #222; border-radius: 8px; }
+</style>
+</head>
+<body>
+<h1>Kraft</h1>
+<div id="meter">Waiting for data&hellip;</div>
+<div class="row">
+  <div class="card"><div class="v in" id="import">-</div><div class="l">Import (W)</div></div>
+  <div class="card"><div class="v out" id="export">-</div><div class="l">Export (W)</div></div>
+</div>
+<div class="row" id="phases"></div>
+<canvas id="graph"></canvas>
+<script>
+"use strict";
+var maxCurrent = 25, window_ = 600, points = [];
+
+function $(id) { return document.getElementById(id); }
+
+function gauge(frac) {
+  frac = Math.max(0, Math.min(1, frac));
+  var a = Math.PI * (1 - frac), x = 50 + 40 * Math.cos(a), y = 50 - 40 * Math.sin(a);
+  var col = frac > 0.9 ? "#e33" : frac > 0.7 ? "#fb0" : "#4c4";
+  return '<svg class="gauge" viewBox="0 0 100 55">' +
+    '<path d="M10 50 A40 40 0 0 1 90 50" stroke="#444" stroke-width="8" fill="none"/>' +
+    '<path d="M10 50 A40 40 0 0 1 ' + x.toFixed(1) + ' ' + y.toFixed(1) + '" stroke="' + col + '" stroke-width="8" fill="none"/></svg>';
+}
+
+function phases(list) {
+  $("phases").innerHTML = list.map(function (p) {
+    return '<div class="card">' + gauge(p.Current / maxCurrent) +
+      '<div class="v">' + p.Current.toFixed(1) + ' A</div>' +
+      '<div class="l">L' + p.Index + ' &middot; ' + p.Voltage.toFixed(1) + ' V</div></div>';
+  }).join("");
+}
+
+function draw() {
+  var c = $("graph"), ctx = c.getContext("2d");
+  c.width = c.clientWidth; c.height = c.clientHeight;
+  if (points.length < 2) return;
+  var now = Date.now() / 1000, max = 1;
+  points.forEach(function (p) { max = Math.max(max, p.i, p.e); });
+  function line(key, col) {
+    ctx.strokeStyle = col; ctx.lineWidth = 2; ctx.beginPath();
+    points.forEach(function (p, n) {
+      var x = c.width * (1 - (now - p.t) / window_), y = c.height * (1 - p[key] / max * 0.95);
+      if (n === 0) ctx.moveTo(x, y); else ctx.lineTo(x, y);
+    });
+    ctx.stroke();
+  }
+  line("i", "#f80");
+  line("e", "#4c4");
+  ctx.fillStyle = "#888"; ctx.fillText(max + " W", 4, 12);
+}
+
+function update(m) {
+  if (m.MeterID) $("meter").textContent = (m.MeterType || "") + " " + m.MeterID + " (" + (m.Version || "") + ")";
+  if (m.ActivePowerPositive !== undefined) $("import").textContent = m.ActivePowerPositive;
+  if (m.ActivePowerNegative !== undefined) $("export").textContent = m.ActivePowerNegative;
+  if (m.Phases) phases(m.Phases);
+  if (m.ActivePowerPositive !== undefined) {
+    var t = Date.now() / 1000;
+    points.push({ t: t, i: m.ActivePowerPositive, e: m.ActivePowerNegative || 0 });
+    while (points.length && points[0].t < t - window_) points.shift();
+    draw();
+  }
+}
+
+fetch("api/v1/state").then(function (r) { return r.json(); }).then(update);
+new EventSource("api/v1/stream").onmessage = function (ev) { update(JSON.parse(ev.data)); };
+window.addEventListener("resize", draw);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Status is what kraft reports about itself on /healthz and /readyz
+type Status struct {
+	// LastFrame is when a frame was last decoded
+	LastFrame time.Time
+	// LastLoop is when the main loop last made progress
+	LastLoop         time.Time
+	DecodeErrors     int
+	SerialOpen       bool
+	BrokerOnline     bool
+	BrokerReconnects int
+	// SerialReconnects is how often the serial device was reopened after an error
+	SerialReconnects int
+	// Queued is the number of messages waiting for the broker
+	Queued int
+}
+
+// Health decides whether kraft is alive and ready
+type Health struct {
+	// Status returns the current status
+	Status func() Status
+	// MaxFrameAge is the longest time since the last decoded frame for kraft to be ready
+	MaxFrameAge time.Duration
+	// MaxLoopAge is the longest time without progress in the main loop for kraft to be alive
+	MaxLoopAge time.Duration
+}
+
+// healthReport is the response of /healthz and /readyz
+type healthReport struct {
+	OK bool
+	Status
+	LastFrame *time.Time `json:",omitempty"`
+	MeterID   *string    `json:",omitempty"`
+	// Problems explains why the check failed
+	Problems []string `json:",omitempty"`
+}
+
+// SetHealth sets how /healthz and /readyz decide whether kraft is alive and
+// ready. Until it is called kraft is starting up, which is alive but not ready.
+func (s *Server) SetHealth(h Health) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health = &h
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request, ready bool) {
+	if !allowGet(w, r) {
+		return
+	}
+	s.mu.RLock()
+	h := s.health
+	meterID := s.state.MeterID
+	s.mu.RUnlock()
+
+	var rep healthReport
+	if h == nil {
+		if ready {
+			rep.Problems = append(rep.Problems, "starting up")
+		}
+		rep.OK = len(rep.Problems) == 0
+		s.writeHealth(w, rep)
+		return
+	}
+
+	st := h.Status()
+	now := time.Now()
+	rep.Status = st
+	rep.MeterID = meterID
+	if !st.LastFrame.IsZero() {
+		rep.LastFrame = &st.LastFrame
+	}
+
+	if h.MaxLoopAge > 0 && now.Sub(st.LastLoop) > h.MaxLoopAge {
+		rep.Problems = append(rep.Problems, fmt.Sprintf("main loop stalled for %s", now.Sub(st.LastLoop).Truncate(time.Second)))
+	}
+	if ready {
+		if !st.SerialOpen {
+			rep.Problems = append(rep.Problems, "serial device not open")
+		}
+		if !st.BrokerOnline {
+			rep.Problems = append(rep.Problems, "MQTT broker offline")
+		}
+		if st.LastFrame.IsZero() {
+			rep.Problems = append(rep.Problems, "no frame decoded yet")
+		} else if h.MaxFrameAge > 0 && now.Sub(st.LastFrame) > h.MaxFrameAge {
+			rep.Problems = append(rep.Problems, fmt.Sprintf("no frame decoded for %s", now.Sub(st.LastFrame).Truncate(time.Second)))
+		}
+	}
+	rep.OK = len(rep.Problems) == 0
+	s.writeHealth(w, rep)
+}
+
+func (s *Server) writeHealth(w http.ResponseWriter, rep healthReport) {
+	b, err := json.Marshal(rep)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !rep.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,134 @@
+// Package clock compares the clock of the meter with the clock of the host.
+package clock
+
+import (
+	"fmt"
+	"hemtjan.st/kraft/event"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/sensor"
+	"sort"
+	"time"
+)
+
+// Config decides when drift is reported
+type Config struct {
+	// Threshold is the drift that raises an alarm, disabled if 0
+	Threshold time.Duration
+	// Window is the number of frames the drift is the median of
+	Window int
+}
+
+// Monitor tracks the drift of the meter clock
+type Monitor struct {
+	cfg     Config
+	samples []time.Duration
+	pos     int
+	alarm   bool
+}
+
+// New creates a Monitor
+func New(cfg Config) *Monitor {
+	if cfg.Window < 1 {
+		cfg.Window = 1
+	}
+	return &Monitor{cfg: cfg}
+}
+
+// Offset returns how far ahead the clock of the meter was of the host when
+// msg was received. The meter only sends whole seconds and the frame takes a
+// while to transmit, so a single offset is off by up to a couple of seconds.
+func Offset(msg *kaifa.Message, received time.Time) time.Duration {
+	return msg.Timestamp.Sub(received)
+}
+
+// Update feeds a message received at received and returns an event if the
+// drift crossed the threshold
+func (m *Monitor) Update(msg *kaifa.Message, received time.Time) []event.Event {
+	if msg.Timestamp.IsZero() {
+		return nil
+	}
+	off := Offset(msg, received)
+	if len(m.samples) < m.cfg.Window {
+		m.samples = append(m.samples, off)
+	} else {
+		m.samples[m.pos] = off
+		m.pos = (m.pos + 1) % len(m.samples)
+	}
+	if m.cfg.Threshold <= 0 {
+		return nil
+	}
+
+	drift, _ := m.Drift()
+	abs := drift
+	if abs < 0 {
+		abs = -abs
+	}
+	// Cleared once the drift is well below the threshold, to not flap
+	alarm := abs > m.cfg.Threshold || m.alarm && abs > m.cfg.Threshold*3/4
+	if alarm == m.alarm {
+		return nil
+	}
+	m.alarm = alarm
+	ev := event.Event{
+		Source: "clock",
+		Type:   "drift",
+		Level:  event.Warning,
+		Time:   received,
+		Value:  drift.Seconds(),
+	}
+	if alarm {
+		ev.Message = fmt.Sprintf("Meter clock is %s off", drift.Round(time.Second))
+	} else {
+		ev.Level = event.Clear
+		ev.Message = fmt.Sprintf("Meter clock back to %s off", drift.Round(time.Second))
+	}
+	return []event.Event{ev}
+}
+
+// Alarm returns true while the drift is above the threshold
+func (m *Monitor) Alarm() bool {
+	return m.alarm
+}
+
+// Drift returns the median offset of the recent frames
+func (m *Monitor) Drift() (time.Duration, bool) {
+	if len(m.samples) == 0 {
+		return 0, false
+	}
+	s := append([]time.Duration(nil), m.samples...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s[len(s)/2], true
+}
+
+// Sensors implements sensor.Source
+func (m *Monitor) Sensors() []sensor.Sensor {
+	return []sensor.Sensor{
+		{
+			ID:          "clock_drift",
+			Feature:     "clockDrift",
+			Name:        "Meter Clock Drift",
+			Unit:        "s",
+			DeviceClass: "duration",
+			StateClass:  "measurement",
+			Category:    sensor.Diagnostic,
+		},
+		{
+			ID:       "clock_alarm",
+			Feature:  "clockAlarm",
+			Name:     "Meter Clock Alarm",
+			Category: sensor.Diagnostic,
+		},
+	}
+}
+
+// Values implements sensor.Source
+func (m *Monitor) Values() sensor.Values {
+	v := sensor.Values{"clock_alarm": 0}
+	if m.alarm {
+		v["clock_alarm"] = 1
+	}
+	if d, ok := m.Drift(); ok {
+		v["clock_drift"] = d.Seconds()
+	}
+	return v
+}
@@ -0,0 +1,133 @@
+package clock
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/event"
+	"hemtjan.st/kraft/kaifa"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2020, 8, 20, 10, 0, 0, 0, time.UTC)
+
+// frame returns a frame sent at meter time ts, received offset later by the host
+func frame(ts time.Time, offset time.Duration) (*kaifa.Message, time.Time) {
+	return &kaifa.Message{Timestamp: ts}, ts.Add(-offset)
+}
+
+func TestDrift(t *testing.T) {
+	m := New(Config{Threshold: 10 * time.Second, Window: 5})
+	_, ok := m.Drift()
+	assert.False(t, ok)
+
+	ts := start
+	feed := func(offset time.Duration) []event.Event {
+		ts = ts.Add(10 * time.Second)
+		return m.Update(frame(ts, offset))
+	}
+	for _, off := range []time.Duration{-1, -1, -2, 30, -1} {
+		assert.Empty(t, feed(off*time.Second))
+	}
+	// A single odd frame doesn't move the median
+	d, _ := m.Drift()
+	assert.Equal(t, -time.Second, d)
+
+	// The meter clock is set 15 s ahead
+	var evs []event.Event
+	for i := 0; i < 3; i++ {
+		evs = append(evs, feed(15*time.Second)...)
+	}
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, event.Warning, evs[0].Level)
+		assert.Equal(t, 15.0, evs[0].Value)
+	}
+	assert.Equal(t, 1.0, m.Values()["clock_alarm"])
+	assert.Equal(t, 15.0, m.Values()["clock_drift"])
+
+	// Kept until well below the threshold
+	for i := 0; i < 5; i++ {
+		assert.Empty(t, feed(9*time.Second))
+	}
+	for i := 0; i < 3; i++ {
+		evs = feed(time.Second)
+	}
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, event.Clear, evs[0].Level)
+	}
+}
+
+func TestRefclock(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kraft")
+	defer os.RemoveAll(dir)
+
+	// A fake chrony
+	path := filepath.Join(dir, "chrony.sock")
+	sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sock.Close()
+
+	r, err := DialRefclock(path, 10*time.Second)
+	assert.NoError(t, err)
+	defer r.Close()
+	received := time.Unix(1597917600, 250000000)
+	assert.NoError(t, r.Send(received, -1500*time.Millisecond))
+
+	buf := make([]byte, 64)
+	_ = sock.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := sock.Read(buf)
+	assert.NoError(t, err)
+	b := buf[:n]
+	order := nativeOrder()
+	if n == 40 {
+		assert.Equal(t, uint64(1597917600), order.Uint64(b[0:]))
+		assert.Equal(t, uint64(250000), order.Uint64(b[8:]))
+	} else if assert.Equal(t, 32, n) {
+		assert.Equal(t, uint32(1597917600), order.Uint32(b[0:]))
+	}
+	rest := b[n-24:]
+	assert.Equal(t, -1.5, math.Float64frombits(order.Uint64(rest)))
+	assert.Equal(t, uint32(sockMagic), order.Uint32(rest[20:]))
+}
+
+func TestRefclockRestart(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kraft")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "chrony.sock")
+	listen := func() *net.UnixConn {
+		sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		assert.NoError(t, err)
+		return sock
+	}
+	received := func(sock *net.UnixConn) bool {
+		_ = sock.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := sock.Read(make([]byte, 64))
+		return err == nil
+	}
+
+	sock := listen()
+	r, err := DialRefclock(path, 10*time.Second)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// A meter clock an hour off is dropped
+	assert.NoError(t, r.Send(start, time.Hour))
+	assert.False(t, received(sock))
+	assert.NoError(t, r.Send(start, -time.Second))
+	assert.True(t, received(sock))
+
+	// chrony restarts, creating a new socket
+	sock.Close()
+	os.Remove(path)
+	assert.Error(t, r.Send(start, -time.Second))
+	sock = listen()
+	defer sock.Close()
+	assert.NoError(t, r.Send(start, -time.Second))
+	assert.True(t, received(sock))
+}
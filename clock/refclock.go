@@ -0,0 +1,117 @@
+package clock
+
+import (
+	"encoding/binary"
+	"log"
+	"math"
+	"net"
+	"time"
+	"unsafe"
+)
+
+// sockMagic identifies samples sent to a chrony SOCK refclock
+const sockMagic = 0x534f434b
+
+// Refclock sends the meter clock to a chrony SOCK refclock, see the refclock
+// directive in chrony.conf(5)
+type Refclock struct {
+	path string
+	// maxOffset is the largest offset that is sent, 0 sends all
+	maxOffset time.Duration
+	// conn is nil after a failed write, until it is dialled again
+	conn *net.UnixConn
+	// dropping is set while samples are outside maxOffset
+	dropping bool
+}
+
+// DialRefclock connects to the socket chrony listens on. Samples that are
+// more than maxOffset off are dropped, as they are more likely a meter in
+// another time zone than a host clock that is that far off.
+func DialRefclock(path string, maxOffset time.Duration) (*Refclock, error) {
+	r := &Refclock{path: path, maxOffset: maxOffset}
+	if err := r.dial(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Refclock) dial() error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: r.path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	return nil
+}
+
+// Send sends a sample: at received, the meter clock was offset ahead of the
+// host. If chrony was restarted since the last sample, the socket is dialled again.
+func (r *Refclock) Send(received time.Time, offset time.Duration) error {
+	abs := offset
+	if abs < 0 {
+		abs = -abs
+	}
+	if r.maxOffset > 0 && abs > r.maxOffset {
+		if !r.dropping {
+			log.Printf("Meter clock is %s off, not sending it to chrony", offset.Round(time.Second))
+			r.dropping = true
+		}
+		return nil
+	}
+	if r.dropping {
+		log.Printf("Meter clock is %s off, sending it to chrony again", offset.Round(time.Second))
+		r.dropping = false
+	}
+
+	if r.conn == nil {
+		if err := r.dial(); err != nil {
+			return err
+		}
+	}
+	if _, err := r.conn.Write(sockSample(received, offset)); err != nil {
+		_ = r.conn.Close()
+		r.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to chrony
+func (r *Refclock) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
+
+// sockSample encodes struct sock_sample from chrony's refclock_sock.c in the
+// layout of the host: a struct timeval, the offset as a double, then the
+// pulse, leap, padding and magic ints. The timeval is assumed to use the word
+// size of the host, which isn't true on 32-bit systems with 64-bit time_t.
+func sockSample(received time.Time, offset time.Duration) []byte {
+	order := nativeOrder()
+	var b []byte
+	sec, usec := received.Unix(), int64(received.Nanosecond()/1000)
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		b = make([]byte, 40)
+		order.PutUint64(b[0:], uint64(sec))
+		order.PutUint64(b[8:], uint64(usec))
+	} else {
+		b = make([]byte, 32)
+		order.PutUint32(b[0:], uint32(sec))
+		order.PutUint32(b[4:], uint32(usec))
+	}
+	rest := b[len(b)-24:]
+	order.PutUint64(rest[0:], math.Float64bits(offset.Seconds()))
+	// pulse, leap and padding stay 0
+	order.PutUint32(rest[20:], sockMagic)
+	return b
+}
+
+func nativeOrder() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
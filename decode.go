@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/payload"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// decodeCmd prints an annotated breakdown of frames, given as hex arguments,
+// hex on stdin or a capture file with hex or the raw bytes from the meter
+func decodeCmd(args []string) {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	file := fs.String("file", "", "Capture file with hex or raw frames, - for stdin")
+	format := fs.String("format", "table", "How to print the decoded message (table or json)")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: kraft decode [options] [hex...]\n\nReads hex from stdin if neither hex nor -file is given.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if *format != "table" && *format != "json" {
+		log.Fatalf("invalid -format: %s", *format)
+	}
+
+	var chunks [][]byte
+	var err error
+	switch {
+	case fs.NArg() > 0:
+		chunks, err = parseHex(strings.Join(fs.Args(), "\n"))
+		if err != nil {
+			log.Fatalf("invalid hex: %v", err)
+		}
+	case *file == "" || *file == "-":
+		chunks, err = readCapture(os.Stdin)
+	default:
+		var f *os.File
+		if f, err = os.Open(*file); err != nil {
+			log.Fatalf("opening %s: %v", *file, err)
+		}
+		chunks, err = readCapture(f)
+		_ = f.Close()
+	}
+	if err != nil {
+		log.Fatalf("reading frames: %v", err)
+	}
+
+	n, failed := 0, 0
+	for _, chunk := range chunks {
+		r := kaifa.NewReader(bytes.NewReader(chunk))
+		found := false
+		for {
+			fr, err := r.ReadFrame()
+			if err != nil {
+				break
+			}
+			found = true
+			n++
+			if !printFrame(os.Stdout, n, fr, *format) {
+				failed++
+			}
+		}
+		if !found {
+			// Likely a truncated frame, decode what there is to see where it ends
+			n++
+			fr := bytes.TrimSuffix(bytes.TrimPrefix(chunk, []byte{0x7e}), []byte{0x7e})
+			if !printFrame(os.Stdout, n, fr, *format) {
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// readCapture reads hex, one frame per line, or raw bytes
+func readCapture(r io.Reader) ([][]byte, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if chunks, err := parseHex(string(b)); err == nil {
+		return chunks, nil
+	}
+	return [][]byte{b}, nil
+}
+
+// parseHex parses one frame per line. The opening and closing flags are
+// optional, so that the data logged by kraft can be pasted as is.
+func parseHex(s string) ([][]byte, error) {
+	var res [][]byte
+	sc := bufio.NewScanner(strings.NewReader(s))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "Data:"); i >= 0 {
+			line = line[i+len("Data:"):]
+		}
+		line = strings.NewReplacer(" ", "", "\t", "", "0x", "", ",", "", ":", "").Replace(line)
+		if line == "" {
+			continue
+		}
+		b, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != 0x7e {
+			b = append(append([]byte{0x7e}, b...), 0x7e)
+		}
+		res = append(res, b)
+	}
+	return res, sc.Err()
+}
+
+// printFrame prints the fields of fr and the decoded message, and returns
+// false if the frame couldn't be decoded
+func printFrame(out io.Writer, n int, fr []byte, format string) bool {
+	msg, elems, err := kaifa.Annotate(fr)
+	_, _ = fmt.Fprintf(out, "Frame %d: %d bytes, offsets from the frame format byte\n\n", n, len(fr))
+
+	if err == nil || len(elems) > 9 {
+		h, m := msg.Header(), msg.Meta()
+		_, _ = fmt.Fprintf(out, "Header: Format=%#02x Separator=%t Length=%d DestAddr=%#02x SrcAddr=%#04x ControlField=%#02x\n",
+			h.Format, h.Separator, h.Length, h.DestAddr, h.SrcAddr, h.ControlField)
+		_, _ = fmt.Fprintf(out, "Meta:   LsapDest=%#02x LsapSrc=%#02x LlcQuality=%#02x Meta=%X\n\n", m.LsapDest, m.LsapSrc, m.LlcQuality, m.Meta)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Offset\tTag\tName\tRaw\tValue")
+	for _, e := range elems {
+		tag := "-"
+		if e.Tag != 0 {
+			tag = fmt.Sprintf("%02X", e.Tag)
+		}
+		_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%X\t%s\n", e.Offset, tag, e.Name, e.Raw, elementValue(e))
+	}
+	if de, ok := err.(*kaifa.DecodeError); ok {
+		rest := fr[de.Offset:]
+		if len(rest) > 16 {
+			rest = rest[:16]
+		}
+		_, _ = fmt.Fprintf(w, "%d\t\t%s\t%X\tERROR: %v\n", de.Offset, de.Field, rest, de.Err)
+	}
+	_ = w.Flush()
+
+	header, frame := kaifa.VerifyChecksums(fr)
+	if len(fr) >= 8 {
+		_, _ = fmt.Fprintf(out, "\nHeader checksum: %s\n", checksumResult(header, kaifa.Checksum(fr[:6])))
+	}
+	if err == nil {
+		_, _ = fmt.Fprintf(out, "Frame checksum:  %s\n", checksumResult(frame, kaifa.Checksum(fr[:len(fr)-2])))
+	}
+
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "\nError: %v\n\n", err)
+		return false
+	}
+
+	_, _ = fmt.Fprintln(out)
+	if format == "json" {
+		b, _ := json.MarshalIndent(msg, "", "  ")
+		_, _ = fmt.Fprintf(out, "%s\n\n", b)
+		return true
+	}
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, f := range (&payload.State{Message: msg}).Fields() {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", f.Key(), f.Text(), f.Unit)
+	}
+	_ = w.Flush()
+	_, _ = fmt.Fprintln(out)
+	return true
+}
+
+func elementValue(e kaifa.Element) string {
+	if v, ok := e.Value.(uint16); ok && e.Name == "Length" {
+		// Also holds the frame format and segmentation bit
+		return fmt.Sprintf("%d (format %#02x)", v&0x07ff, v>>8&0xf0)
+	}
+	switch v := e.Value.(type) {
+	case []byte:
+		return fmt.Sprintf("%X", v)
+	case string:
+		return fmt.Sprintf("%q", v)
+	case uint8:
+		return fmt.Sprintf("%d (%#02x)", v, v)
+	case uint16:
+		return fmt.Sprintf("%d (%#04x)", v, v)
+	}
+	return fmt.Sprint(e.Value)
+}
+
+func checksumResult(ok bool, calculated uint16) string {
+	if ok {
+		return fmt.Sprintf("%04X ok", calculated)
+	}
+	return fmt.Sprintf("mismatch, calculated %04X", calculated)
+}
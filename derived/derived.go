@@ -0,0 +1,118 @@
+// Package derived computes electrical quantities that follow from the values
+// reported by the meter, like apparent power and power factor.
+package derived
+
+import (
+	"fmt"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/sensor"
+	"math"
+)
+
+// Metrics derives values from the latest known meter readings
+type Metrics struct {
+	state kaifa.Message
+}
+
+// New creates Metrics
+func New() *Metrics {
+	return &Metrics{}
+}
+
+// Update feeds a message to the metrics
+func (m *Metrics) Update(msg *kaifa.Message) {
+	m.state.Merge(msg)
+}
+
+// Sensors implements sensor.Source. The per-phase sensors follow the phases
+// of the frames seen so far.
+func (m *Metrics) Sensors() []sensor.Sensor {
+	var res []sensor.Sensor
+	for _, ph := range m.state.Phases {
+		i := ph.Index
+		res = append(res, sensor.Sensor{
+			ID:          fmt.Sprintf("phase_%d_apparent_power", i),
+			Feature:     fmt.Sprintf("phase%dApparentPower", i),
+			Name:        fmt.Sprintf("Phase %d Apparent Power", i),
+			Unit:        "VA",
+			DeviceClass: "apparent_power",
+			StateClass:  "measurement",
+		})
+	}
+	return append(res,
+		sensor.Sensor{
+			ID:          "apparent_power",
+			Feature:     "apparentPower",
+			Name:        "Apparent Power",
+			Unit:        "VA",
+			DeviceClass: "apparent_power",
+			StateClass:  "measurement",
+		},
+		sensor.Sensor{
+			ID:          "power_factor",
+			Feature:     "powerFactor",
+			Name:        "Power Factor",
+			DeviceClass: "power_factor",
+			StateClass:  "measurement",
+			Precision:   2,
+		},
+		sensor.Sensor{
+			ID:          "net_power",
+			Feature:     "netPower",
+			Name:        "Net Power",
+			Unit:        "W",
+			DeviceClass: "power",
+			StateClass:  "measurement",
+		},
+		sensor.Sensor{
+			ID:         "phase_imbalance",
+			Feature:    "phaseImbalance",
+			Name:       "Phase Imbalance",
+			Unit:       "%",
+			StateClass: "measurement",
+			Precision:  1,
+		},
+	)
+}
+
+// Values implements sensor.Source
+func (m *Metrics) Values() sensor.Values {
+	v := sensor.Values{}
+	st := &m.state
+
+	var net *float64
+	if st.ActivePowerPositive != nil {
+		n := float64(*st.ActivePowerPositive)
+		if st.ActivePowerNegative != nil {
+			n -= float64(*st.ActivePowerNegative)
+		}
+		net = &n
+		v["net_power"] = n
+	}
+
+	if len(st.Phases) == 0 {
+		return v
+	}
+
+	var total, sumI, minI, maxI float64
+	minI = math.Inf(1)
+	for _, ph := range st.Phases {
+		s := ph.Voltage * ph.Current
+		total += s
+		v[fmt.Sprintf("phase_%d_apparent_power", ph.Index)] = s
+		sumI += ph.Current
+		minI = math.Min(minI, ph.Current)
+		maxI = math.Max(maxI, ph.Current)
+	}
+	v["apparent_power"] = total
+
+	if net != nil && total > 0 {
+		v["power_factor"] = math.Min(math.Abs(*net)/total, 1)
+	}
+
+	if avg := sumI / float64(len(st.Phases)); len(st.Phases) > 1 && avg > 0 {
+		// Largest deviation from the average current, as a percentage of the average
+		v["phase_imbalance"] = math.Max(maxI-avg, avg-minI) / avg * 100
+	}
+	return v
+}
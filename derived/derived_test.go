@@ -0,0 +1,51 @@
+package derived
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/kaifa"
+	"testing"
+	"time"
+)
+
+func TestValues(t *testing.T) {
+	m := New()
+	in, out := int32(1500), int32(0)
+	ts := time.Date(2020, 8, 20, 10, 0, 0, 0, time.UTC)
+	m.Update(&kaifa.Message{
+		Timestamp:           ts,
+		ActivePowerPositive: &in,
+		ActivePowerNegative: &out,
+		Phases: []kaifa.Phase{
+			{Index: 1, Current: 2, Voltage: 230},
+			{Index: 2, Current: 4, Voltage: 230},
+			{Index: 3, Current: 3, Voltage: 230},
+		},
+	})
+
+	assert.Len(t, m.Sensors(), 7)
+
+	v := m.Values()
+	assert.InDelta(t, 460, v["phase_1_apparent_power"], 0.001)
+	assert.InDelta(t, 920, v["phase_2_apparent_power"], 0.001)
+	assert.InDelta(t, 2070, v["apparent_power"], 0.001)
+	assert.InDelta(t, 1500.0/2070, v["power_factor"], 0.0001)
+	assert.InDelta(t, 1500, v["net_power"], 0.001)
+	assert.InDelta(t, 100.0/3, v["phase_imbalance"], 0.001)
+
+	// Short frames only update the import, the export is kept
+	exp := int32(500)
+	m.Update(&kaifa.Message{Timestamp: ts, ActivePowerNegative: &exp})
+	in = 0
+	m.Update(&kaifa.Message{Timestamp: ts.Add(2 * time.Second), ActivePowerPositive: &in})
+	v = m.Values()
+	assert.InDelta(t, -500, v["net_power"], 0.001)
+	assert.InDelta(t, 500.0/2070, v["power_factor"], 0.0001)
+}
+
+func TestNoPhases(t *testing.T) {
+	m := New()
+	in := int32(100)
+	m.Update(&kaifa.Message{ActivePowerPositive: &in})
+	assert.Equal(t, 1, len(m.Values()))
+	assert.Len(t, m.Sensors(), 4)
+}
@@ -0,0 +1,180 @@
+// Package estimate provides high resolution energy counters between the
+// hourly energy registers by integrating the power readings.
+package estimate
+
+import (
+	"fmt"
+	"hemtjan.st/kraft/integrate"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/persist"
+	"hemtjan.st/kraft/sensor"
+	"log"
+	"time"
+)
+
+type counter struct {
+	Anchored bool
+	// Value is the estimated register in Wh
+	Value float64
+	// Published is the highest value published so far, the published counter
+	// never goes backwards even if the estimate was ahead of the meter
+	Published float64
+	// Power is the last power reading in W
+	Power float64
+	// Drift is the difference between the estimate and the register at the last re-anchor
+	Drift    float64
+	HasDrift bool
+}
+
+func (c *counter) integrate(dt time.Duration) {
+	c.Value += c.Power * dt.Hours()
+	if c.Value > c.Published {
+		c.Published = c.Value
+	}
+}
+
+// anchor resets the estimate to a register that was read the duration since
+// ago, 0 if the energy since then can't be integrated
+func (c *counter) anchor(register float64, since time.Duration) {
+	extra := c.Power * since.Hours()
+	if c.Anchored {
+		c.Drift = c.Value - extra - register
+		c.HasDrift = true
+	}
+	c.Anchored = true
+	c.Value = register + extra
+	if c.Value > c.Published {
+		c.Published = c.Value
+	}
+}
+
+type state struct {
+	Last       time.Time
+	LastAnchor time.Time
+	Import     counter
+	Export     counter
+}
+
+// Estimator keeps estimated energy counters for import and export
+type Estimator struct {
+	path string
+	st   state
+}
+
+// New creates an Estimator, restoring the state persisted at path if set, so
+// that the counters don't start over from the next register after a restart
+func New(path string) (*Estimator, error) {
+	e := &Estimator{path: path}
+	if path != "" {
+		if err := persist.Load(path, &e.st); err != nil {
+			return nil, fmt.Errorf("loading estimate state: %w", err)
+		}
+	}
+	return e, nil
+}
+
+// Update feeds a message to the estimator. The state is persisted when the
+// counters are anchored to a new register.
+func (e *Estimator) Update(msg *kaifa.Message) error {
+	now := msg.Timestamp
+	if dt := integrate.Span(e.st.Last, now); dt > 0 {
+		e.st.Import.integrate(dt)
+		e.st.Export.integrate(dt)
+	}
+	if now.After(e.st.Last) {
+		e.st.Last = now
+	}
+
+	if msg.ActivePowerPositive != nil {
+		e.st.Import.Power = float64(*msg.ActivePowerPositive)
+	}
+	if msg.ActivePowerNegative != nil {
+		e.st.Export.Power = float64(*msg.ActivePowerNegative)
+	}
+
+	if msg.EnergyTimestamp == nil || msg.EnergyTimestamp.Equal(e.st.LastAnchor) {
+		return nil
+	}
+	e.st.LastAnchor = *msg.EnergyTimestamp
+	since := integrate.Span(*msg.EnergyTimestamp, now)
+	if msg.ActiveEnergyPositive != nil {
+		e.st.Import.anchor(float64(*msg.ActiveEnergyPositive), since)
+	}
+	if msg.ActiveEnergyNegative != nil {
+		e.st.Export.anchor(float64(*msg.ActiveEnergyNegative), since)
+	}
+	if imp, exp, ok := e.Drift(); ok {
+		log.Printf("Energy estimate drifted %.0f Wh from the import register and %.0f Wh from the export register", imp, exp)
+	}
+	return e.Save()
+}
+
+// Save persists the state
+func (e *Estimator) Save() error {
+	if e.path == "" {
+		return nil
+	}
+	return persist.Save(e.path, &e.st)
+}
+
+// Drift returns the difference in Wh between the estimates and the registers
+// at the last re-anchor. ok is false until the counters have been anchored twice.
+func (e *Estimator) Drift() (imp, exp float64, ok bool) {
+	return e.st.Import.Drift, e.st.Export.Drift, e.st.Import.HasDrift || e.st.Export.HasDrift
+}
+
+// Sensors implements sensor.Source
+func (e *Estimator) Sensors() []sensor.Sensor {
+	return []sensor.Sensor{
+		{
+			ID:          "energy_used_estimated",
+			Feature:     "energyUsedEstimated",
+			Name:        "Consumed Energy (Estimated)",
+			Unit:        "kWh",
+			DeviceClass: "energy",
+			StateClass:  "total_increasing",
+			Precision:   3,
+		},
+		{
+			ID:          "energy_produced_estimated",
+			Feature:     "energyProducedEstimated",
+			Name:        "Returned Energy (Estimated)",
+			Unit:        "kWh",
+			DeviceClass: "energy",
+			StateClass:  "total_increasing",
+			Precision:   3,
+		},
+		{
+			ID:         "energy_used_drift",
+			Feature:    "energyUsedDrift",
+			Name:       "Consumed Energy Estimate Drift",
+			Unit:       "Wh",
+			StateClass: "measurement",
+		},
+		{
+			ID:         "energy_produced_drift",
+			Feature:    "energyProducedDrift",
+			Name:       "Returned Energy Estimate Drift",
+			Unit:       "Wh",
+			StateClass: "measurement",
+		},
+	}
+}
+
+// Values implements sensor.Source
+func (e *Estimator) Values() sensor.Values {
+	v := sensor.Values{}
+	if e.st.Import.Anchored {
+		v["energy_used_estimated"] = e.st.Import.Published / 1000
+	}
+	if e.st.Export.Anchored {
+		v["energy_produced_estimated"] = e.st.Export.Published / 1000
+	}
+	if e.st.Import.HasDrift {
+		v["energy_used_drift"] = e.st.Import.Drift
+	}
+	if e.st.Export.HasDrift {
+		v["energy_produced_drift"] = e.st.Export.Drift
+	}
+	return v
+}
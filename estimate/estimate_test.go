@@ -0,0 +1,83 @@
+package estimate
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/kaifa/kaifatest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEstimate(t *testing.T) {
+	e, err := New("")
+	assert.NoError(t, err)
+	start := kaifatest.Start
+
+	// Nothing is estimated before the first register
+	assert.NoError(t, e.Update(kaifatest.Power(start.Add(-10*time.Second), 1000, 0)))
+	assert.Empty(t, e.Values())
+
+	assert.NoError(t, e.Update(kaifatest.Register(start, 10000, 500)))
+	assert.NoError(t, kaifatest.Feed(e.Update, start.Add(10*time.Second), start.Add(time.Hour), 1000, 0))
+	v := e.Values()
+	assert.InDelta(t, 10.997, v["energy_used_estimated"], 0.001)
+	assert.InDelta(t, 0.5, v["energy_produced_estimated"], 0.001)
+	_, _, ok := e.Drift()
+	assert.False(t, ok)
+
+	// The meter counted less than estimated, the counter must not go backwards
+	assert.NoError(t, e.Update(kaifatest.Register(start.Add(time.Hour), 10900, 500)))
+	imp, exp, ok := e.Drift()
+	assert.True(t, ok)
+	assert.InDelta(t, 100, imp, 0.1)
+	assert.InDelta(t, 0, exp, 0.1)
+	v = e.Values()
+	assert.InDelta(t, 11.003, v["energy_used_estimated"], 0.001)
+	assert.InDelta(t, 100, v["energy_used_drift"], 0.1)
+
+	// A repeated register does not re-anchor
+	assert.NoError(t, e.Update(kaifatest.Register(start.Add(time.Hour), 10900, 500)))
+	imp, _, _ = e.Drift()
+	assert.InDelta(t, 100, imp, 0.1)
+
+	// Once the estimate passes the published value it moves again
+	assert.NoError(t, kaifatest.Feed(e.Update, start.Add(time.Hour+10*time.Second), start.Add(90*time.Minute), 1000, 0))
+	assert.InDelta(t, 11.397, e.Values()["energy_used_estimated"], 0.001)
+}
+
+func TestGap(t *testing.T) {
+	e, err := New("")
+	assert.NoError(t, err)
+	start := kaifatest.Start
+	assert.NoError(t, e.Update(kaifatest.Register(start, 10000, 0)))
+	// Readings too far apart are not integrated
+	assert.NoError(t, e.Update(kaifatest.Power(start.Add(10*time.Minute), 1000, 0)))
+	assert.InDelta(t, 10.0, e.Values()["energy_used_estimated"], 0.0001)
+}
+
+func TestRestart(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kraft")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "estimate.json")
+	start := kaifatest.Start
+
+	e, err := New(path)
+	assert.NoError(t, err)
+	assert.NoError(t, e.Update(kaifatest.Register(start, 10000, 0)))
+	assert.NoError(t, kaifatest.Feed(e.Update, start.Add(10*time.Second), start.Add(30*time.Minute), 1000, 0))
+	assert.NoError(t, e.Save())
+
+	// The estimate carries on after a restart instead of waiting for the next register
+	e, err = New(path)
+	assert.NoError(t, err)
+	assert.NoError(t, kaifatest.Feed(e.Update, start.Add(30*time.Minute), start.Add(time.Hour), 1000, 0))
+
+	// The same as without the restart
+	cont, _ := New("")
+	assert.NoError(t, cont.Update(kaifatest.Register(start, 10000, 0)))
+	assert.NoError(t, kaifatest.Feed(cont.Update, start.Add(10*time.Second), start.Add(time.Hour), 1000, 0))
+	assert.InDelta(t, cont.Values()["energy_used_estimated"], e.Values()["energy_used_estimated"], 1e-9)
+	assert.InDelta(t, 10.994, e.Values()["energy_used_estimated"], 0.001)
+}
@@ -0,0 +1,37 @@
+// Package event describes notable conditions detected in the meter readings
+package event
+
+import (
+	"time"
+)
+
+// Level is the severity of an event
+type Level string
+
+const (
+	// Clear is sent when a previously reported condition is over
+	Clear    Level = "clear"
+	Info     Level = "info"
+	Warning  Level = "warning"
+	Critical Level = "critical"
+)
+
+// Event is published whenever a module detects or clears a condition
+type Event struct {
+	// Source is the module that raised the event, e.g. "fuse"
+	Source string `json:"source"`
+	// Type is the kind of condition, e.g. "overload"
+	Type  string `json:"type"`
+	Level Level  `json:"level"`
+	// Phase is the phase index, or 0 if the event isn't tied to a phase
+	Phase int       `json:"phase,omitempty"`
+	Time  time.Time `json:"time"`
+	// Value is the reading that triggered the event
+	Value float64 `json:"value"`
+	// Start is set on events that end a condition and holds when it began
+	Start *time.Time `json:"start,omitempty"`
+	// Extreme is set on events that end a condition and holds the most
+	// extreme reading while it lasted
+	Extreme *float64 `json:"extreme,omitempty"`
+	Message string   `json:"message"`
+}
@@ -0,0 +1,198 @@
+// Package fuse monitors the per-phase current against the rating of the main
+// fuse, so that loads like EV chargers can be throttled before it trips.
+package fuse
+
+import (
+	"fmt"
+	"hemtjan.st/kraft/event"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/sensor"
+	"time"
+)
+
+// Voltage is the nominal phase voltage in V, used for the power a fuse can pass
+const Voltage = 230
+
+// Config describes the main fuse and when to raise alarms
+type Config struct {
+	// Phases is the number of phases, normally 1 or 3
+	Phases int
+	// Rating is the rating of the fuse in A
+	Rating float64
+	// Warning and Critical are the alarm thresholds as a fraction of Rating
+	Warning  float64
+	Critical float64
+	// Hold is how long the current must stay above a threshold before the alarm fires
+	Hold time.Duration
+	// Hysteresis is how far below a threshold, as a fraction of Rating, the
+	// current must fall before the alarm is cleared
+	Hysteresis float64
+}
+
+// ParseRating parses a fuse description like "3x20" or "20"
+func ParseRating(s string) (phases int, rating float64, err error) {
+	if _, err := fmt.Sscanf(s, "%dx%g", &phases, &rating); err == nil {
+		return phases, rating, nil
+	}
+	if _, err := fmt.Sscanf(s, "%g", &rating); err != nil {
+		return 0, 0, fmt.Errorf("invalid fuse rating %q, expected e.g. 3x20", s)
+	}
+	return 1, rating, nil
+}
+
+type phase struct {
+	current float64
+	known   bool
+	level   event.Level
+	// since holds when the current first exceeded each threshold
+	since map[event.Level]time.Time
+}
+
+// Monitor tracks the load of each phase
+type Monitor struct {
+	cfg    Config
+	phases []phase
+}
+
+// New creates a Monitor
+func New(cfg Config) (*Monitor, error) {
+	if cfg.Phases < 1 || cfg.Rating <= 0 {
+		return nil, fmt.Errorf("invalid fuse: %dx%g A", cfg.Phases, cfg.Rating)
+	}
+	m := &Monitor{cfg: cfg, phases: make([]phase, cfg.Phases)}
+	for i := range m.phases {
+		m.phases[i].level = event.Clear
+		m.phases[i].since = map[event.Level]time.Time{}
+	}
+	return m, nil
+}
+
+// Update feeds a message to the monitor and returns alarms that were raised or cleared
+func (m *Monitor) Update(msg *kaifa.Message) []event.Event {
+	var res []event.Event
+	for _, ph := range msg.Phases {
+		if ph.Index < 1 || ph.Index > len(m.phases) {
+			continue
+		}
+		p := &m.phases[ph.Index-1]
+		p.current = ph.Current
+		p.known = true
+
+		level := m.level(p, msg.Timestamp)
+		if level == p.level {
+			continue
+		}
+		p.level = level
+		ev := event.Event{
+			Source: "fuse",
+			Type:   "overload",
+			Level:  level,
+			Phase:  ph.Index,
+			Time:   msg.Timestamp,
+			Value:  ph.Current,
+		}
+		if level == event.Clear {
+			ev.Message = fmt.Sprintf("Phase %d back to %.1f A", ph.Index, ph.Current)
+		} else {
+			ev.Message = fmt.Sprintf("Phase %d at %.1f A of %g A", ph.Index, ph.Current, m.cfg.Rating)
+		}
+		res = append(res, ev)
+	}
+	return res
+}
+
+// level returns the alarm level of p at time now
+func (m *Monitor) level(p *phase, now time.Time) event.Level {
+	thresholds := []struct {
+		level event.Level
+		limit float64
+	}{
+		{event.Warning, m.cfg.Warning * m.cfg.Rating},
+		{event.Critical, m.cfg.Critical * m.cfg.Rating},
+	}
+	res := event.Clear
+	for _, t := range thresholds {
+		if t.limit <= 0 {
+			continue
+		}
+		// An active alarm is kept until the current falls below the hysteresis
+		active := severity[p.level] >= severity[t.level]
+		if p.current >= t.limit || (active && p.current > t.limit-m.cfg.Hysteresis*m.cfg.Rating) {
+			if _, ok := p.since[t.level]; !ok {
+				p.since[t.level] = now
+			}
+			if active || now.Sub(p.since[t.level]) >= m.cfg.Hold {
+				res = t.level
+			}
+		} else {
+			delete(p.since, t.level)
+		}
+	}
+	return res
+}
+
+var severity = map[event.Level]int{
+	event.Clear:    0,
+	event.Warning:  1,
+	event.Critical: 2,
+}
+
+// Sensors implements sensor.Source
+func (m *Monitor) Sensors() []sensor.Sensor {
+	var res []sensor.Sensor
+	for i := 1; i <= m.cfg.Phases; i++ {
+		res = append(res, sensor.Sensor{
+			ID:          fmt.Sprintf("phase_%d_available_current", i),
+			Feature:     fmt.Sprintf("phase%dAvailableCurrent", i),
+			Name:        fmt.Sprintf("Phase %d Available Current", i),
+			Unit:        "A",
+			DeviceClass: "current",
+			StateClass:  "measurement",
+			Precision:   1,
+		})
+	}
+	return append(res,
+		sensor.Sensor{
+			ID:         "fuse_load",
+			Feature:    "fuseLoad",
+			Name:       "Main Fuse Load",
+			Unit:       "%",
+			StateClass: "measurement",
+		},
+		sensor.Sensor{
+			ID:      "fuse_alarm",
+			Feature: "fuseAlarm",
+			Name:    "Main Fuse Alarm",
+		},
+	)
+}
+
+// Values implements sensor.Source. fuse_alarm is 0 when clear, 1 for warning
+// and 2 for critical.
+func (m *Monitor) Values() sensor.Values {
+	v := sensor.Values{}
+	load, alarm, known := 0.0, 0.0, false
+	for i, p := range m.phases {
+		if !p.known {
+			continue
+		}
+		known = true
+		v[fmt.Sprintf("phase_%d_available_current", i+1)] = m.cfg.Rating - p.current
+		if l := p.current / m.cfg.Rating * 100; l > load {
+			load = l
+		}
+		switch p.level {
+		case event.Critical:
+			alarm = 2
+		case event.Warning:
+			if alarm < 1 {
+				alarm = 1
+			}
+		}
+	}
+	if known {
+		v["fuse_load"] = load
+		v["fuse_alarm"] = alarm
+	}
+	return v
+}
@@ -0,0 +1,72 @@
+package fuse
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/event"
+	"hemtjan.st/kraft/kaifa/kaifatest"
+	"testing"
+	"time"
+)
+
+func TestParseRating(t *testing.T) {
+	ph, r, err := ParseRating("3x20")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, ph)
+	assert.Equal(t, 20.0, r)
+
+	ph, r, err = ParseRating("35")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ph)
+	assert.Equal(t, 35.0, r)
+
+	_, _, err = ParseRating("big")
+	assert.Error(t, err)
+}
+
+func TestMonitor(t *testing.T) {
+	m, err := New(Config{Phases: 3, Rating: 20, Warning: 0.8, Critical: 1, Hold: 10 * time.Second, Hysteresis: 0.05})
+	assert.NoError(t, err)
+	start := kaifatest.Start
+
+	assert.Empty(t, m.Update(kaifatest.Currents(start, 5, 17, 3)))
+	v := m.Values()
+	assert.Equal(t, 15.0, v["phase_1_available_current"])
+	assert.Equal(t, 3.0, v["phase_2_available_current"])
+	assert.Equal(t, 85.0, v["fuse_load"])
+	assert.Equal(t, 0.0, v["fuse_alarm"])
+
+	// Warning is raised once the current has been above the threshold long enough
+	assert.Empty(t, m.Update(kaifatest.Currents(start.Add(5*time.Second), 5, 17, 3)))
+	evs := m.Update(kaifatest.Currents(start.Add(10*time.Second), 5, 17, 3))
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, event.Warning, evs[0].Level)
+		assert.Equal(t, 2, evs[0].Phase)
+	}
+	assert.Equal(t, 1.0, m.Values()["fuse_alarm"])
+
+	// A short spike over the rating doesn't escalate
+	assert.Empty(t, m.Update(kaifatest.Currents(start.Add(12*time.Second), 5, 21, 3)))
+	assert.Empty(t, m.Update(kaifatest.Currents(start.Add(14*time.Second), 5, 16, 3)))
+
+	// Within the hysteresis the warning stays
+	assert.Empty(t, m.Update(kaifatest.Currents(start.Add(20*time.Second), 5, 15.5, 3)))
+	evs = m.Update(kaifatest.Currents(start.Add(30*time.Second), 5, 14, 3))
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, event.Clear, evs[0].Level)
+	}
+
+	// Sustained overload goes straight to critical
+	assert.Empty(t, m.Update(kaifatest.Currents(start.Add(40*time.Second), 25, 5, 3)))
+	evs = m.Update(kaifatest.Currents(start.Add(50*time.Second), 25, 5, 3))
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, event.Critical, evs[0].Level)
+		assert.Equal(t, 1, evs[0].Phase)
+	}
+	assert.Equal(t, 2.0, m.Values()["fuse_alarm"])
+
+	// And steps down to warning
+	evs = m.Update(kaifatest.Currents(start.Add(60*time.Second), 17, 5, 3))
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, event.Warning, evs[0].Level)
+	}
+}
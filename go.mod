@@ -1,10 +1,10 @@
 module hemtjan.st/kraft
 
-go 1.15
+go 1.16
 
 require (
 	github.com/stretchr/testify v1.3.0
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
-	golang.org/x/sys v0.0.0-20200819171115-d785dc25833f // indirect
 	lib.hemtjan.st v0.7.4
+	modernc.org/sqlite v1.14.1
 )
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/payload"
+	"hemtjan.st/kraft/persist"
+	"hemtjan.st/kraft/queue"
+	"hemtjan.st/kraft/sensor"
+	"hemtjan.st/kraft/throttle"
+	"lib.hemtjan.st/hass"
+	"lib.hemtjan.st/transport/mqtt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// haStateFile is the file in -state.dir the published topics are recorded in
+	haStateFile = "hass.json"
+
+	// Default topics, {prefix} is the discovery prefix and {name} the device name
+	haDefaultPrefix       = "homeassistant"
+	haDefaultState        = "{prefix}/{name}/state"
+	haDefaultAvailability = "{prefix}/{name}/availability"
+
+	haOnline  = "online"
+	haOffline = "offline"
+)
+
+// haDiscovery is the device discovery payload. It uses the types from
+// lib.hemtjan.st/hass for the device and components, and adds the
+// availability options.
+type haDiscovery struct {
+	Device       *hass.DeviceInfo        `json:"device"`
+	Origin       *hass.Origin            `json:"origin"`
+	Components   map[string]*haComponent `json:"components"`
+	StateTopic   string                  `json:"state_topic"`
+	Availability []haAvailability        `json:"availability,omitempty"`
+}
+
+type haComponent struct {
+	*hass.Component
+	// StateTopic overrides the state topic of the device, used for payload.Tree
+	StateTopic string `json:"state_topic,omitempty"`
+	// ExpireAfter makes the entity unavailable if no state arrives for this many seconds
+	ExpireAfter      int    `json:"expire_after,omitempty"`
+	EntityCategory   string `json:"entity_category,omitempty"`
+	EnabledByDefault *bool  `json:"enabled_by_default,omitempty"`
+	// PayloadOn and PayloadOff are the states of a binary_sensor
+	PayloadOn  string `json:"payload_on,omitempty"`
+	PayloadOff string `json:"payload_off,omitempty"`
+	// LastResetValueTemplate gives when a total last started over
+	LastResetValueTemplate string `json:"last_reset_value_template,omitempty"`
+}
+
+// haLastReset are the templates for the start of the periods of
+// sensor.Sensor.Reset, Home Assistant is assumed to share the time zone
+var haLastReset = map[string]string{
+	sensor.Hour:  "{{ now().replace(minute=0, second=0, microsecond=0).isoformat() }}",
+	sensor.Day:   "{{ today_at().isoformat() }}",
+	sensor.Month: "{{ today_at().replace(day=1).isoformat() }}",
+}
+
+// haDisabledByDefault are the entities that are rarely useful, they are
+// created disabled unless enabled with -hass.enable
+var haDisabledByDefault = map[string]bool{
+	"reactive_power_import":  true,
+	"reactive_power_export":  true,
+	"reactive_energy_import": true,
+	"reactive_energy_export": true,
+	"meter_clock":            true,
+}
+
+// haEntities parses the comma separated lists of entities to enable and
+// disable into a map from entity ID to enabled
+func haEntities(enable, disable string) map[string]bool {
+	res := map[string]bool{}
+	for _, l := range []struct {
+		ids     string
+		enabled bool
+	}{{enable, true}, {disable, false}} {
+		for _, id := range strings.Split(l.ids, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				res[id] = l.enabled
+			}
+		}
+	}
+	return res
+}
+
+type haAvailability struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available,omitempty"`
+	PayloadNotAvailable string `json:"payload_not_available,omitempty"`
+}
+
+// How a changed MeterID is handled
+const (
+	// haMigrate keeps the identity of the old meter, so that the entities
+	// and their history carry over to the new meter
+	haMigrate = "migrate"
+	// haNewDevice removes the old device and announces a new one
+	haNewDevice = "new"
+)
+
+// haConfig configures the Home Assistant publisher
+type haConfig struct {
+	// Name is the name of the device, also used in the topics
+	Name string
+	// Prefix is the discovery prefix
+	Prefix string
+	// StateTopic and AvailabilityTopic are topic templates, see haTopic
+	StateTopic        string
+	AvailabilityTopic string
+	// Format is the format of the state, payload.CBOR is not supported by Home Assistant
+	Format payload.Format
+	// Retain is used for the state
+	Retain bool
+	// Policy decides which values are published, keyed by the field names of payload.Flat
+	Policy []throttle.Rule
+	// Queue holds the states with energy registers while the broker is unreachable, may be nil
+	Queue *queue.Queue
+	// StaleAfter is how long without frames before the device is unavailable
+	StaleAfter time.Duration
+	// Enabled overrides whether entities are enabled by default
+	Enabled map[string]bool
+	// StatePath is the file the published topics are recorded in, not persisted if empty
+	StatePath string
+	// MeterChange is haMigrate or haNewDevice
+	MeterChange string
+}
+
+// haRecord is what has been published to Home Assistant. It is persisted so
+// that configs left behind by a rename or meter swap can be removed.
+type haRecord struct {
+	// Identity is the meter ID used for the device identifier and unique IDs
+	Identity string `json:"identity"`
+	// MeterID is the ID of the meter that was last seen
+	MeterID string `json:"meterId"`
+	// Topics are the retained topics that were published
+	Topics []string `json:"topics"`
+}
+
+// haPublisher publishes the meter to Home Assistant using MQTT device discovery
+type haPublisher struct {
+	mq    mqtt.MQTT
+	cfg   haConfig
+	state *sink
+
+	mu        sync.Mutex
+	rec       haRecord
+	disc      *haDiscovery
+	sensors   []sensor.Sensor
+	lastFrame time.Time
+	online    bool
+}
+
+func newHAPublisher(mq mqtt.MQTT, cfg haConfig) (*haPublisher, error) {
+	if cfg.MeterChange != haMigrate && cfg.MeterChange != haNewDevice {
+		return nil, fmt.Errorf("invalid meter change mode %q, expected %s or %s", cfg.MeterChange, haMigrate, haNewDevice)
+	}
+	if cfg.Format == payload.CBOR {
+		return nil, fmt.Errorf("payload format %s is not supported by Home Assistant", cfg.Format)
+	}
+	h := &haPublisher{
+		mq:    mq,
+		cfg:   cfg,
+		state: &sink{mq: mq, format: cfg.Format, retain: cfg.Retain, queue: cfg.Queue},
+	}
+	if len(cfg.Policy) > 0 {
+		h.state.filter = throttle.New(cfg.Policy)
+		h.state.keepalive = cfg.StaleAfter / 2
+	}
+	if cfg.StatePath != "" {
+		if err := persist.Load(cfg.StatePath, &h.rec); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// haTopic expands a topic template for the device name. The template can
+// contain {prefix}, {name} and {meter}.
+func haTopic(tmpl, prefix, name, meterID string) string {
+	return payload.Topic(tmpl, map[string]string{"prefix": prefix, "name": name, "meter": meterID})
+}
+
+func haConfigTopic(prefix, name string) string {
+	return prefix + "/device/" + name + "/config"
+}
+
+// haTopics returns the retained topics published with the default topics for
+// the device name, except those below the state topic for payload.Tree
+func haTopics(prefix, name string) []string {
+	return []string{
+		haConfigTopic(prefix, name),
+		haTopic(haDefaultState, prefix, name, ""),
+		haTopic(haDefaultAvailability, prefix, name, ""),
+	}
+}
+
+// haWill returns the availability topic for the last-will of the connection,
+// which is set before any frame is read and can't depend on the meter
+func haWill(tmpl, prefix, name string) (string, error) {
+	if strings.Contains(tmpl, "{meter}") {
+		return "", fmt.Errorf("the availability topic is the last-will of the connection and can't contain {meter}")
+	}
+	return haTopic(tmpl, prefix, name, ""), nil
+}
+
+func (h *haPublisher) stateTopic() string {
+	return haTopic(h.cfg.StateTopic, h.cfg.Prefix, h.cfg.Name, h.rec.MeterID)
+}
+
+func (h *haPublisher) availabilityTopic() string {
+	return haTopic(h.cfg.AvailabilityTopic, h.cfg.Prefix, h.cfg.Name, h.rec.MeterID)
+}
+
+// run republishes the discovery config when Home Assistant comes online and
+// marks the device unavailable when frames stop arriving
+func (h *haPublisher) run() {
+	birth := h.mq.Subscribe(h.cfg.Prefix + "/status")
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case b, ok := <-birth:
+			if !ok {
+				return
+			}
+			if string(b) == haOnline {
+				log.Printf("Home Assistant online, republishing discovery config")
+				h.mu.Lock()
+				h.publishConfig()
+				if h.online {
+					h.mq.Publish(h.availabilityTopic(), []byte(haOnline), true)
+				}
+				h.mu.Unlock()
+			}
+		case <-tick.C:
+			h.mu.Lock()
+			if h.online && h.cfg.StaleAfter > 0 && time.Since(h.lastFrame) > h.cfg.StaleAfter {
+				log.Printf("No frame for %s, marking Home Assistant device unavailable", h.cfg.StaleAfter)
+				h.setOnline(false)
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// Update publishes msg and the derived values, creating the device on the
+// first frame that carries the meter identity. Entities for fields that first
+// appear in later frames, like the hourly energy registers, are announced then.
+func (h *haPublisher) Update(msg *kaifa.Message, sources []sensor.Source, values sensor.Values) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if msg.MeterID != nil && (h.disc == nil || *msg.MeterID != h.rec.MeterID) {
+		h.announce(msg, sources)
+	} else if h.disc != nil {
+		h.extend(msg)
+	}
+	if h.disc == nil {
+		// Short frames only contain the current power
+		return
+	}
+
+	h.lastFrame = time.Now()
+	st := &payload.State{Message: msg, Kraft: values, Received: h.lastFrame, Sensors: h.sensors}
+	for _, t := range h.state.publishState(h.disc.StateTopic, st) {
+		if h.cfg.Retain && !contains(h.rec.Topics, t) {
+			// New field topics show up as the values appear in the frames
+			h.rec.Topics = append(h.rec.Topics, t)
+			h.saveRecord()
+		}
+	}
+	if !h.online {
+		h.setOnline(true)
+	}
+}
+
+// Reconnected republishes the availability after the connection to the
+// broker was lost, as the last-will has since marked the device unavailable
+func (h *haPublisher) Reconnected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.online {
+		h.mq.Publish(h.availabilityTopic(), []byte(haOnline), true)
+	}
+}
+
+// Close marks the device as unavailable
+func (h *haPublisher) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.setOnline(false)
+}
+
+func (h *haPublisher) setOnline(online bool) {
+	h.online = online
+	payload := haOffline
+	if online {
+		payload = haOnline
+	}
+	h.mq.Publish(h.availabilityTopic(), []byte(payload), true)
+}
+
+func (h *haPublisher) publishConfig() {
+	if h.disc == nil {
+		return
+	}
+	b, err := json.Marshal(h.disc)
+	if err == nil {
+		h.mq.Publish(haConfigTopic(h.cfg.Prefix, h.cfg.Name), b, true)
+	}
+}
+
+// announce publishes the discovery config, removing what was published for
+// another name or, unless migrating, another meter
+func (h *haPublisher) announce(msg *kaifa.Message, sources []sensor.Source) {
+	meterID := *msg.MeterID
+	if h.rec.MeterID != "" && h.rec.MeterID != meterID {
+		log.Printf("Meter changed from %s to %s", h.rec.MeterID, meterID)
+		if h.cfg.MeterChange == haNewDevice {
+			haClear(h.mq, h.rec.Topics)
+			h.rec.Topics = nil
+			h.rec.Identity = meterID
+		}
+	}
+	if h.rec.Identity == "" {
+		h.rec.Identity = meterID
+	}
+	h.rec.MeterID = meterID
+
+	topics := []string{haConfigTopic(h.cfg.Prefix, h.cfg.Name), h.availabilityTopic()}
+	if h.cfg.Retain {
+		topics = append(topics, h.stateTopic())
+	}
+	var stale []string
+	for _, t := range h.rec.Topics {
+		if !contains(topics, t) && (h.cfg.Format != payload.Tree || !strings.HasPrefix(t, h.stateTopic()+"/")) {
+			stale = append(stale, t)
+		}
+	}
+	if len(stale) > 0 {
+		log.Printf("Removing stale Home Assistant topics: %s", strings.Join(stale, ", "))
+		haClear(h.mq, stale)
+	}
+	h.rec.Topics = append(topics, subtract(h.rec.Topics, stale, topics)...)
+	h.saveRecord()
+
+	h.sensors = nil
+	for _, src := range sources {
+		h.sensors = append(h.sensors, src.Sensors()...)
+	}
+	h.disc = h.discovery(msg)
+	h.publishConfig()
+	if h.online {
+		// The availability may just have been cleared
+		h.mq.Publish(h.availabilityTopic(), []byte(haOnline), true)
+	}
+}
+
+// extend announces the components of msg that aren't in the discovery config yet
+func (h *haPublisher) extend(msg *kaifa.Message) {
+	var added []string
+	for id, c := range h.discovery(msg).Components {
+		if _, ok := h.disc.Components[id]; !ok {
+			h.disc.Components[id] = c
+			added = append(added, id)
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+	sort.Strings(added)
+	log.Printf("Announcing new Home Assistant entities: %v", added)
+	h.publishConfig()
+}
+
+func (h *haPublisher) saveRecord() {
+	if h.cfg.StatePath == "" {
+		return
+	}
+	if err := persist.Save(h.cfg.StatePath, &h.rec); err != nil {
+		log.Printf("Error saving Home Assistant state: %v", err)
+	}
+}
+
+// haClear removes retained messages, which also removes discovery configs
+func haClear(mq mqtt.MQTT, topics []string) {
+	for _, t := range topics {
+		mq.Publish(t, []byte{}, true)
+	}
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// subtract returns the strings in l that are in none of the other lists
+func subtract(l []string, other ...[]string) []string {
+	var res []string
+outer:
+	for _, s := range l {
+		for _, o := range other {
+			if contains(o, s) {
+				continue outer
+			}
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// discovery builds the discovery config with the components for the fields of msg
+func (h *haPublisher) discovery(msg *kaifa.Message) *haDiscovery {
+	uniqPrefix := "kaifa_" + h.rec.Identity
+	cfg := &haDiscovery{
+		Device: &hass.DeviceInfo{
+			Identifiers:  []string{h.rec.Identity},
+			Manufacturer: "Kaifa",
+			Name:         h.cfg.Name,
+			SerialNumber: h.rec.MeterID,
+		},
+		Origin: &hass.Origin{
+			Name:       "Kraft",
+			SwVersion:  version,
+			SupportUrl: "https://github.com/hemtjanst/kraft",
+		},
+		Components: map[string]*haComponent{},
+		StateTopic: h.stateTopic(),
+		Availability: []haAvailability{
+			{Topic: h.availabilityTopic()},
+		},
+	}
+	if msg.MeterType != nil {
+		cfg.Device.Model = *msg.MeterType
+	}
+	if msg.Version != nil {
+		cfg.Device.SwVersion = *msg.Version
+	}
+
+	// add adds a component for the field at path, c.ValueTemplate is used
+	// for payload.JSON
+	add := func(id string, path []string, c *hass.Component) *haComponent {
+		f := payload.Field{Path: path}
+		c.Platform = "sensor"
+		c.UniqueId = uniqPrefix + "_" + id
+		comp := &haComponent{Component: c}
+		switch h.cfg.Format {
+		case payload.Flat:
+			c.ValueTemplate = fmt.Sprintf("{{ value_json.%s }}", f.Key())
+		case payload.Tree:
+			c.ValueTemplate = ""
+			comp.StateTopic = cfg.StateTopic + "/" + f.Topic()
+		}
+		// The energy registers are only sent once an hour, each field
+		// has its own topic in payload.Tree
+		hourly := h.cfg.Format == payload.Tree && (path[0] == "energy" || path[0] == "reactive_energy")
+		if h.cfg.StaleAfter > 0 && !hourly {
+			// Also covers kraft dying while Home Assistant restarts, as the
+			// retained availability would still say online
+			comp.ExpireAfter = int(h.cfg.StaleAfter.Seconds())
+		}
+		if en, ok := h.cfg.Enabled[id]; ok {
+			comp.EnabledByDefault = &en
+		} else if haDisabledByDefault[id] {
+			en := false
+			comp.EnabledByDefault = &en
+		}
+		cfg.Components[id] = comp
+		return comp
+	}
+
+	if msg.ActivePowerPositive != nil {
+		add("input_power", []string{"power", "import"}, &hass.Component{
+			Name:              "Input Power",
+			UnitOfMeasurement: "W",
+			ValueTemplate:     "{{ value_json.ActivePowerPositive }}",
+			StateClass:        "measurement",
+			DeviceClass:       "power",
+		})
+	}
+	if msg.ActivePowerNegative != nil {
+		add("output_power", []string{"power", "export"}, &hass.Component{
+			Name:              "Output Power",
+			UnitOfMeasurement: "W",
+			ValueTemplate:     "{{ value_json.ActivePowerNegative }}",
+			StateClass:        "measurement",
+			DeviceClass:       "power",
+		})
+	}
+	if msg.ReactivePowerPositive != nil {
+		add("reactive_power_import", []string{"reactive_power", "import"}, &hass.Component{
+			Name:              "Reactive Power Import",
+			UnitOfMeasurement: "var",
+			ValueTemplate:     "{{ value_json.ReactivePowerPositive }}",
+			StateClass:        "measurement",
+			DeviceClass:       "reactive_power",
+		})
+	}
+	if msg.ReactivePowerNegative != nil {
+		add("reactive_power_export", []string{"reactive_power", "export"}, &hass.Component{
+			Name:              "Reactive Power Export",
+			UnitOfMeasurement: "var",
+			ValueTemplate:     "{{ value_json.ReactivePowerNegative }}",
+			StateClass:        "measurement",
+			DeviceClass:       "reactive_power",
+		})
+	}
+	for idx, ph := range msg.Phases {
+		p := fmt.Sprintf("phase%d", ph.Index)
+		add(fmt.Sprintf("phase_%d_current", ph.Index), []string{p, "current"}, &hass.Component{
+			Name:              fmt.Sprintf("Phase %d Current", ph.Index),
+			UnitOfMeasurement: "A",
+			ValueTemplate:     fmt.Sprintf("{{ value_json.Phases[%d].Current }}", idx),
+			StateClass:        "measurement",
+			DeviceClass:       "current",
+		})
+		add(fmt.Sprintf("phase_%d_voltage", ph.Index), []string{p, "voltage"}, &hass.Component{
+			Name:              fmt.Sprintf("Phase %d Voltage", ph.Index),
+			UnitOfMeasurement: "V",
+			ValueTemplate:     fmt.Sprintf("{{ value_json.Phases[%d].Voltage }}", idx),
+			StateClass:        "measurement",
+			DeviceClass:       "voltage",
+		})
+	}
+	if msg.ActiveEnergyPositive != nil {
+		add("consumed_energy", []string{"energy", "import"}, &hass.Component{
+			Name:              "Consumed Energy",
+			UnitOfMeasurement: "Wh",
+			ValueTemplate:     "{{ value_json.ActiveEnergyPositive }}",
+			StateClass:        "total_increasing",
+			DeviceClass:       "energy",
+		})
+	}
+	if msg.ActiveEnergyNegative != nil {
+		add("returned_energy", []string{"energy", "export"}, &hass.Component{
+			Name:              "Returned Energy",
+			UnitOfMeasurement: "Wh",
+			ValueTemplate:     "{{ value_json.ActiveEnergyNegative }}",
+			StateClass:        "total_increasing",
+			DeviceClass:       "energy",
+		})
+	}
+	if msg.ReactiveEnergyPositive != nil {
+		add("reactive_energy_import", []string{"reactive_energy", "import"}, &hass.Component{
+			Name:              "Reactive Energy Import",
+			UnitOfMeasurement: "varh",
+			ValueTemplate:     "{{ value_json.ReactiveEnergyPositive }}",
+			StateClass:        "total_increasing",
+			DeviceClass:       "reactive_energy",
+		})
+	}
+	if msg.ReactiveEnergyNegative != nil {
+		add("reactive_energy_export", []string{"reactive_energy", "export"}, &hass.Component{
+			Name:              "Reactive Energy Export",
+			UnitOfMeasurement: "varh",
+			ValueTemplate:     "{{ value_json.ReactiveEnergyNegative }}",
+			StateClass:        "total_increasing",
+			DeviceClass:       "reactive_energy",
+		})
+	}
+	if msg.EnergyTimestamp != nil {
+		add("energy_timestamp", []string{"energy", "timestamp"}, &hass.Component{
+			Name:          "Energy Timestamp",
+			ValueTemplate: "{{ value_json.EnergyTimestamp }}",
+			DeviceClass:   "timestamp",
+		})
+	}
+
+	add("meter_clock", []string{"timestamp"}, &hass.Component{
+		Name:          "Meter Clock",
+		ValueTemplate: "{{ value_json.Timestamp }}",
+		DeviceClass:   "timestamp",
+	}).EntityCategory = sensor.Diagnostic
+	add("last_frame", []string{"received"}, &hass.Component{
+		Name:          "Last Frame",
+		ValueTemplate: "{{ value_json.Received }}",
+		DeviceClass:   "timestamp",
+	}).EntityCategory = sensor.Diagnostic
+	if msg.Version != nil {
+		add("firmware", []string{"version"}, &hass.Component{
+			Name:          "Firmware",
+			ValueTemplate: "{{ value_json.Version }}",
+		}).EntityCategory = sensor.Diagnostic
+	}
+	for _, s := range h.sensors {
+		comp := add(s.ID, []string{s.ID}, &hass.Component{
+			Name:              s.Name,
+			UnitOfMeasurement: s.Unit,
+			ValueTemplate:     fmt.Sprintf("{{ value_json.Kraft.%s }}", s.ID),
+			StateClass:        s.StateClass,
+			DeviceClass:       s.DeviceClass,
+		})
+		comp.EntityCategory = s.Category
+		comp.LastResetValueTemplate = haLastReset[s.Reset]
+		if s.Binary {
+			comp.Platform = "binary_sensor"
+			comp.PayloadOn, comp.PayloadOff = s.Format(1), s.Format(0)
+		}
+	}
+	return cfg
+}
+
+// hassCmd runs the hass subcommands
+func hassCmd(args []string) {
+	if len(args) == 0 || args[0] != "cleanup" {
+		fmt.Fprintf(os.Stderr, "Usage: kraft hass cleanup [flags]\n")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("hass cleanup", flag.ExitOnError)
+	stateDir := fs.String("state.dir", "", "Directory kraft persists its state in")
+	names := fs.String("hass.name", "", "Comma separated list of device names to remove, in addition to what kraft has recorded")
+	prefix := fs.String("hass.prefix", haDefaultPrefix, "Home Assistant discovery prefix")
+	mqFlags := mqtt.MustFlags(fs.String, fs.Bool)
+	_ = fs.Parse(args[1:])
+
+	var rec haRecord
+	path := ""
+	if *stateDir != "" {
+		path = filepath.Join(*stateDir, haStateFile)
+		if err := persist.Load(path, &rec); err != nil {
+			log.Fatalf("reading %s: %v", path, err)
+		}
+	}
+	topics := rec.Topics
+	for _, name := range strings.Split(*names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			for _, t := range haTopics(*prefix, name) {
+				if !contains(topics, t) {
+					topics = append(topics, t)
+				}
+			}
+		}
+	}
+	if len(topics) == 0 {
+		log.Fatalf("nothing to remove, set -state.dir or -hass.name")
+	}
+
+	mq, err := mqtt.New(context.Background(), mqFlags())
+	if err != nil {
+		log.Fatalf("connecting to mqtt: %v", err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		_, err := mq.Start()
+		stopped <- err
+	}()
+	for _, t := range topics {
+		log.Printf("Removing %s", t)
+	}
+	haClear(mq, topics)
+	flushed := make(chan bool, 1)
+	go func() {
+		flushed <- flush(mq, 10*time.Second)
+	}()
+	select {
+	case err := <-stopped:
+		log.Fatalf("MQTT connection lost before the topics were removed: %v", err)
+	case ok := <-flushed:
+		if !ok {
+			log.Fatalf("timed out waiting for the broker to receive the removals")
+		}
+	}
+
+	if path != "" {
+		rec.Topics = nil
+		if err := persist.Save(path, &rec); err != nil {
+			log.Fatalf("saving %s: %v", path, err)
+		}
+	}
+}
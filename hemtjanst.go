@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/sensor"
+	"hemtjan.st/kraft/throttle"
+	"lib.hemtjan.st/client"
+	"lib.hemtjan.st/device"
+	"lib.hemtjan.st/feature"
+	"lib.hemtjan.st/transport/mqtt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+
+	// Re-use currentPower from hemtjanst for positive power (i.e. power flowing into the system from the grid)
+	currentPower = string(feature.CurrentPower)
+	// Define a custom feature for produced power (e.g. if exporting Solar power to the grid)
+	currentPowerProduced = "currentPowerProduced"
+	energyUsed           = string(feature.EnergyUsed)
+	energyProduced       = "energyProduced"
+	phaseCurrent         = "phase%dCurrent"
+	phaseVoltage         = "phase%dVoltage"
+
+	reactivePower          = "reactivePower"
+	reactivePowerProduced  = "reactivePowerProduced"
+	reactiveEnergyUsed     = "reactiveEnergyUsed"
+	reactiveEnergyProduced = "reactiveEnergyProduced"
+	netPower               = "netPower"
+	meterTimestamp         = "meterTimestamp"
+	// reachable is 1 while frames are arriving from the meter, and 0 otherwise
+	reachable = "reachable"
+)
+
+// hjConfig configures the Hemtjänst device
+type hjConfig struct {
+	Topic string
+	Name  string
+	// Policy decides which values are published, keyed by feature name
+	Policy []throttle.Rule
+	// StaleAfter is how long without frames before the meter is unreachable, 0 disables
+	StaleAfter time.Duration
+	// Phases and Rating describe the main fuse, used for the maximum of the
+	// current and power features. Unknown if 0.
+	Phases int
+	Rating float64
+	// Nominal is the nominal voltage
+	Nominal float64
+	// LeaveTopic and LastWill are the topic and payload of the last-will the
+	// broker publishes if the connection is lost, unused if either is empty
+	LeaveTopic string
+	LastWill   string
+}
+
+// hjValue is the value of a feature in a frame
+type hjValue struct {
+	name string
+	info feature.Info
+	unit string
+	// text is used instead of num if set
+	text      string
+	num       float64
+	precision int
+	// unset is a feature without a value in this frame
+	unset bool
+}
+
+// hjDevice publishes the meter as a Hemtjänst device
+type hjDevice struct {
+	mq     mqtt.MQTT
+	cfg    hjConfig
+	filter *throttle.Filter
+
+	mu sync.Mutex
+	d  client.Device
+	// tr is the transport of d, to drop its subscriptions when d is replaced
+	tr   *hjTransport
+	info *device.Info
+	// units holds the unit of each feature, published next to the device
+	units     map[string]string
+	lastFrame time.Time
+	reachable bool
+}
+
+func newHJDevice(mq mqtt.MQTT, cfg hjConfig) *hjDevice {
+	return &hjDevice{mq: mq, cfg: cfg, filter: throttle.New(cfg.Policy)}
+}
+
+// hjTransport records the topics a client.Device subscribes to, so that they
+// can be unsubscribed when the device is replaced. Otherwise the old device
+// would keep answering discovery with the features it was created with.
+type hjTransport struct {
+	mqtt.MQTT
+	topics []string
+}
+
+func (t *hjTransport) Subscribe(topic string) chan []byte {
+	t.topics = append(t.topics, topic)
+	return t.MQTT.Subscribe(topic)
+}
+
+// close unsubscribes all topics of the device
+func (t *hjTransport) close() {
+	for _, topic := range t.topics {
+		t.MQTT.Unsubscribe(topic)
+	}
+	t.topics = nil
+}
+
+// run marks the meter unreachable when frames stop arriving
+func (h *hjDevice) run() {
+	if h.cfg.StaleAfter <= 0 {
+		return
+	}
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for range tick.C {
+		h.mu.Lock()
+		if h.d != nil && h.reachable && time.Since(h.lastFrame) > h.cfg.StaleAfter {
+			h.reachable = false
+			_ = h.d.Feature(reachable).Update("0")
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Close reports the meter as unreachable and announces on the Hemtjänst leave
+// topic that kraft is going away, like the last-will does if the connection is lost
+func (h *hjDevice) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.d != nil {
+		h.reachable = false
+		_ = h.d.Feature(reachable).Update("0")
+	}
+	if h.cfg.LeaveTopic != "" && h.cfg.LastWill != "" {
+		h.mq.Publish(h.cfg.LeaveTopic, []byte(h.cfg.LastWill), false)
+	}
+}
+
+// unitsTopic returns the topic the units of the features are published on,
+// as the feature info of the Hemtjänst protocol has no unit
+func (h *hjDevice) unitsTopic() string {
+	return h.cfg.Topic + "/units"
+}
+
+// Update publishes msg and the derived values. The device is created from the
+// first frame with the meter identity, with the features of all values the
+// meter sends, including the hourly registers. It is only announced again if
+// a later frame has values that aren't features yet.
+func (h *hjDevice) Update(msg *kaifa.Message, sources []sensor.Source, values sensor.Values) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	vals := h.values(msg, sources, values)
+	if h.info == nil && msg.MeterID == nil {
+		// Short frames only contain the current power
+		return nil
+	}
+	if h.info == nil {
+		h.info = &device.Info{
+			Topic:        h.cfg.Topic,
+			Name:         h.cfg.Name,
+			Manufacturer: "Kaifa",
+			Features: map[string]*feature.Info{
+				reachable: {Max: 1, Step: 1},
+			},
+			Type: "energyMeter",
+		}
+		h.units = map[string]string{}
+	}
+	if msg.MeterID != nil {
+		h.info.SerialNumber = *msg.MeterID
+	}
+	if msg.MeterType != nil {
+		h.info.Model = *msg.MeterType
+	}
+
+	var added []string
+	for _, v := range vals {
+		if _, ok := h.info.Features[v.name]; !ok {
+			info := v.info
+			h.info.Features[v.name] = &info
+			if v.unit != "" {
+				h.units[v.name] = v.unit
+			}
+			added = append(added, v.name)
+		}
+	}
+	if len(added) > 0 {
+		if h.d != nil {
+			sort.Strings(added)
+			log.Printf("Announcing new features: %v", added)
+		}
+		if h.tr != nil {
+			// The new device subscribes again
+			h.tr.close()
+		}
+		tr := &hjTransport{MQTT: h.mq}
+		d, err := client.NewDevice(h.info, tr)
+		if err != nil {
+			// Start over with the next frame that carries the meter identity
+			h.info, h.d, h.tr = nil, nil, nil
+			return fmt.Errorf("creating device: %v", err)
+		}
+		h.d, h.tr = d, tr
+		h.filter = throttle.New(h.cfg.Policy)
+		h.reachable = false
+		if b, err := json.Marshal(h.units); err == nil {
+			h.mq.Publish(h.unitsTopic(), b, true)
+		}
+	}
+
+	now := time.Now()
+	for _, v := range vals {
+		if v.unset {
+			continue
+		}
+		if v.text != "" {
+			_ = h.d.Feature(v.name).Update(v.text)
+		} else if out, ok := h.filter.Offer(v.name, now, v.num); ok {
+			_ = h.d.Feature(v.name).Update(strconv.FormatFloat(out, 'f', v.precision, 64))
+		}
+	}
+	h.lastFrame = now
+	if !h.reachable {
+		h.reachable = true
+		_ = h.d.Feature(reachable).Update("1")
+	}
+	return nil
+}
+
+// values returns the feature values of msg
+func (h *hjDevice) values(msg *kaifa.Message, sources []sensor.Source, values sensor.Values) []hjValue {
+	// Limits from the main fuse, if known
+	var maxCurrent, maxPower int
+	if h.cfg.Rating > 0 {
+		maxCurrent = int(h.cfg.Rating)
+		maxPower = int(float64(h.cfg.Phases) * h.cfg.Rating * h.cfg.Nominal)
+	}
+
+	res := []hjValue{
+		{name: meterTimestamp, text: msg.Timestamp.Format(time.RFC3339)},
+	}
+	power := func(name, unit string, v *int32) {
+		if v != nil {
+			// Power in W or var
+			res = append(res, hjValue{name: name, info: feature.Info{Max: maxPower, Step: 1}, unit: unit, num: float64(*v)})
+		}
+	}
+	energy := func(name, unit string, v *int32) {
+		// The registers are only in the hourly frames, but are announced
+		// with the first frame to avoid announcing the device again
+		val := hjValue{name: name, unit: unit, precision: 3, unset: v == nil}
+		if v != nil {
+			// Convert Wh or varh to kWh or kvarh
+			val.num = float64(*v) / 1000
+		}
+		res = append(res, val)
+	}
+
+	// Power imported from the grid
+	power(currentPower, "W", msg.ActivePowerPositive)
+	// Power exported to the grid
+	power(currentPowerProduced, "W", msg.ActivePowerNegative)
+	power(reactivePower, "var", msg.ReactivePowerPositive)
+	power(reactivePowerProduced, "var", msg.ReactivePowerNegative)
+	if msg.ActivePowerPositive != nil && msg.ActivePowerNegative != nil {
+		res = append(res, hjValue{
+			name: netPower,
+			info: feature.Info{Min: -maxPower, Max: maxPower, Step: 1},
+			unit: "W",
+			num:  float64(*msg.ActivePowerPositive) - float64(*msg.ActivePowerNegative),
+		})
+	}
+
+	for _, ph := range msg.Phases {
+		// Current in Amperes
+		res = append(res, hjValue{
+			name:      fmt.Sprintf(phaseCurrent, ph.Index),
+			info:      feature.Info{Max: maxCurrent},
+			unit:      "A",
+			num:       ph.Current,
+			precision: 3,
+		})
+		// Voltage in Volts
+		res = append(res, hjValue{
+			name:      fmt.Sprintf(phaseVoltage, ph.Index),
+			info:      feature.Info{Max: int(h.cfg.Nominal * 1.5)},
+			unit:      "V",
+			num:       ph.Voltage,
+			precision: 1,
+		})
+	}
+
+	energy(energyUsed, "kWh", msg.ActiveEnergyPositive)
+	energy(energyProduced, "kWh", msg.ActiveEnergyNegative)
+	energy(reactiveEnergyUsed, "kvarh", msg.ReactiveEnergyPositive)
+	energy(reactiveEnergyProduced, "kvarh", msg.ReactiveEnergyNegative)
+
+	seen := map[string]bool{}
+	for _, v := range res {
+		seen[v.name] = true
+	}
+	for _, src := range sources {
+		for _, s := range src.Sensors() {
+			if seen[s.Feature] {
+				continue
+			}
+			v, ok := values[s.ID]
+			info := feature.Info{}
+			if s.Unit == "%" {
+				info.Max = 100
+			}
+			if s.Binary {
+				info.Max, info.Step = 1, 1
+			}
+			// Announced before there is a value, to avoid announcing the device again
+			res = append(res, hjValue{name: s.Feature, info: info, unit: s.Unit, num: v, precision: s.Precision, unset: !ok})
+		}
+	}
+	return res
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hemtjan.st/kraft/history"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const dateFormat = "2006-01-02"
+
+// historyCmd prints the rollups stored in the local history database
+func historyCmd(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	db := fs.String("db", "kraft.db", "Path to history database")
+	period := fs.String("period", string(history.Day), "Rollup period (hour, day or month)")
+	from := fs.String("from", "", "First date to include, YYYY-MM-DD (default start of current month)")
+	to := fs.String("to", "", "Date to stop at (exclusive), YYYY-MM-DD (default tomorrow)")
+	_ = fs.Parse(args)
+
+	p := history.Period(*period)
+	if !p.Valid() {
+		log.Fatalf("invalid period: %s", *period)
+	}
+
+	now := time.Now()
+	start := history.Month.Start(now)
+	end := history.Day.Next(now)
+	var err error
+	if *from != "" {
+		if start, err = time.ParseInLocation(dateFormat, *from, time.Local); err != nil {
+			log.Fatalf("invalid -from: %v", err)
+		}
+	}
+	if *to != "" {
+		if end, err = time.ParseInLocation(dateFormat, *to, time.Local); err != nil {
+			log.Fatalf("invalid -to: %v", err)
+		}
+	}
+
+	st, err := history.Open(*db, history.Config{})
+	if err != nil {
+		log.Fatalf("opening %s: %v", *db, err)
+	}
+	defer st.Close()
+
+	res, err := st.Rollups(p, start, end)
+	if err != nil {
+		log.Fatalf("reading rollups: %v", err)
+	}
+
+	layout := map[history.Period]string{
+		history.Hour:  "2006-01-02 15:04",
+		history.Day:   dateFormat,
+		history.Month: "2006-01",
+	}[p]
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	_, _ = fmt.Fprintln(w, "Start\tImport (kWh)\tExport (kWh)\tNet (kWh)\t")
+	var imp, exp int64
+	for _, r := range res {
+		imp += r.Import
+		exp += r.Export
+		_, _ = fmt.Fprintf(w, "%s\t%.3f\t%.3f\t%.3f\t\n", r.Start.Format(layout), kWh(r.Import), kWh(r.Export), kWh(r.Import-r.Export))
+	}
+	_, _ = fmt.Fprintf(w, "Total\t%.3f\t%.3f\t%.3f\t\n", kWh(imp), kWh(exp), kWh(imp-exp))
+	_ = w.Flush()
+}
+
+func kWh(wh int64) float64 {
+	return float64(wh) / 1000
+}
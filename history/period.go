@@ -0,0 +1,86 @@
+package history
+
+import (
+	"time"
+)
+
+// Period is the length of a rollup bucket
+type Period string
+
+const (
+	Hour  Period = "hour"
+	Day   Period = "day"
+	Month Period = "month"
+)
+
+// Periods lists all rollup periods, from shortest to longest
+var Periods = []Period{Hour, Day, Month}
+
+// Start returns the start of the bucket that t falls within
+func (p Period) Start(t time.Time) time.Time {
+	switch p {
+	case Hour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case Day:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case Month:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+	return t
+}
+
+// Next returns the start of the bucket following the one t falls within
+func (p Period) Next(t time.Time) time.Time {
+	s := p.Start(t)
+	switch p {
+	case Hour:
+		return s.Add(time.Hour)
+	case Day:
+		return s.AddDate(0, 0, 1)
+	case Month:
+		return s.AddDate(0, 1, 0)
+	}
+	return t
+}
+
+// Valid reports whether p is one of the known periods
+func (p Period) Valid() bool {
+	for _, v := range Periods {
+		if p == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Counter is a snapshot of the accumulated energy registers
+type Counter struct {
+	Timestamp time.Time
+	MeterID   string
+	// Import is ActiveEnergyPositive in Wh
+	Import int64
+	// Export is ActiveEnergyNegative in Wh
+	Export int64
+}
+
+// Delta returns the energy imported and exported between prev and cur.
+// ok is false if the snapshots can't be compared, i.e. they are from different
+// meters, out of order, or one of the registers went backwards.
+func Delta(prev, cur Counter) (imp, exp int64, ok bool) {
+	if prev.MeterID != cur.MeterID || !cur.Timestamp.After(prev.Timestamp) {
+		return 0, 0, false
+	}
+	imp = cur.Import - prev.Import
+	exp = cur.Export - prev.Export
+	if imp < 0 || exp < 0 {
+		return 0, 0, false
+	}
+	return imp, exp, true
+}
+
+// bucketTime returns the time used to select rollup buckets for a counter snapshot.
+// The registers are read at the turn of the hour, so a snapshot taken at 11:00:00
+// holds the energy used between 10:00 and 11:00.
+func bucketTime(ts time.Time) time.Time {
+	return ts.Add(-time.Second)
+}
@@ -0,0 +1,51 @@
+package history
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPeriodStart(t *testing.T) {
+	ts := time.Date(2020, 8, 20, 11, 27, 15, 0, time.UTC)
+
+	assert.Equal(t, time.Date(2020, 8, 20, 11, 0, 0, 0, time.UTC), Hour.Start(ts))
+	assert.Equal(t, time.Date(2020, 8, 20, 0, 0, 0, 0, time.UTC), Day.Start(ts))
+	assert.Equal(t, time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC), Month.Start(ts))
+
+	assert.Equal(t, time.Date(2020, 8, 20, 12, 0, 0, 0, time.UTC), Hour.Next(ts))
+	assert.Equal(t, time.Date(2020, 8, 21, 0, 0, 0, 0, time.UTC), Day.Next(ts))
+	assert.Equal(t, time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC), Month.Next(ts))
+
+	assert.True(t, Month.Valid())
+	assert.False(t, Period("week").Valid())
+}
+
+func TestBucketTime(t *testing.T) {
+	// The snapshot taken at midnight belongs to the last hour of the previous day
+	ts := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2020, 8, 31, 23, 0, 0, 0, time.UTC), Hour.Start(bucketTime(ts)))
+	assert.Equal(t, time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC), Month.Start(bucketTime(ts)))
+}
+
+func TestDelta(t *testing.T) {
+	ts := time.Date(2020, 8, 20, 11, 0, 0, 0, time.UTC)
+	prev := Counter{Timestamp: ts, MeterID: "1", Import: 31964337, Export: 8820719}
+
+	imp, exp, ok := Delta(prev, Counter{Timestamp: ts.Add(time.Hour), MeterID: "1", Import: 31965337, Export: 8820720})
+	assert.True(t, ok)
+	assert.Equal(t, int64(1000), imp)
+	assert.Equal(t, int64(1), exp)
+
+	// Register going backwards
+	_, _, ok = Delta(prev, Counter{Timestamp: ts.Add(time.Hour), MeterID: "1", Import: 100, Export: 8820720})
+	assert.False(t, ok)
+
+	// Different meter
+	_, _, ok = Delta(prev, Counter{Timestamp: ts.Add(time.Hour), MeterID: "2", Import: 31965337, Export: 8820720})
+	assert.False(t, ok)
+
+	// Out of order
+	_, _, ok = Delta(prev, Counter{Timestamp: ts, MeterID: "1", Import: 31965337, Export: 8820720})
+	assert.False(t, ok)
+}
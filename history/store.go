@@ -0,0 +1,253 @@
+package history
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hemtjan.st/kraft/kaifa"
+	"math"
+	"time"
+
+	// Pure-Go SQLite driver, registers itself as "sqlite"
+	_ "modernc.org/sqlite"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS reading (
+	ts INTEGER NOT NULL,
+	meter_id TEXT NOT NULL,
+	power_import INTEGER,
+	power_export INTEGER,
+	data TEXT NOT NULL,
+	PRIMARY KEY (meter_id, ts)
+);
+CREATE TABLE IF NOT EXISTS counter (
+	ts INTEGER NOT NULL,
+	meter_id TEXT NOT NULL,
+	import_wh INTEGER NOT NULL,
+	export_wh INTEGER NOT NULL,
+	PRIMARY KEY (meter_id, ts)
+);
+CREATE TABLE IF NOT EXISTS rollup (
+	period TEXT NOT NULL,
+	start INTEGER NOT NULL,
+	import_wh INTEGER NOT NULL,
+	export_wh INTEGER NOT NULL,
+	PRIMARY KEY (period, start)
+);
+`
+
+// Config controls what is stored and for how long
+type Config struct {
+	// Resolution is the minimum time between two stored raw readings, zero disables raw readings
+	Resolution time.Duration
+	// RawRetention is how long raw readings are kept, zero keeps them forever
+	RawRetention time.Duration
+	// Retention is how long the buckets of each rollup period are kept.
+	// Missing or zero entries keep them forever. Counter snapshots follow the
+	// hourly retention.
+	Retention map[Period]time.Duration
+}
+
+// Rollup is the energy imported and exported during one bucket
+type Rollup struct {
+	Period Period
+	Start  time.Time
+	// Import is the energy drawn from the grid in Wh
+	Import int64
+	// Export is the energy returned to the grid in Wh
+	Export int64
+}
+
+// Store keeps readings and rollups in an SQLite database
+type Store struct {
+	db  *sql.DB
+	cfg Config
+	// meterID is the meter of the last frame that carried it, short frames
+	// are taken to come from the same meter
+	meterID   string
+	lastRaw   time.Time
+	lastPrune time.Time
+}
+
+// Open opens (or creates) the database at path
+func Open(path string, cfg Config) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows a single writer
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("creating schema: %w", err)
+	}
+	return &Store{db: db, cfg: cfg}, nil
+}
+
+// Close closes the underlying database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Record stores msg according to the configured resolution and updates the
+// rollups when the message carries the energy registers.
+func (s *Store) Record(msg *kaifa.Message) error {
+	if msg.MeterID != nil {
+		s.meterID = *msg.MeterID
+	}
+	if s.meterID == "" {
+		// Short frames only contain the current power, and can't be tied to
+		// a meter until a frame with the meter ID has arrived
+		return nil
+	}
+	if s.cfg.Resolution > 0 && msg.Timestamp.Sub(s.lastRaw) >= s.cfg.Resolution {
+		if err := s.recordRaw(msg); err != nil {
+			return err
+		}
+		s.lastRaw = msg.Timestamp
+	}
+	if msg.EnergyTimestamp != nil && msg.ActiveEnergyPositive != nil && msg.ActiveEnergyNegative != nil {
+		c := Counter{
+			Timestamp: *msg.EnergyTimestamp,
+			MeterID:   s.meterID,
+			Import:    int64(*msg.ActiveEnergyPositive),
+			Export:    int64(*msg.ActiveEnergyNegative),
+		}
+		if err := s.recordCounter(c); err != nil {
+			return err
+		}
+	}
+	if msg.Timestamp.Sub(s.lastPrune) >= time.Hour {
+		if err := s.Prune(msg.Timestamp); err != nil {
+			return err
+		}
+		s.lastPrune = msg.Timestamp
+	}
+	return nil
+}
+
+func (s *Store) recordRaw(msg *kaifa.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		"INSERT OR REPLACE INTO reading (ts, meter_id, power_import, power_export, data) VALUES (?, ?, ?, ?, ?)",
+		msg.Timestamp.Unix(), s.meterID, nullInt(msg.ActivePowerPositive), nullInt(msg.ActivePowerNegative), string(data),
+	)
+	return err
+}
+
+func (s *Store) recordCounter(c Counter) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(
+		"INSERT OR IGNORE INTO counter (ts, meter_id, import_wh, export_wh) VALUES (?, ?, ?, ?)",
+		c.Timestamp.Unix(), c.MeterID, c.Import, c.Export,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		// The same snapshot is repeated until the next hour, only count it once
+		return err
+	}
+
+	prev := Counter{MeterID: c.MeterID}
+	var prevTs int64
+	err = tx.QueryRow(
+		"SELECT ts, import_wh, export_wh FROM counter WHERE meter_id = ? AND ts < ? ORDER BY ts DESC LIMIT 1",
+		c.MeterID, c.Timestamp.Unix(),
+	).Scan(&prevTs, &prev.Import, &prev.Export)
+	if err == sql.ErrNoRows {
+		return tx.Commit()
+	}
+	if err != nil {
+		return err
+	}
+	prev.Timestamp = time.Unix(prevTs, 0)
+
+	imp, exp, ok := Delta(prev, c)
+	if ok {
+		// After an outage the registers span several hours. The energy is
+		// spread evenly over them, as there is nothing better to go on.
+		hours := int64(math.Round(c.Timestamp.Sub(prev.Timestamp).Hours()))
+		if hours < 1 {
+			hours = 1
+		}
+		for i := int64(0); i < hours; i++ {
+			// The last hour ends at c, and gets what doesn't divide evenly
+			t := bucketTime(c.Timestamp.Add(-time.Duration(hours-1-i) * time.Hour))
+			hi, he := imp*(i+1)/hours-imp*i/hours, exp*(i+1)/hours-exp*i/hours
+			for _, p := range Periods {
+				_, err := tx.Exec(
+					`INSERT INTO rollup (period, start, import_wh, export_wh) VALUES (?, ?, ?, ?)
+					ON CONFLICT (period, start) DO UPDATE SET import_wh = import_wh + excluded.import_wh, export_wh = export_wh + excluded.export_wh`,
+					string(p), p.Start(t).Unix(), hi, he,
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Prune removes data that is older than the configured retention
+func (s *Store) Prune(now time.Time) error {
+	if d := s.cfg.RawRetention; d > 0 {
+		if _, err := s.db.Exec("DELETE FROM reading WHERE ts < ?", now.Add(-d).Unix()); err != nil {
+			return err
+		}
+	}
+	if d := s.cfg.Retention[Hour]; d > 0 {
+		if _, err := s.db.Exec("DELETE FROM counter WHERE ts < ?", now.Add(-d).Unix()); err != nil {
+			return err
+		}
+	}
+	for _, p := range Periods {
+		if d := s.cfg.Retention[p]; d > 0 {
+			if _, err := s.db.Exec("DELETE FROM rollup WHERE period = ? AND start < ?", string(p), now.Add(-d).Unix()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Rollups returns the buckets of period p that start within [from, to)
+func (s *Store) Rollups(p Period, from, to time.Time) ([]Rollup, error) {
+	rows, err := s.db.Query(
+		"SELECT start, import_wh, export_wh FROM rollup WHERE period = ? AND start >= ? AND start < ? ORDER BY start",
+		string(p), from.Unix(), to.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Rollup
+	for rows.Next() {
+		r := Rollup{Period: p}
+		var start int64
+		if err := rows.Scan(&start, &r.Import, &r.Export); err != nil {
+			return nil, err
+		}
+		r.Start = time.Unix(start, 0)
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+func nullInt(v *int32) interface{} {
+	if v == nil {
+		return nil
+	}
+	return int64(*v)
+}
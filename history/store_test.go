@@ -0,0 +1,125 @@
+package history
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/kaifa/kaifatest"
+	"testing"
+	"time"
+)
+
+var start = kaifatest.Start
+
+const meter = "6970631401234567"
+
+func open(t *testing.T, cfg Config) *Store {
+	s, err := Open(":memory:", cfg)
+	assert.NoError(t, err)
+	return s
+}
+
+func count(t *testing.T, s *Store, table string) int {
+	var n int
+	assert.NoError(t, s.db.QueryRow("SELECT COUNT(*) FROM "+table).Scan(&n))
+	return n
+}
+
+func TestRecord(t *testing.T) {
+	s := open(t, Config{Resolution: time.Minute})
+	defer s.Close()
+
+	// Short frames can't be tied to a meter before its ID is known
+	assert.NoError(t, s.Record(kaifatest.Power(start.Add(-time.Hour), 1000, 0)))
+	assert.Equal(t, 0, count(t, s, "reading"))
+
+	for ts := start.Add(time.Second); ts.Before(start.Add(5 * time.Minute)); ts = ts.Add(10 * time.Second) {
+		assert.NoError(t, s.Record(kaifatest.Meter(meter, kaifatest.Power(ts, 1000, 0))))
+	}
+	assert.Equal(t, 5, count(t, s, "reading"))
+	// Then they are taken to come from the same meter
+	assert.NoError(t, s.Record(kaifatest.Power(start.Add(time.Hour), 1000, 0)))
+	assert.Equal(t, 6, count(t, s, "reading"))
+
+	assert.NoError(t, s.Record(kaifatest.Meter(meter, kaifatest.Register(start, 10000, 500))))
+	assert.NoError(t, s.Record(kaifatest.Meter(meter, kaifatest.Register(start.Add(time.Hour), 11500, 500))))
+	// The register is repeated until the next hour
+	assert.NoError(t, s.Record(kaifatest.Meter(meter, kaifatest.Register(start.Add(time.Hour), 11500, 500))))
+	assert.NoError(t, s.Record(kaifatest.Meter(meter, kaifatest.Register(start.Add(2*time.Hour), 12000, 700))))
+
+	res, err := s.Rollups(Hour, start, start.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []Rollup{
+		{Period: Hour, Start: start, Import: 1500},
+		{Period: Hour, Start: start.Add(time.Hour), Import: 500, Export: 200},
+	}, utc(res))
+
+	res, err = s.Rollups(Day, start.Add(-24*time.Hour), start.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []Rollup{{Period: Day, Start: Day.Start(start), Import: 2000, Export: 200}}, utc(res))
+
+	// A register going backwards, e.g. a replaced meter, isn't counted
+	assert.NoError(t, s.Record(kaifatest.Meter(meter, kaifatest.Register(start.Add(3*time.Hour), 100, 0))))
+	res, err = s.Rollups(Month, Month.Start(start), Month.Next(start))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2000), res[0].Import)
+}
+
+func TestOutage(t *testing.T) {
+	s := open(t, Config{})
+	defer s.Close()
+
+	// Down from 22:00 to 02:00, the energy is spread over the four hours
+	// and the two days
+	night := time.Date(2020, 8, 20, 22, 0, 0, 0, time.UTC)
+	assert.NoError(t, s.Record(kaifatest.Meter(meter, kaifatest.Register(night, 10000, 0))))
+	assert.NoError(t, s.Record(kaifatest.Meter(meter, kaifatest.Register(night.Add(4*time.Hour), 10002, 0))))
+
+	res, err := s.Rollups(Hour, night, night.Add(4*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []Rollup{
+		{Period: Hour, Start: night},
+		{Period: Hour, Start: night.Add(time.Hour), Import: 1},
+		{Period: Hour, Start: night.Add(2 * time.Hour)},
+		{Period: Hour, Start: night.Add(3 * time.Hour), Import: 1},
+	}, utc(res))
+
+	res, err = s.Rollups(Day, Day.Start(night), Day.Start(night).AddDate(0, 0, 2))
+	assert.NoError(t, err)
+	assert.Equal(t, []Rollup{
+		{Period: Day, Start: Day.Start(night), Import: 1},
+		{Period: Day, Start: Day.Next(night), Import: 1},
+	}, utc(res))
+}
+
+func TestPrune(t *testing.T) {
+	s := open(t, Config{
+		Resolution:   time.Minute,
+		RawRetention: time.Hour,
+		Retention:    map[Period]time.Duration{Hour: 24 * time.Hour},
+	})
+	defer s.Close()
+
+	assert.NoError(t, s.Record(kaifatest.Meter(meter, kaifatest.Register(start, 10000, 0))))
+	assert.NoError(t, s.Record(kaifatest.Meter(meter, kaifatest.Register(start.Add(time.Hour), 11000, 0))))
+	assert.NoError(t, s.Prune(start.Add(2*time.Hour)))
+	assert.Equal(t, 1, count(t, s, "reading"))
+	assert.Equal(t, 2, count(t, s, "counter"))
+
+	assert.NoError(t, s.Prune(start.Add(48*time.Hour)))
+	assert.Equal(t, 0, count(t, s, "reading"))
+	assert.Equal(t, 0, count(t, s, "counter"))
+	res, err := s.Rollups(Hour, start, start.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, res)
+	// The days and months are kept
+	res, err = s.Rollups(Day, Day.Start(start), Day.Next(start))
+	assert.NoError(t, err)
+	assert.Len(t, res, 1)
+}
+
+// utc makes the bucket starts comparable, they are read back in local time
+func utc(res []Rollup) []Rollup {
+	for i := range res {
+		res[i].Start = res[i].Start.UTC()
+	}
+	return res
+}
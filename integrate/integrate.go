@@ -0,0 +1,38 @@
+// Package integrate turns the power readings into energy. The power is taken
+// to stay the same until the next reading.
+package integrate
+
+import (
+	"time"
+)
+
+// MaxGap is the longest time between two readings that is still integrated.
+// Over longer gaps, e.g. while frames were lost, the power isn't known.
+const MaxGap = 5 * time.Minute
+
+// Span returns the time from the reading at from until to, or 0 if to isn't
+// after from or the gap is too long to integrate
+func Span(from, to time.Time) time.Duration {
+	dt := to.Sub(from)
+	if from.IsZero() || dt <= 0 || dt > MaxGap {
+		return 0
+	}
+	return dt
+}
+
+// Split calls f for each part of the span from the reading at from until to,
+// split where next, which returns the start of the bucket after the one t is
+// in, starts a new hour or period. Nothing is called unless Span is non-zero.
+func Split(from, to time.Time, next func(t time.Time) time.Time, f func(start, end time.Time)) {
+	if Span(from, to) == 0 {
+		return
+	}
+	for t := from; t.Before(to); {
+		end := next(t)
+		if end.After(to) {
+			end = to
+		}
+		f(t, end)
+		t = end
+	}
+}
@@ -0,0 +1,37 @@
+package integrate
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2020, 8, 20, 10, 58, 0, 0, time.UTC)
+
+func TestSpan(t *testing.T) {
+	assert.Equal(t, 10*time.Second, Span(start, start.Add(10*time.Second)))
+	assert.Equal(t, MaxGap, Span(start, start.Add(MaxGap)))
+	assert.Zero(t, Span(start, start.Add(MaxGap+time.Second)))
+	assert.Zero(t, Span(start, start))
+	assert.Zero(t, Span(start, start.Add(-time.Second)))
+	assert.Zero(t, Span(time.Time{}, start))
+}
+
+func TestSplit(t *testing.T) {
+	hour := func(t time.Time) time.Time {
+		return t.Truncate(time.Hour).Add(time.Hour)
+	}
+	var parts [][2]time.Time
+	f := func(start, end time.Time) {
+		parts = append(parts, [2]time.Time{start, end})
+	}
+	Split(start, start.Add(4*time.Minute), hour, f)
+	assert.Equal(t, [][2]time.Time{
+		{start, start.Add(2 * time.Minute)},
+		{start.Add(2 * time.Minute), start.Add(4 * time.Minute)},
+	}, parts)
+
+	parts = nil
+	Split(start, start.Add(time.Hour), hour, f)
+	assert.Empty(t, parts)
+}
@@ -0,0 +1,42 @@
+package kaifa
+
+// Checksum calculates the HDLC frame check sequence (CRC-16/X.25) of data.
+// The result is in the byte order of the frame, i.e. as read by Unmarshal.
+func Checksum(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	crc = ^crc
+	// The checksum is sent least significant byte first
+	return crc<<8 | crc>>8
+}
+
+// VerifyChecksums checks the header and frame checksums of fr, a frame as
+// returned by Reader. Unmarshal doesn't verify them.
+func VerifyChecksums(fr []byte) (header, frame bool) {
+	if len(fr) >= 8 {
+		header = Checksum(fr[:6]) == order.Uint16(fr[6:8])
+	}
+	if len(fr) >= 2 {
+		frame = Checksum(fr[:len(fr)-2]) == order.Uint16(fr[len(fr)-2:])
+	}
+	return header, frame
+}
+
+// Header returns the HDLC header of the frame
+func (m *Message) Header() Header {
+	return m.header
+}
+
+// Meta returns the LLC header of the frame
+func (m *Message) Meta() Meta {
+	return m.meta
+}
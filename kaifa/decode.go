@@ -3,16 +3,141 @@ package kaifa
 import (
 	"encoding/binary"
 	"fmt"
+	"reflect"
 	"time"
 )
 
+// Element is a field read from a frame, see Annotate
+type Element struct {
+	// Offset is the position of the field in the frame
+	Offset int
+	Name   string
+	// Tag is the A-XDR type tag, 0 for the fixed fields of the frame header
+	Tag   uint8
+	Raw   []byte
+	Value interface{}
+}
+
+// DecodeError is returned when a frame can't be decoded
+type DecodeError struct {
+	// Offset is the position in the frame of the field that couldn't be read
+	Offset int
+	Field  string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s at offset %d: %v", e.Field, e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
 func Unmarshal(data []byte) (*Message, error) {
-	buf := NewBuffer(data)
+	return unmarshal(&decoder{data: data, buf: NewBuffer(data)})
+}
+
+// Annotate decodes data like Unmarshal, and also returns every field it read.
+// It is meant for inspecting frames that can't be decoded.
+func Annotate(data []byte) (*Message, []Element, error) {
+	var elems []Element
+	m, err := unmarshal(&decoder{
+		data:  data,
+		buf:   NewBuffer(data),
+		trace: func(e Element) { elems = append(elems, e) },
+	})
+	return m, elems, err
+}
+
+// decoder keeps track of the offset of each field
+type decoder struct {
+	data  []byte
+	buf   *Buffer
+	trace func(Element)
+}
+
+func (d *decoder) offset() int {
+	return len(d.data) - d.buf.Len()
+}
+
+// raw reads a fixed size field
+func (d *decoder) raw(name string, v interface{}) error {
+	start := d.offset()
+	if err := d.buf.ReadRaw(v); err != nil {
+		return d.fail(start, name, err)
+	}
+	d.note(start, name, 0, v)
+	return nil
+}
+
+// typed reads an A-XDR element
+func (d *decoder) typed(name string, v interface{}) error {
+	start := d.offset()
+	var tag uint8
+	if d.buf.Len() > 0 {
+		tag = (*d.buf)[0]
+	}
+	if err := d.buf.ReadType(v); err != nil {
+		return d.fail(start, name, err)
+	}
+	d.note(start, name, tag, v)
+	return nil
+}
+
+// timestamp reads a timestamp stored as an octet string
+func (d *decoder) timestamp(name string) (time.Time, error) {
+	start := d.offset()
+	var data []byte
+	if err := d.buf.ReadType(&data); err != nil {
+		return time.Time{}, d.fail(start, name, err)
+	}
+	ts, err := parseTimestamp(data)
+	if err != nil {
+		return ts, d.fail(start, name, err)
+	}
+	d.note(start, name, d.data[start], ts)
+	return ts, nil
+}
+
+// field is a named value to read
+type field struct {
+	name string
+	v    interface{}
+}
+
+// typedFields reads an A-XDR element into each field
+func (d *decoder) typedFields(fields []field) error {
+	for _, f := range fields {
+		if err := d.typed(f.name, f.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *decoder) note(start int, name string, tag uint8, v interface{}) {
+	if d.trace == nil {
+		return
+	}
+	d.trace(Element{
+		Offset: start,
+		Name:   name,
+		Tag:    tag,
+		Raw:    d.data[start:d.offset()],
+		Value:  reflect.Indirect(reflect.ValueOf(v)).Interface(),
+	})
+}
+
+func (d *decoder) fail(offset int, name string, err error) error {
+	return &DecodeError{Offset: offset, Field: name, Err: err}
+}
 
+func unmarshal(d *decoder) (*Message, error) {
 	var err error
 	m := &Message{}
 
-	if err := buf.ReadRaw(&m.header.Length); err != nil {
+	if err := d.raw("Length", &m.header.Length); err != nil {
 		return m, err
 	}
 	b0 := uint8((m.header.Length & 0xF800) >> 8)
@@ -20,30 +145,27 @@ func Unmarshal(data []byte) (*Message, error) {
 	m.header.Separator = (b0 & 0x08) > 0
 	m.header.Format = b0 & 0xF0
 
-	err = buf.ReadRaw(
-		&m.header.DestAddr,
-		&m.header.SrcAddr,
-		&m.header.ControlField,
-		&m.header.Checksum,
-		&m.meta.LsapDest,
-		&m.meta.LsapSrc,
-		&m.meta.LlcQuality,
-	)
-
-	if err != nil {
-		return m, err
+	fields := []field{
+		{"DestAddr", &m.header.DestAddr},
+		{"SrcAddr", &m.header.SrcAddr},
+		{"ControlField", &m.header.ControlField},
+		{"Checksum", &m.header.Checksum},
+		{"LsapDest", &m.meta.LsapDest},
+		{"LsapSrc", &m.meta.LsapSrc},
+		{"LlcQuality", &m.meta.LlcQuality},
+	}
+	for _, f := range fields {
+		if err := d.raw(f.name, f.v); err != nil {
+			return m, err
+		}
 	}
 	m.meta.Meta = make([]byte, 5)
-	if err := buf.ReadRaw(m.meta.Meta); err != nil {
+	if err := d.raw("Meta", m.meta.Meta); err != nil {
 		return m, err
 	}
 
 	// Read timestamp blob as LV Data
-	var tsData []byte
-	if err = buf.ReadType(&tsData); err != nil {
-		return m, err
-	}
-	if m.Timestamp, err = parseTimestamp(tsData); err != nil {
+	if m.Timestamp, err = d.timestamp("Timestamp"); err != nil {
 		return m, err
 	}
 
@@ -53,8 +175,9 @@ func Unmarshal(data []byte) (*Message, error) {
 	fullHdr := true
 	phases := 0
 
+	itemsAt := d.offset()
 	var itemCount uint8
-	if err := buf.ReadType(&itemCount); err != nil {
+	if err := d.typed("Items", &itemCount); err != nil {
 		return m, err
 	}
 
@@ -64,7 +187,8 @@ func Unmarshal(data []byte) (*Message, error) {
 		return m, nil
 	case 1:
 		// For a single item only the Active Power imported from the grid is reported
-		if err := buf.ReadType(m.ActivePowerPositive); err != nil {
+		m.ActivePowerPositive = new(int32)
+		if err := d.typed("ActivePowerPositive", m.ActivePowerPositive); err != nil {
 			return m, err
 		}
 
@@ -85,7 +209,7 @@ func Unmarshal(data []byte) (*Message, error) {
 		phases = 3
 		energy = true
 	default:
-		return m, fmt.Errorf("unsupported number of items: %d", itemCount)
+		return m, d.fail(itemsAt, "Items", fmt.Errorf("unsupported number of items: %d", itemCount))
 	}
 
 	if fullHdr {
@@ -97,15 +221,15 @@ func Unmarshal(data []byte) (*Message, error) {
 		m.ReactivePowerPositive = new(int32)
 		m.ReactivePowerNegative = new(int32)
 
-		err := buf.ReadType(
-			m.Version,
-			m.MeterID,
-			m.MeterType,
-			m.ActivePowerPositive,
-			m.ActivePowerNegative,
-			m.ReactivePowerPositive,
-			m.ReactivePowerNegative,
-		)
+		err := d.typedFields([]field{
+			{"Version", m.Version},
+			{"MeterID", m.MeterID},
+			{"MeterType", m.MeterType},
+			{"ActivePowerPositive", m.ActivePowerPositive},
+			{"ActivePowerNegative", m.ActivePowerNegative},
+			{"ReactivePowerPositive", m.ReactivePowerPositive},
+			{"ReactivePowerNegative", m.ReactivePowerNegative},
+		})
 		if err != nil {
 			return m, err
 		}
@@ -117,7 +241,7 @@ func Unmarshal(data []byte) (*Message, error) {
 		// First is current (Amperes) for each phase
 		for i := 0; i < phases; i++ {
 			var cur int32
-			if err := buf.ReadType(&cur); err != nil {
+			if err := d.typed(fmt.Sprintf("Phase%dCurrent", i+1), &cur); err != nil {
 				return m, err
 			}
 			m.Phases[i].Index = i + 1
@@ -127,44 +251,40 @@ func Unmarshal(data []byte) (*Message, error) {
 		// Then the voltage for each phase
 		for i := 0; i < phases; i++ {
 			var voltage int32
-			if err := buf.ReadType(&voltage); err != nil {
+			if err := d.typed(fmt.Sprintf("Phase%dVoltage", i+1), &voltage); err != nil {
 				return m, err
 			}
 			m.Phases[i].Voltage = float64(voltage) / 10
 		}
 	}
 	if energy {
-		var tsData []byte
-		if err := buf.ReadType(&tsData); err != nil {
-			return m, err
-		}
-		if ts, err := parseTimestamp(tsData); err != nil {
+		ts, err := d.timestamp("EnergyTimestamp")
+		if err != nil {
 			return m, err
-		} else {
-			m.EnergyTimestamp = &ts
 		}
+		m.EnergyTimestamp = &ts
 
 		m.ActiveEnergyPositive = new(int32)
 		m.ActiveEnergyNegative = new(int32)
 		m.ReactiveEnergyPositive = new(int32)
 		m.ReactiveEnergyNegative = new(int32)
-		err := buf.ReadType(
-			m.ActiveEnergyPositive,
-			m.ActiveEnergyNegative,
-			m.ReactiveEnergyPositive,
-			m.ReactiveEnergyNegative,
-		)
+		err = d.typedFields([]field{
+			{"ActiveEnergyPositive", m.ActiveEnergyPositive},
+			{"ActiveEnergyNegative", m.ActiveEnergyNegative},
+			{"ReactiveEnergyPositive", m.ReactiveEnergyPositive},
+			{"ReactiveEnergyNegative", m.ReactiveEnergyNegative},
+		})
 		if err != nil {
 			return m, err
 		}
 	}
 
-	if err := buf.ReadRaw(&m.checksum); err != nil {
+	if err := d.raw("FrameChecksum", &m.checksum); err != nil {
 		return m, err
 	}
 
-	if buf.Len() > 0 {
-		return m, fmt.Errorf("trailing data: %X", data)
+	if d.buf.Len() > 0 {
+		return m, d.fail(d.offset(), "end of frame", fmt.Errorf("trailing data: %X", []byte(*d.buf)))
 	}
 
 	return m, nil
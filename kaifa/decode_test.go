@@ -2,6 +2,7 @@ package kaifa
 
 import (
 	"bytes"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"testing"
 	"time"
@@ -91,3 +92,69 @@ func TestReader(t *testing.T) {
 	assert.Equal(t, int32(81560), *msg.ReactiveEnergyPositive)
 	assert.Equal(t, int32(4789275), *msg.ReactiveEnergyNegative)
 }
+
+func TestReaderFrames(t *testing.T) {
+	// Both frames arrive in the same read
+	d := NewReader(bytes.NewReader(append(append([]byte{}, testData...), testData...)))
+	for i := 0; i < 2; i++ {
+		fr, err := d.ReadFrame()
+		assert.NoError(t, err)
+		assert.Len(t, fr, len(testFrame)+2)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	fr := testData[1 : len(testData)-1]
+	msg, elems, err := Annotate(fr)
+	assert.NoError(t, err)
+	assert.Equal(t, "1234567890123456", *msg.MeterID)
+	assert.Equal(t, uint8(0xa0), msg.Header().Format)
+	assert.Equal(t, uint8(0xe6), msg.Meta().LsapDest)
+
+	byName := map[string]Element{}
+	for _, e := range elems {
+		byName[e.Name] = e
+	}
+	// Header fields, timestamp, item count, the items and the frame checksum
+	assert.Len(t, elems, 9+1+1+18+1)
+	assert.Equal(t, 41, byName["MeterID"].Offset)
+	assert.Equal(t, uint8(0x09), byName["MeterID"].Tag)
+	assert.Equal(t, "1234567890123456", byName["MeterID"].Value)
+	assert.Equal(t, []byte{0x06, 0x00, 0x00, 0x0a, 0xa9}, byName["ActivePowerNegative"].Raw)
+	assert.Equal(t, int32(2729), byName["ActivePowerNegative"].Value)
+	assert.Equal(t, msg.Timestamp, byName["Timestamp"].Value)
+	assert.Equal(t, 16, byName["Timestamp"].Offset)
+	assert.Equal(t, uint8(0), byName["DestAddr"].Tag)
+}
+
+func TestDecodeError(t *testing.T) {
+	fr := append([]byte{}, testData[1:len(testData)-1]...)
+	// MeterID is no longer an octet string followed by an int32, the type of
+	// ActivePowerPositive is wrong instead
+	fr[41+18+10] = 0x05
+	_, err := Unmarshal(fr)
+	var de *DecodeError
+	if assert.True(t, errors.As(err, &de)) {
+		assert.Equal(t, "ActivePowerPositive", de.Field)
+		assert.Equal(t, 69, de.Offset)
+		assert.Equal(t, ErrWrongType, de.Err)
+	}
+
+	// Truncated frame
+	_, err = Unmarshal(testData[1:50])
+	assert.EqualError(t, err, "MeterID at offset 41: unexpected EOF")
+}
+
+func TestChecksum(t *testing.T) {
+	fr := append([]byte{}, testData[1:len(testData)-1]...)
+	header, frame := VerifyChecksums(fr)
+	assert.True(t, header)
+	// The frame checksum of the test frame is made up
+	assert.False(t, frame)
+
+	sum := Checksum(fr[:len(fr)-2])
+	fr[len(fr)-2], fr[len(fr)-1] = byte(sum>>8), byte(sum)
+	header, frame = VerifyChecksums(fr)
+	assert.True(t, header)
+	assert.True(t, frame)
+}
@@ -0,0 +1,62 @@
+// Package kaifatest builds meter messages for the tests of the packages that
+// track the readings.
+package kaifatest
+
+import (
+	"hemtjan.st/kraft/kaifa"
+	"time"
+)
+
+// Start is a Thursday at 10:00 UTC
+var Start = time.Date(2020, 8, 20, 10, 0, 0, 0, time.UTC)
+
+// Power returns a frame at ts with the imported and exported power in W
+func Power(ts time.Time, imp, exp int32) *kaifa.Message {
+	return &kaifa.Message{Timestamp: ts, ActivePowerPositive: &imp, ActivePowerNegative: &exp}
+}
+
+// Register returns the frame with the energy registers in Wh read at ts,
+// which the meter sends 10 seconds later
+func Register(ts time.Time, imp, exp int32) *kaifa.Message {
+	return &kaifa.Message{
+		Timestamp:            ts.Add(10 * time.Second),
+		EnergyTimestamp:      &ts,
+		ActiveEnergyPositive: &imp,
+		ActiveEnergyNegative: &exp,
+	}
+}
+
+// Currents returns a frame at ts with the current of each phase in A, at 230 V
+func Currents(ts time.Time, a ...float64) *kaifa.Message {
+	msg := &kaifa.Message{Timestamp: ts}
+	for i, c := range a {
+		msg.Phases = append(msg.Phases, kaifa.Phase{Index: i + 1, Current: c, Voltage: 230})
+	}
+	return msg
+}
+
+// Voltages returns a frame at ts with the voltage of each phase in V
+func Voltages(ts time.Time, v ...float64) *kaifa.Message {
+	msg := &kaifa.Message{Timestamp: ts}
+	for i, u := range v {
+		msg.Phases = append(msg.Phases, kaifa.Phase{Index: i + 1, Voltage: u})
+	}
+	return msg
+}
+
+// Meter sets the meter ID of msg, which the long frames carry
+func Meter(id string, msg *kaifa.Message) *kaifa.Message {
+	msg.MeterID = &id
+	return msg
+}
+
+// Feed passes constant power frames every 10 seconds during [from, to) to
+// update, and returns the first error
+func Feed(update func(*kaifa.Message) error, from, to time.Time, imp, exp int32) error {
+	for ts := from; ts.Before(to); ts = ts.Add(10 * time.Second) {
+		if err := update(Power(ts, imp, exp)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -19,15 +19,16 @@ func NewReader(r io.Reader) Reader {
 
 func (r *reader) ReadFrame() ([]byte, error) {
 	for {
+		// A read can return more than one frame
+		if fr, err := r.tryFrame(); len(fr) > 0 || err != nil {
+			return fr, err
+		}
 		buf := make([]byte, 4096)
 		n, err := r.r.Read(buf)
 		if err != nil {
 			return nil, err
 		}
 		r.buf = append(r.buf, buf[0:n]...)
-		if fr, err := r.tryFrame(); len(fr) > 0 || err != nil {
-			return fr, err
-		}
 	}
 }
 
@@ -0,0 +1,20 @@
+package kaifa
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+	// Two frames in a single read, e.g. from a capture file or after a stall
+	r := NewReader(bytes.NewReader(append(append([]byte{}, testData...), testData...)))
+	for i := 0; i < 2; i++ {
+		fr, err := r.ReadFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, testData[1:len(testData)-1], fr)
+	}
+	_, err := r.ReadFrame()
+	assert.Equal(t, io.EOF, err)
+}
@@ -77,3 +77,46 @@ type Meta struct {
 	LlcQuality uint8
 	Meta       []byte
 }
+
+// Merge copies the values present in src into m, keeping the values of m that
+// src doesn't carry. The meter alternates between lists of different lengths,
+// merging them gives the latest known value of every field.
+func (m *Message) Merge(src *Message) {
+	m.header = src.header
+	m.meta = src.meta
+	m.checksum = src.checksum
+	m.Timestamp = src.Timestamp
+
+	mergeString(&m.Version, src.Version)
+	mergeString(&m.MeterID, src.MeterID)
+	mergeString(&m.MeterType, src.MeterType)
+	mergeInt(&m.ActivePowerPositive, src.ActivePowerPositive)
+	mergeInt(&m.ActivePowerNegative, src.ActivePowerNegative)
+	mergeInt(&m.ReactivePowerPositive, src.ReactivePowerPositive)
+	mergeInt(&m.ReactivePowerNegative, src.ReactivePowerNegative)
+	if len(src.Phases) > 0 {
+		m.Phases = append([]Phase(nil), src.Phases...)
+	}
+	if src.EnergyTimestamp != nil {
+		ts := *src.EnergyTimestamp
+		m.EnergyTimestamp = &ts
+	}
+	mergeInt(&m.ActiveEnergyPositive, src.ActiveEnergyPositive)
+	mergeInt(&m.ActiveEnergyNegative, src.ActiveEnergyNegative)
+	mergeInt(&m.ReactiveEnergyPositive, src.ReactiveEnergyPositive)
+	mergeInt(&m.ReactiveEnergyNegative, src.ReactiveEnergyNegative)
+}
+
+func mergeString(dst **string, src *string) {
+	if src != nil {
+		v := *src
+		*dst = &v
+	}
+}
+
+func mergeInt(dst **int32, src *int32) {
+	if src != nil {
+		v := *src
+		*dst = &v
+	}
+}
@@ -0,0 +1,46 @@
+package kaifa
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	full, err := Unmarshal(testData[1 : len(testData)-1])
+	assert.NoError(t, err)
+
+	power := int32(1234)
+	ts := full.Timestamp.Add(2 * time.Second)
+	short := &Message{Timestamp: ts, ActivePowerPositive: &power}
+
+	m := &Message{}
+	m.Merge(full)
+	m.Merge(short)
+
+	assert.Equal(t, ts, m.Timestamp)
+	assert.Equal(t, int32(1234), *m.ActivePowerPositive)
+	assert.Equal(t, int32(2729), *m.ActivePowerNegative)
+	assert.Equal(t, "1234567890123456", *m.MeterID)
+	assert.Len(t, m.Phases, 3)
+	assert.Equal(t, int32(31964337), *m.ActiveEnergyPositive)
+
+	// The merged message must not share values with its sources
+	power = 0
+	*full.MeterID = "0"
+	assert.Equal(t, int32(1234), *m.ActivePowerPositive)
+	assert.Equal(t, "1234567890123456", *m.MeterID)
+}
+
+func TestUnmarshalSingleItem(t *testing.T) {
+	frame := append([]byte{}, testFrame[:28]...)
+	frame = append(frame,
+		0x02, 0x01, // Number of fields = 1
+		0x06, 0x00, 0x00, 0x04, 0xd2, // int32 - active power positive
+		0x2e, 0x88, // footer checksum
+	)
+	msg, err := Unmarshal(append([]byte{0xa0, byte(len(frame) + 2)}, frame...))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1234), *msg.ActivePowerPositive)
+	assert.Nil(t, msg.MeterID)
+}
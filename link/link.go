@@ -0,0 +1,117 @@
+// Package link keeps statistics about the frames read from the meter, to
+// diagnose a poor serial connection.
+package link
+
+import (
+	"hemtjan.st/kraft/sensor"
+	"sync"
+	"time"
+)
+
+// Stats counts decoded and failed frames. It is safe for concurrent use.
+type Stats struct {
+	mu sync.Mutex
+	// recent is a ring buffer of the outcome of the last frames
+	recent []bool
+	pos, n int
+	errors int
+	last   time.Time
+}
+
+// New creates Stats where the link quality is calculated over the last window frames
+func New(window int) *Stats {
+	if window < 1 {
+		window = 1
+	}
+	return &Stats{recent: make([]bool, window)}
+}
+
+// Frame records a successfully decoded frame received at now
+func (s *Stats) Frame(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = now
+	s.add(true)
+}
+
+// Error records a frame that could not be decoded
+func (s *Stats) Error() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors++
+	s.add(false)
+}
+
+func (s *Stats) add(ok bool) {
+	s.recent[s.pos] = ok
+	s.pos = (s.pos + 1) % len(s.recent)
+	if s.n < len(s.recent) {
+		s.n++
+	}
+}
+
+// LastFrame returns when the last frame was decoded
+func (s *Stats) LastFrame() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// Errors returns the number of frames that could not be decoded since start
+func (s *Stats) Errors() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.errors
+}
+
+// Quality returns the share of recent frames that were decoded, in percent
+func (s *Stats) Quality() (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.quality()
+}
+
+func (s *Stats) quality() (float64, bool) {
+	if s.n == 0 {
+		return 0, false
+	}
+	ok := 0
+	for i := 0; i < s.n; i++ {
+		if s.recent[i] {
+			ok++
+		}
+	}
+	return float64(ok) / float64(s.n) * 100, true
+}
+
+// Sensors implements sensor.Source
+func (s *Stats) Sensors() []sensor.Sensor {
+	return []sensor.Sensor{
+		{
+			ID:         "decode_errors",
+			Feature:    "decodeErrors",
+			Name:       "Decode Errors",
+			StateClass: "total_increasing",
+			Category:   sensor.Diagnostic,
+		},
+		{
+			ID:         "link_quality",
+			Feature:    "linkQuality",
+			Name:       "Link Quality",
+			Unit:       "%",
+			StateClass: "measurement",
+			Category:   sensor.Diagnostic,
+		},
+	}
+}
+
+// Values implements sensor.Source
+func (s *Stats) Values() sensor.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := sensor.Values{"decode_errors": float64(s.errors)}
+	if q, ok := s.quality(); ok {
+		v["link_quality"] = q
+	}
+	return v
+}
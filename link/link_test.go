@@ -0,0 +1,30 @@
+package link
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	s := New(4)
+	_, ok := s.Quality()
+	assert.False(t, ok)
+	assert.Equal(t, 0.0, s.Values()["decode_errors"])
+
+	now := time.Date(2020, 8, 20, 10, 0, 0, 0, time.UTC)
+	s.Frame(now)
+	s.Error()
+	q, ok := s.Quality()
+	assert.True(t, ok)
+	assert.Equal(t, 50.0, q)
+
+	// Only the last 4 frames count towards the quality
+	for i := 1; i <= 4; i++ {
+		s.Frame(now.Add(time.Duration(i) * 10 * time.Second))
+	}
+	q, _ = s.Quality()
+	assert.Equal(t, 100.0, q)
+	assert.Equal(t, 1, s.Errors())
+	assert.Equal(t, now.Add(40*time.Second), s.LastFrame())
+}
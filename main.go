@@ -6,50 +6,185 @@ import (
 	"flag"
 	"fmt"
 	"github.com/tarm/serial"
+	"hemtjan.st/kraft/api"
+	"hemtjan.st/kraft/clock"
+	"hemtjan.st/kraft/derived"
+	"hemtjan.st/kraft/estimate"
+	"hemtjan.st/kraft/event"
+	"hemtjan.st/kraft/fuse"
+	"hemtjan.st/kraft/history"
 	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/link"
+	"hemtjan.st/kraft/netting"
+	"hemtjan.st/kraft/payload"
+	"hemtjan.st/kraft/peak"
+	"hemtjan.st/kraft/probe"
+	"hemtjan.st/kraft/quality"
+	"hemtjan.st/kraft/queue"
+	"hemtjan.st/kraft/register"
+	"hemtjan.st/kraft/rules"
+	"hemtjan.st/kraft/sdnotify"
+	"hemtjan.st/kraft/sensor"
+	"hemtjan.st/kraft/solar"
+	"hemtjan.st/kraft/tariff"
+	"hemtjan.st/kraft/throttle"
 	"io"
-	"lib.hemtjan.st/client"
-	"lib.hemtjan.st/device"
-	"lib.hemtjan.st/feature"
-	"lib.hemtjan.st/hass"
 	"lib.hemtjan.st/transport/mqtt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-const (
-
-	// Re-use currentPower from hemtjanst for positive power (i.e. power flowing into the system from the grid)
-	currentPower = string(feature.CurrentPower)
-	// Define a custom feature for produced power (e.g. if exporting Solar power to the grid)
-	currentPowerProduced = "currentPowerProduced"
-	energyUsed           = string(feature.EnergyUsed)
-	energyProduced       = "energyProduced"
-	phaseCurrent         = "phase%dCurrent"
-	phaseVoltage         = "phase%dVoltage"
-)
+// version is reported to Home Assistant, set with -ldflags "-X main.version=..."
+var version = "dev"
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "history":
+			historyCmd(os.Args[2:])
+			return
+		case "hass":
+			hassCmd(os.Args[2:])
+			return
+		case "decode":
+			decodeCmd(os.Args[2:])
+			return
+		case "probe":
+			probeCmd(os.Args[2:])
+			return
+		}
+	}
+
 	serialDevice := flag.String("device", "/dev/ttyUSB0", "Serial device")
 	baudFlag := flag.Int("speed", 2400, "Baud rate of serial port")
+	framing := flag.String("framing", "8E1", "Data bits, parity and stop bits of serial port")
+	autoDetectFlag := flag.Bool("auto", false, "Detect the serial settings at startup, overriding -speed and -framing")
 	topicName := flag.String("topic", "powerMeter/house", "Topic of hemtjanst device")
 	name := flag.String("name", "Grid", "Name of device")
 	haName := flag.String("hass.name", "grid", "Name of homeassistant device")
+	haEnable := flag.String("hass.enable", "", "Comma separated list of homeassistant entities to enable by default, e.g. reactive_power_import")
+	haDisable := flag.String("hass.disable", "", "Comma separated list of homeassistant entities to disable by default, e.g. phase_1_voltage")
+	haMeterChange := flag.String("hass.meter-change", haMigrate, "What to do when the meter is replaced: migrate keeps the entities and their history, new announces a new device")
+	haPrefix := flag.String("hass.prefix", haDefaultPrefix, "Home Assistant discovery prefix")
+	haStateTopic := flag.String("hass.state-topic", haDefaultState, "Topic template for the homeassistant state, {prefix}, {name} and {meter} are replaced")
+	haAvailTopic := flag.String("hass.availability-topic", haDefaultAvailability, "Topic template for the homeassistant availability and the last-will, {prefix} and {name} are replaced")
+	haFormat := flag.String("hass.format", string(payload.JSON), "Payload format of the homeassistant state: json, flat or tree")
+	haRetain := flag.Bool("hass.retain", true, "Publish the homeassistant state retained")
+	publishTopic := flag.String("publish.topic", "", "Topic template to publish the readings on, e.g. meter/{meter}, disabled if empty")
+	publishFormat := flag.String("publish.format", string(payload.JSON), "Payload format of -publish.topic: json, flat, tree or cbor")
+	publishRetain := flag.Bool("publish.retain", false, "Publish the readings retained")
+	publishPolicy := flag.String("publish.policy", "", "Publishing policy of -publish.topic")
+	haPolicy := flag.String("hass.policy", "", "Publishing policy of the homeassistant state, e.g. phase*_voltage:deadband=0.5,max=5m")
+	hjPolicy := flag.String("hemtjanst.policy", "", "Publishing policy of the hemtjanst features, e.g. phase*Voltage:window=30s,aggregate=mean")
+	hjStale := flag.Duration("hemtjanst.stale-timeout", time.Minute, "Report the meter as unreachable when no frame arrives within this time, 0 disables")
+	haStale := flag.Duration("hass.stale-timeout", time.Minute, "Mark the homeassistant device unavailable when no frame arrives within this time, 0 disables")
+	historyDB := flag.String("history.db", "", "Path to SQLite database for local history, disabled if empty")
+	historyRes := flag.Duration("history.resolution", time.Minute, "Minimum interval between stored raw readings, 0 disables raw readings")
+	historyRawRet := flag.Duration("history.retention.raw", 30*24*time.Hour, "How long to keep raw readings, 0 keeps forever")
+	historyHourRet := flag.Duration("history.retention.hour", 366*24*time.Hour, "How long to keep hourly rollups, 0 keeps forever")
+	historyDayRet := flag.Duration("history.retention.day", 0, "How long to keep daily rollups, 0 keeps forever")
+	historyMonthRet := flag.Duration("history.retention.month", 0, "How long to keep monthly rollups, 0 keeps forever")
+	httpListen := flag.String("http.listen", "", "Address to serve the HTTP API and dashboard on (e.g. :8080), disabled if empty")
+	httpReadyAge := flag.Duration("http.ready-age", 30*time.Second, "Longest time since the last decoded frame for /readyz to report ready")
+	httpLiveAge := flag.Duration("http.live-age", 30*time.Second, "Longest time without progress in the main loop for /healthz to report alive")
+	stateDir := flag.String("state.dir", "", "Directory to persist state in across restarts, state is not persisted if empty")
+	peakCount := flag.Int("peak.count", 0, "Number of monthly peak hours averaged by the capacity tariff, 0 disables peak tracking")
+	peakOnePerDay := flag.Bool("peak.one-per-day", false, "Only count the highest hour of each day as a peak")
+	peakWeekdays := flag.Bool("peak.weekdays", false, "Only count hours Monday to Friday as peaks")
+	peakHours := flag.String("peak.hours", "", "Only count hours within this range as peaks, e.g. 7-19")
+	nettingPeriod := flag.Duration("netting.period", 0, "Settlement period of net metering, e.g. 1h or 15m, disabled if 0")
+	solarTopic := flag.String("solar.topic", "", "MQTT topic with the solar production in W, disables the energy balance if empty")
+	solarKey := flag.String("solar.key", "", "Key of the production in JSON payloads on -solar.topic, e.g. ac.power, plain numbers if empty")
+	solarStale := flag.Duration("solar.stale", 5*time.Minute, "Time without production readings after which the production is taken to be 0")
+	tariffConfig := flag.String("tariff", "", "JSON file describing the tariff, disables cost tracking if empty")
+	tariffPrices := flag.String("tariff.prices", "", "JSON file or http:// URL with spot prices")
+	tariffRefresh := flag.Duration("tariff.refresh", 15*time.Minute, "How often to reload the spot prices")
+	fuseRating := flag.String("fuse", "", "Main fuse rating, e.g. 3x20 for three phases of 20 A, disables fuse monitoring if empty")
+	fuseWarning := flag.Float64("fuse.warning", 0.8, "Load of the main fuse, as a fraction of its rating, that raises a warning")
+	fuseCritical := flag.Float64("fuse.critical", 1.0, "Load of the main fuse, as a fraction of its rating, that raises a critical alarm")
+	fuseHold := flag.Duration("fuse.hold", 10*time.Second, "How long the load must stay above a threshold before the alarm is raised")
+	fuseHysteresis := flag.Float64("fuse.hysteresis", 0.05, "How far below a threshold, as a fraction of the rating, the load must fall to clear the alarm")
+	qualityEnabled := flag.Bool("quality", false, "Monitor voltage quality and publish voltage events")
+	qualityPhases := flag.Int("quality.phases", 3, "Number of phases to monitor the voltage of")
+	qualityNominal := flag.Float64("quality.nominal", 230, "Nominal voltage")
+	qualityTolerance := flag.Float64("quality.tolerance", 0.1, "Allowed deviation from the nominal voltage, as a fraction")
+	qualityOutage := flag.Duration("quality.outage-gap", time.Minute, "Time without frames that is reported as an outage")
+	clockEnabled := flag.Bool("clock", false, "Monitor the drift of the meter clock against the host clock")
+	clockThreshold := flag.Duration("clock.threshold", 30*time.Second, "Meter clock drift that raises an alarm, disabled if 0")
+	clockRefclock := flag.String("clock.refclock", "", "Path of a chrony SOCK refclock to send the meter clock to, disabled if empty")
+	clockMaxOffset := flag.Duration("clock.refclock.max-offset", 10*time.Second, "Largest offset of the meter clock that is sent to chrony, 0 sends all")
+	rulesConfig := flag.String("rules", "", "JSON file with alarm rules on the readings, disabled if empty")
+	queueSize := flag.Int("queue.size", 1000, "Number of energy registers and events to keep while the MQTT broker is unreachable")
+	queueGrace := flag.Duration("queue.grace", 30*time.Second, "Also replay messages published this long before the connection was found to be lost")
+	shutdownTimeout := flag.Duration("shutdown.timeout", 5*time.Second, "Longest time to spend shutting down before exiting anyway")
+	eventsTopic := flag.String("events.topic", "kraft/events", "MQTT topic to publish alarms and other events on, disabled if empty")
+	derivedEnabled := flag.Bool("derived", true, "Publish derived values like apparent power, power factor and net power")
+	estimateEnergy := flag.Bool("energy.estimate", false, "Publish energy counters estimated from the power readings between the hourly registers")
+	checkEnergy := flag.Bool("energy.check", true, "Reject energy registers that went backwards or increased faster than -energy.max-power")
+	energyMaxPower := flag.Float64("energy.max-power", 0, "Most power in W the connection can pass, derived from -fuse if 0")
 
 	mqFlags := mqtt.MustFlags(flag.String, flag.Bool)
 	flag.Parse()
 
-	ctx := context.Background()
-	mq, err := mqtt.New(ctx, mqFlags())
+	statePath := func(name string) string {
+		if *stateDir == "" {
+			return ""
+		}
+		return filepath.Join(*stateDir, name)
+	}
+
+	// The main fuse limits the current and power, unknown if -fuse is empty
+	var fusePhases int
+	var fuseAmps float64
+	if *fuseRating != "" {
+		var err error
+		if fusePhases, fuseAmps, err = fuse.ParseRating(*fuseRating); err != nil {
+			log.Fatalf("invalid -fuse: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mqCfg := mqFlags()
+	if *haName != "" {
+		// The broker marks the Home Assistant device unavailable if kraft
+		// dies without closing the connection
+		will, err := haWill(*haAvailTopic, *haPrefix, *haName)
+		if err != nil {
+			log.Fatalf("invalid -hass.availability-topic: %v", err)
+		}
+		mqCfg.WillTopic, mqCfg.WillPayload, mqCfg.WillRetain = will, haOffline, true
+	}
+	mq, err := mqtt.New(ctx, mqCfg)
 	if err != nil {
 		log.Fatalf("connecting to mqtt: %v", err)
 	}
 
+	// outbox holds the energy registers and events while the broker is unreachable
+	outbox, err := queue.Open(statePath("queue.json"), *queueSize, *queueGrace, mq.Publish)
+	if err != nil {
+		log.Fatalf("opening queue: %v", err)
+	}
+
 	// Spawn a goroutine to detect MQTT errors and handle reconnect
+	var mqReconnects int32
+	mqDone := make(chan struct{})
 	go func() {
+		defer close(mqDone)
 		for {
 			ok, err := mq.Start()
+			outbox.SetOnline(false)
+			if ctx.Err() != nil {
+				// Shutting down
+				return
+			}
 			if err != nil {
 				log.Printf("MQTT Error: %s", err)
 			}
@@ -58,203 +193,317 @@ func main() {
 			}
 			time.Sleep(3 * time.Second)
 			log.Printf("MQTT: Reconnecting")
+			atomic.AddInt32(&mqReconnects, 1)
 		}
 	}()
 
-	var d client.Device
+	var hist *history.Store
+	if *historyDB != "" {
+		hist, err = history.Open(*historyDB, history.Config{
+			Resolution:   *historyRes,
+			RawRetention: *historyRawRet,
+			Retention: map[history.Period]time.Duration{
+				history.Hour:  *historyHourRet,
+				history.Day:   *historyDayRet,
+				history.Month: *historyMonthRet,
+			},
+		})
+		if err != nil {
+			log.Fatalf("opening history database: %v", err)
+		}
+	}
 
-	var haDev *hass.Device
+	// sources are the modules deriving values that are published next to the meter readings
+	var sources []sensor.Source
 
-	// pushData gets called on each message
-	pushData := func(msg *kaifa.Message) {
-		if haDev == nil && *haName != "" {
-			uniqPrefix := "kaifa_" + *msg.MeterID
-			haDev = &hass.Device{
-				Device: &hass.DeviceInfo{
-					Identifiers:  []string{*msg.MeterID},
-					Manufacturer: "Kaifa",
-					Model:        *msg.MeterType,
-					Name:         *haName,
-					SwVersion:    *msg.Version,
-					SerialNumber: *msg.MeterID,
-				},
-				Origin: &hass.Origin{
-					Name:       "Kraft",
-					SwVersion:  "0.1.1",
-					SupportUrl: "https://github.com/hemtjanst/kraft",
-				},
-				Components: map[string]*hass.Component{},
-				StateTopic: "homeassistant/" + *haName + "/state",
-			}
-
-			if msg.ActivePowerPositive != nil {
-				haDev.Components["input_power"] = &hass.Component{
-					Platform:          "sensor",
-					Name:              "Input Power",
-					UnitOfMeasurement: "W",
-					ValueTemplate:     "{{ value_json.ActivePowerPositive }}",
-					StateClass:        "measurement",
-					DeviceClass:       "power",
-					UniqueId:          uniqPrefix + "_input_power",
-				}
-			}
-			if msg.ActivePowerNegative != nil {
-				haDev.Components["output_power"] = &hass.Component{
-					Platform:          "sensor",
-					Name:              "Output Power",
-					UnitOfMeasurement: "W",
-					ValueTemplate:     "{{ value_json.ActivePowerNegative }}",
-					StateClass:        "measurement",
-					DeviceClass:       "power",
-					UniqueId:          uniqPrefix + "_output_power",
-				}
-			}
-			for idx, ph := range msg.Phases {
-				n1 := fmt.Sprintf("phase_%d_current", ph.Index)
-				n2 := fmt.Sprintf("phase_%d_voltage", ph.Index)
-
-				haDev.Components[n1] = &hass.Component{
-					Platform:          "sensor",
-					Name:              fmt.Sprintf("Phase %d Current", ph.Index),
-					UnitOfMeasurement: "A",
-					ValueTemplate:     fmt.Sprintf("{{ value_json.Phases[%d].Current }}", idx),
-					StateClass:        "measurement",
-					DeviceClass:       "current",
-					UniqueId:          uniqPrefix + "_" + n1,
-				}
-				haDev.Components[n2] = &hass.Component{
-					Platform:          "sensor",
-					Name:              fmt.Sprintf("Phase %d Voltage", ph.Index),
-					UnitOfMeasurement: "V",
-					ValueTemplate:     fmt.Sprintf("{{ value_json.Phases[%d].Voltage }}", idx),
-					StateClass:        "measurement",
-					DeviceClass:       "voltage",
-					UniqueId:          uniqPrefix + "_" + n2,
-				}
-			}
-			if msg.ActiveEnergyPositive != nil {
-				haDev.Components["consumed_energy"] = &hass.Component{
-					Platform:          "sensor",
-					Name:              "Consumed Energy",
-					UnitOfMeasurement: "Wh",
-					ValueTemplate:     "{{ value_json.ActiveEnergyPositive }}",
-					StateClass:        "total_increasing",
-					DeviceClass:       "energy",
-					UniqueId:          uniqPrefix + "_consumed_energy",
-				}
+	linkStats := link.New(100)
+	sources = append(sources, linkStats)
+
+	var peaks *peak.Tracker
+	if *peakCount > 0 {
+		peakRules := peak.Rules{
+			Count:        *peakCount,
+			OnePerDay:    *peakOnePerDay,
+			WeekdaysOnly: *peakWeekdays,
+		}
+		if *peakHours != "" {
+			if _, err := fmt.Sscanf(*peakHours, "%d-%d", &peakRules.From, &peakRules.To); err != nil {
+				log.Fatalf("invalid -peak.hours %q: %v", *peakHours, err)
 			}
-			if msg.ActiveEnergyNegative != nil {
-				haDev.Components[*haName+"_returned_energy"] = &hass.Component{
-					Platform:          "sensor",
-					Name:              "Returned Energy",
-					UnitOfMeasurement: "Wh",
-					ValueTemplate:     "{{ value_json.ActiveEnergyNegative }}",
-					StateClass:        "total_increasing",
-					DeviceClass:       "energy",
-					UniqueId:          uniqPrefix + "_returned_energy",
+		}
+		peaks, err = peak.New(peakRules, statePath("peak.json"))
+		if err != nil {
+			log.Fatalf("creating peak tracker: %v", err)
+		}
+		sources = append(sources, peaks)
+	}
+
+	var netMeter *netting.Netting
+	if *nettingPeriod > 0 {
+		netMeter, err = netting.New(*nettingPeriod, statePath("netting.json"))
+		if err != nil {
+			log.Fatalf("creating net metering: %v", err)
+		}
+		sources = append(sources, netMeter)
+	}
+
+	var balance *solar.Balance
+	if *solarTopic != "" {
+		balance, err = solar.New(*solarStale, statePath("solar.json"))
+		if err != nil {
+			log.Fatalf("creating energy balance: %v", err)
+		}
+		sources = append(sources, balance)
+		go func() {
+			for b := range mq.Subscribe(*solarTopic) {
+				w, err := solar.ParsePower(b, *solarKey)
+				if err != nil {
+					log.Printf("Invalid production on %s: %v", *solarTopic, err)
+					continue
 				}
+				balance.SetProduction(w, time.Now())
 			}
-			b, err := json.Marshal(haDev)
-			if err == nil {
-				mq.Publish("homeassistant/device/"+*haName+"/config", b, true)
-			}
+		}()
+	}
+
+	var costs *tariff.Engine
+	if *tariffConfig != "" {
+		cfg, err := tariff.LoadConfig(*tariffConfig)
+		if err != nil {
+			log.Fatalf("loading tariff: %v", err)
+		}
+		var prices *tariff.Prices
+		if *tariffPrices != "" {
+			prices = &tariff.Prices{}
+			go tariff.Watch(*tariffPrices, prices, *tariffRefresh)
 		}
+		costs, err = tariff.New(cfg, prices, statePath("tariff.json"))
+		if err != nil {
+			log.Fatalf("creating tariff: %v", err)
+		}
+		sources = append(sources, costs)
+	}
 
-		if haDev != nil {
-			b, err := json.Marshal(msg)
-			if err == nil {
-				mq.Publish(haDev.StateTopic, b, true)
-			}
+	var metrics *derived.Metrics
+	if *derivedEnabled {
+		metrics = derived.New()
+		sources = append(sources, metrics)
+	}
+
+	var estimator *estimate.Estimator
+	if *estimateEnergy {
+		estimator, err = estimate.New(statePath("estimate.json"))
+		if err != nil {
+			log.Fatalf("creating energy estimate: %v", err)
 		}
+		sources = append(sources, estimator)
+	}
 
-		if d == nil && *topicName != "" {
-			// Device is created once the first message is received
-			// since we need to know which features are supported
-			// and the model/serial number
+	var fuseMon *fuse.Monitor
+	if *fuseRating != "" {
+		fuseMon, err = fuse.New(fuse.Config{
+			Phases:     fusePhases,
+			Rating:     fuseAmps,
+			Warning:    *fuseWarning,
+			Critical:   *fuseCritical,
+			Hold:       *fuseHold,
+			Hysteresis: *fuseHysteresis,
+		})
+		if err != nil {
+			log.Fatalf("creating fuse monitor: %v", err)
+		}
+		sources = append(sources, fuseMon)
+	}
 
-			var err error
-			info := &device.Info{
-				Topic:        *topicName,
-				Name:         *name,
-				Manufacturer: "Kaifa",
-				Features:     map[string]*feature.Info{},
-				Type:         "energyMeter",
-			}
-			if msg.MeterID != nil {
-				info.SerialNumber = *msg.MeterID
-			}
-			if msg.MeterType != nil {
-				info.Model = *msg.MeterType
-			}
+	var registers *register.Checker
+	if *checkEnergy {
+		cfg := register.Config{MaxPower: *energyMaxPower}
+		if cfg.MaxPower == 0 && fuseAmps > 0 {
+			// Fuses pass up to about 1.45 times their rating for an hour before tripping
+			cfg.MaxPower = float64(fusePhases) * fuseAmps * fuse.Voltage * 1.5
+		}
+		if cfg.MaxPower == 0 {
+			log.Printf("Neither -energy.max-power nor -fuse is set, energy registers are only checked for going backwards")
+		}
+		registers, err = register.New(cfg, statePath("registers.json"))
+		if err != nil {
+			log.Fatalf("creating register checker: %v", err)
+		}
+	}
 
-			if msg.ActivePowerPositive != nil {
-				info.Features[currentPower] = &feature.Info{}
-			}
-			if msg.ActivePowerNegative != nil {
-				info.Features[currentPowerProduced] = &feature.Info{}
-			}
+	var clockMon *clock.Monitor
+	var refclock *clock.Refclock
+	refclockFailing := false
+	if *clockEnabled {
+		clockMon = clock.New(clock.Config{Threshold: *clockThreshold, Window: 31})
+		sources = append(sources, clockMon)
+	}
+	if *clockRefclock != "" {
+		if refclock, err = clock.DialRefclock(*clockRefclock, *clockMaxOffset); err != nil {
+			log.Fatalf("connecting to refclock: %v", err)
+		}
+	}
 
-			for _, ph := range msg.Phases {
-				info.Features[fmt.Sprintf(phaseCurrent, ph.Index)] = &feature.Info{}
-				info.Features[fmt.Sprintf(phaseVoltage, ph.Index)] = &feature.Info{}
-			}
+	var qualityMon *quality.Monitor
+	if *qualityEnabled {
+		qualityMon, err = quality.New(quality.Config{
+			Phases:       *qualityPhases,
+			Nominal:      *qualityNominal,
+			Tolerance:    *qualityTolerance,
+			Interruption: 0.05,
+			DipDuration:  time.Minute,
+			OutageGap:    *qualityOutage,
+		})
+		if err != nil {
+			log.Fatalf("creating voltage quality monitor: %v", err)
+		}
+		sources = append(sources, qualityMon)
+	}
+
+	var ruleEngine *rules.Engine
+	if *rulesConfig != "" {
+		cfg, err := rules.LoadConfig(*rulesConfig)
+		if err == nil {
+			ruleEngine, err = rules.New(cfg)
+		}
+		if err != nil {
+			log.Fatalf("loading rules: %v", err)
+		}
+		sources = append(sources, ruleEngine)
+	}
 
-			if msg.ActiveEnergyPositive != nil {
-				info.Features[energyUsed] = &feature.Info{}
+	// publishEvents logs events and publishes them to the events topic
+	publishEvents := func(evs []event.Event) {
+		for _, ev := range evs {
+			log.Printf("Event %s/%s (%s): %s", ev.Source, ev.Type, ev.Level, ev.Message)
+			if *eventsTopic == "" {
+				continue
 			}
-			if msg.ActiveEnergyNegative != nil {
-				info.Features[energyProduced] = &feature.Info{}
+			if b, err := json.Marshal(ev); err == nil {
+				outbox.Publish(queue.Message{Topic: *eventsTopic, Payload: b, Time: time.Now()})
 			}
+		}
+	}
 
-			d, err = client.NewDevice(info, mq)
-			if err != nil {
-				log.Fatalf("error creating device: %v", err)
-			}
+	var apiSrv *api.Server
+	// httpErr receives the error the HTTP server stopped with
+	var httpErr chan error
+	if *httpListen != "" {
+		apiSrv = api.New()
+		httpErr = make(chan error, 1)
+		go func() {
+			httpErr <- http.ListenAndServe(*httpListen, apiSrv)
+		}()
+	}
+
+	var hj *hjDevice
+	if *topicName != "" {
+		cfg := hjConfig{
+			Topic:      *topicName,
+			Name:       *name,
+			Policy:     parsePolicy("hemtjanst.policy", *hjPolicy),
+			StaleAfter: *hjStale,
+			Nominal:    *qualityNominal,
+			LeaveTopic: mqCfg.LeaveTopic,
+			LastWill:   mqCfg.ClientID,
 		}
+		cfg.Phases, cfg.Rating = fusePhases, fuseAmps
+		hj = newHJDevice(mq, cfg)
+		go hj.run()
+	}
 
-		if msg.ActivePowerPositive != nil {
-			// Power imported from the grid in Watts
-			if d != nil {
-				_ = d.Feature(currentPower).Update(fmt.Sprintf("%d", *msg.ActivePowerPositive))
-			}
+	var ha *haPublisher
+	if *haName != "" {
+		format, err := payload.ParseFormat(*haFormat)
+		if err != nil {
+			log.Fatalf("invalid -hass.format: %v", err)
 		}
-		if msg.ActivePowerNegative != nil {
-			// Power exported to the grid in Watts
-			if d != nil {
-				_ = d.Feature(currentPowerProduced).Update(fmt.Sprintf("%d", *msg.ActivePowerNegative))
-			}
+		ha, err = newHAPublisher(mq, haConfig{
+			Name:              *haName,
+			Prefix:            *haPrefix,
+			StateTopic:        *haStateTopic,
+			AvailabilityTopic: *haAvailTopic,
+			Format:            format,
+			Retain:            *haRetain,
+			Policy:            parsePolicy("hass.policy", *haPolicy),
+			Queue:             outbox,
+			StaleAfter:        *haStale,
+			Enabled:           haEntities(*haEnable, *haDisable),
+			StatePath:         statePath(haStateFile),
+			MeterChange:       *haMeterChange,
+		})
+		if err != nil {
+			log.Fatalf("creating Home Assistant publisher: %v", err)
 		}
+		go ha.run()
+	}
 
-		for _, ph := range msg.Phases {
-			if d != nil {
-				// Current in Amperes
-				_ = d.Feature(fmt.Sprintf(phaseCurrent, ph.Index)).Update(fmt.Sprintf("%.3f", ph.Current))
-				// Voltage in Volts
-				_ = d.Feature(fmt.Sprintf(phaseVoltage, ph.Index)).Update(fmt.Sprintf("%.1f", ph.Voltage))
-			}
+	go watchBroker(mq, outbox, func() {
+		if ha != nil {
+			ha.Reconnected()
 		}
+	})
 
-		if msg.ActiveEnergyPositive != nil {
-			if d != nil {
-				// Convert to float and divide by 1000 to get kWh
-				_ = d.Feature(energyUsed).Update(fmt.Sprintf("%.3f", float64(*msg.ActiveEnergyPositive)/1000))
-			}
+	// readings publishes every reading on -publish.topic, nil if disabled
+	var readings *sink
+	if *publishTopic != "" {
+		format, err := payload.ParseFormat(*publishFormat)
+		if err != nil {
+			log.Fatalf("invalid -publish.format: %v", err)
+		}
+		readings = &sink{mq: mq, format: format, retain: *publishRetain, queue: outbox}
+		if policy := parsePolicy("publish.policy", *publishPolicy); len(policy) > 0 {
+			readings.filter = throttle.New(policy)
 		}
-		if msg.ActiveEnergyNegative != nil {
-			if d != nil {
-				// Convert to float and divide by 1000 to get kWh
-				_ = d.Feature(energyProduced).Update(fmt.Sprintf("%.3f", float64(*msg.ActiveEnergyNegative)/1000))
+	}
+	var meterID string
+
+	// aggregate collects the sensors and current values of all sources, once
+	// per frame for the rules and the publishers
+	aggregate := func() ([]sensor.Sensor, sensor.Values) {
+		var sensors []sensor.Sensor
+		values := sensor.Values{}
+		for _, src := range sources {
+			sensors = append(sensors, src.Sensors()...)
+			for k, v := range src.Values() {
+				values[k] = v
 			}
 		}
+		return sensors, values
+	}
 
+	// pushData gets called on each message
+	pushData := func(msg *kaifa.Message, sensors []sensor.Sensor, values sensor.Values) {
+		if ha != nil {
+			ha.Update(msg, sources, values)
+		}
+
+		if msg.MeterID != nil {
+			meterID = *msg.MeterID
+		}
+		if readings != nil && (meterID != "" || !strings.Contains(*publishTopic, "{meter}")) {
+			st := &payload.State{Message: msg, Kraft: values, Received: time.Now(), Sensors: sensors}
+			readings.publishState(payload.Topic(*publishTopic, map[string]string{"meter": meterID}), st)
+		}
+
+		if hj != nil {
+			if err := hj.Update(msg, sources, values); err != nil {
+				log.Printf("Error publishing to Hemtjänst: %v", err)
+			}
+		}
 	}
 
-	cfg := &serial.Config{
-		Name:   *serialDevice,
-		Baud:   *baudFlag,
-		Parity: serial.ParityEven,
-		Size:   8,
+	settings := probe.Settings{Baud: *baudFlag}
+	if settings.Size, settings.Parity, settings.StopBits, err = probe.ParseFraming(*framing); err != nil {
+		log.Fatalf("invalid -framing: %v", err)
+	}
+	if *autoDetectFlag {
+		if settings, err = autoDetect(*serialDevice, 5*time.Second); err != nil {
+			log.Fatalf("detecting serial settings: %v", err)
+		}
+		log.Printf("Detected Kaifa meter at %s", settings)
 	}
+	cfg := serialConfig(*serialDevice, settings)
 
 	// Open serial to read & discard everything for 200ms to drain incoming buffer
 	s, err := serial.OpenPort(cfg)
@@ -271,23 +520,295 @@ func main() {
 	if err != nil {
 		log.Fatalf("error opening %s: %v", *serialDevice, err)
 	}
-	r := kaifa.NewReader(s)
+	serialOpen := int32(1)
+	// serialReconnects counts how often the serial device was reopened after an error
+	var serialReconnects int32
+
+	// Notifies systemd if run as a Type=notify service
+	notifier, err := sdnotify.New()
+	if err != nil {
+		log.Printf("Error connecting to systemd: %v", err)
+	}
+	go superviseSystemd(notifier, linkStats, outbox)
+
+	// stopReading ends the goroutine reading frames on shutdown
+	stopReading := make(chan struct{})
+
+	// shutdown announces that kraft is going away, saves the state and exits
+	// with code, or 1 if that takes longer than -shutdown.timeout
+	shutdown := func(code int) {
+		_ = notifier.Notify(sdnotify.Stopping)
+		atomic.StoreInt32(&serialOpen, 0)
+		close(stopReading)
+		_ = s.Close()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if ha != nil {
+				ha.Close()
+			}
+			if hj != nil {
+				hj.Close()
+			}
+			if peaks != nil {
+				if err := peaks.Save(); err != nil {
+					log.Printf("Error saving peaks: %v", err)
+				}
+			}
+			if netMeter != nil {
+				if err := netMeter.Save(); err != nil {
+					log.Printf("Error saving net metering: %v", err)
+				}
+			}
+			if balance != nil {
+				if err := balance.Save(); err != nil {
+					log.Printf("Error saving energy balance: %v", err)
+				}
+			}
+			if estimator != nil {
+				if err := estimator.Save(); err != nil {
+					log.Printf("Error saving energy estimate: %v", err)
+				}
+			}
+			if hist != nil {
+				_ = hist.Close()
+			}
+			if refclock != nil {
+				_ = refclock.Close()
+			}
+			// Publishing is asynchronous, wait for the broker to have
+			// received everything before disconnecting
+			if outbox.Online() {
+				if flush(mq, *shutdownTimeout) {
+					outbox.Delivered()
+				} else {
+					log.Printf("Timed out waiting for the MQTT broker")
+				}
+			}
+			cancel()
+			<-mqDone
+			_ = notifier.Close()
+		}()
+		select {
+		case <-done:
+		case <-time.After(*shutdownTimeout):
+			log.Printf("Shutdown timed out after %s", *shutdownTimeout)
+			code = 1
+		}
+		os.Exit(code)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	// Frames are read in the background so that a signal isn't held up by a blocking read
+	type result struct {
+		fr  []byte
+		err error
+		// at is when the frame was received
+		at time.Time
+	}
+	frames := make(chan result)
+	read := func(r kaifa.Reader) {
+		for {
+			fr, err := r.ReadFrame()
+			select {
+			case frames <- result{fr, err, time.Now()}:
+			case <-stopReading:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	go read(kaifa.NewReader(s))
+
+	// reopened receives the serial device once it has been opened again
+	// after an error
+	reopened := make(chan *serial.Port)
+	reopen := func() {
+		for {
+			select {
+			case <-time.After(3 * time.Second):
+			case <-stopReading:
+				return
+			}
+			p, err := serial.OpenPort(cfg)
+			if err != nil {
+				log.Printf("Error reopening %s: %v", *serialDevice, err)
+				continue
+			}
+			select {
+			case reopened <- p:
+				return
+			case <-stopReading:
+				_ = p.Close()
+				return
+			}
+		}
+	}
+
+	// lastLoop is when the main loop last made progress, for /healthz
+	lastLoop := time.Now().UnixNano()
+	heartbeat := time.NewTicker(time.Second)
+	defer heartbeat.Stop()
+	if apiSrv != nil {
+		apiSrv.SetHealth(api.Health{
+			Status: func() api.Status {
+				return api.Status{
+					LastFrame:        linkStats.LastFrame(),
+					LastLoop:         time.Unix(0, atomic.LoadInt64(&lastLoop)),
+					DecodeErrors:     linkStats.Errors(),
+					SerialOpen:       atomic.LoadInt32(&serialOpen) == 1,
+					BrokerOnline:     outbox.Online(),
+					BrokerReconnects: int(atomic.LoadInt32(&mqReconnects)),
+					SerialReconnects: int(atomic.LoadInt32(&serialReconnects)),
+					Queued:           outbox.Len(),
+				}
+			},
+			MaxFrameAge: *httpReadyAge,
+			MaxLoopAge:  *httpLiveAge,
+		})
+	}
 
 	for {
 		// Main loop, keep reading frames until serial closes or program is terminated
-		fr, err := r.ReadFrame()
+		atomic.StoreInt64(&lastLoop, time.Now().UnixNano())
+		var res result
+		select {
+		case sig := <-sigs:
+			log.Printf("Received %s, shutting down", sig)
+			shutdown(0)
+		case err := <-httpErr:
+			log.Printf("HTTP server: %v", err)
+			shutdown(1)
+		case <-heartbeat.C:
+			if ruleEngine != nil {
+				publishEvents(ruleEngine.Tick(time.Now()))
+			}
+			continue
+		case p := <-reopened:
+			log.Printf("Reopened %s", *serialDevice)
+			s = p
+			atomic.StoreInt32(&serialOpen, 1)
+			atomic.AddInt32(&serialReconnects, 1)
+			go read(kaifa.NewReader(s))
+			continue
+		case res = <-frames:
+		}
+		fr, err := res.fr, res.err
 		if err != nil {
 			if err == io.EOF {
-				log.Printf("EOF from serial device, exiting")
-				return
+				log.Printf("EOF from serial device, reopening")
+			} else {
+				log.Printf("error while reading frame: %v, reopening", err)
 			}
-			log.Fatalf("error while reading frame: %v", err)
+			// The meter or the adapter went away, try again until it is back
+			atomic.StoreInt32(&serialOpen, 0)
+			_ = s.Close()
+			go reopen()
+			continue
 		}
 		msg, err := kaifa.Unmarshal(fr)
 		if err != nil {
-			log.Fatalf("Error unmarshalling frame: %v\nData: %X", err, fr)
+			// Usually noise on the serial line, the next frame is likely fine
+			log.Printf("Error unmarshalling frame: %v\nData: %X", err, fr)
+			linkStats.Error()
+			continue
+		}
+		linkStats.Frame(res.at)
+
+		if registers != nil {
+			// Implausible registers are removed before anything else sees them
+			evs, err := registers.Check(msg)
+			if err != nil {
+				log.Printf("Error saving registers: %v", err)
+			}
+			publishEvents(evs)
+		}
+
+		if peaks != nil {
+			if err := peaks.Update(msg); err != nil {
+				log.Printf("Error tracking peaks: %v", err)
+			}
+		}
+
+		if netMeter != nil {
+			if err := netMeter.Update(msg); err != nil {
+				log.Printf("Error tracking net metering: %v", err)
+			}
+		}
+		if balance != nil {
+			if err := balance.Update(msg, res.at); err != nil {
+				log.Printf("Error tracking energy balance: %v", err)
+			}
+		}
+		if costs != nil {
+			if err := costs.Update(msg); err != nil {
+				log.Printf("Error pricing energy: %v", err)
+			}
+		}
+
+		if metrics != nil {
+			metrics.Update(msg)
+		}
+		if estimator != nil {
+			if err := estimator.Update(msg); err != nil {
+				log.Printf("Error estimating energy: %v", err)
+			}
+		}
+
+		if fuseMon != nil {
+			publishEvents(fuseMon.Update(msg))
+		}
+		if qualityMon != nil {
+			publishEvents(qualityMon.Update(msg))
+		}
+		if clockMon != nil {
+			publishEvents(clockMon.Update(msg, res.at))
+		}
+		if refclock != nil && (clockMon == nil || !clockMon.Alarm()) {
+			// Only the first of a run of errors is logged, the socket is
+			// dialled again on every frame until chrony is back
+			err := refclock.Send(res.at, clock.Offset(msg, res.at))
+			if err != nil && !refclockFailing {
+				log.Printf("Error sending to refclock: %v", err)
+			} else if err == nil && refclockFailing {
+				log.Printf("Sending to refclock again")
+			}
+			refclockFailing = err != nil
+		}
+
+		sensors, values := aggregate()
+		if ruleEngine != nil {
+			// Rules see the same values as the flat payload
+			st := &payload.State{Message: msg, Kraft: values, Sensors: sensors}
+			publishEvents(ruleEngine.Update(rules.Values(st), res.at))
+			// The rules are a source too, and have just changed
+			for k, v := range ruleEngine.Values() {
+				values[k] = v
+			}
+		}
+
+		pushData(msg, sensors, values)
+
+		if apiSrv != nil {
+			apiSrv.Update(msg)
+		}
+		if hist != nil {
+			if err := hist.Record(msg); err != nil {
+				log.Printf("Error storing history: %v", err)
+			}
 		}
+	}
+}
 
-		pushData(msg)
+// parsePolicy parses the publishing policy given in flag name
+func parsePolicy(name, s string) []throttle.Rule {
+	policy, err := throttle.ParseRules(s)
+	if err != nil {
+		log.Fatalf("invalid -%s: %v", name, err)
 	}
+	return policy
 }
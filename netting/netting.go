@@ -0,0 +1,314 @@
+// Package netting nets the imported and exported energy within each
+// settlement period, as done by e.g. Swedish hourly net metering
+// (timnettning), so that prosumers can see the settled rather than the gross
+// energy.
+package netting
+
+import (
+	"fmt"
+	"hemtjan.st/kraft/integrate"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/persist"
+	"hemtjan.st/kraft/sensor"
+	"time"
+)
+
+// Period is the energy imported and exported during a settlement period
+type Period struct {
+	Start time.Time
+	// Import and Export are the gross energy in Wh
+	Import float64
+	Export float64
+	// Exact is set when the energy comes from the meter's registers rather
+	// than from integrating the power readings
+	Exact bool
+}
+
+// Net returns the settled energy: only the difference between import and
+// export is billed or compensated
+func (p Period) Net() (imp, exp float64) {
+	if p.Import > p.Export {
+		return p.Import - p.Export, 0
+	}
+	return 0, p.Export - p.Import
+}
+
+type state struct {
+	Current Period
+	// Closed holds the periods since the last energy register, which are
+	// corrected when the next register arrives
+	Closed []Period
+
+	// Last power readings, in W
+	LastTime   time.Time
+	LastImport *float64
+	LastExport *float64
+
+	// Last seen energy registers
+	RegisterTime *time.Time
+	RegImport    int64
+	RegExport    int64
+
+	// Settled energy of the periods that can't be corrected any more, in Wh.
+	// Periods are only added once final, so that the totals never go down.
+	SettledImport float64
+	SettledExport float64
+}
+
+// Netting tracks the current settlement period
+type Netting struct {
+	period time.Duration
+	path   string
+	st     state
+}
+
+// New creates a Netting for periods of the given length, which must divide an
+// hour, restoring the state persisted at path if set
+func New(period time.Duration, path string) (*Netting, error) {
+	if period <= 0 || period > time.Hour || time.Hour%period != 0 {
+		return nil, fmt.Errorf("invalid settlement period %s, must divide an hour", period)
+	}
+	n := &Netting{period: period, path: path}
+	if path != "" {
+		if err := persist.Load(path, &n.st); err != nil {
+			return nil, fmt.Errorf("loading netting state: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// periodStart returns the start of the period t is in
+func (n *Netting) periodStart(t time.Time) time.Time {
+	hour := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	return hour.Add(t.Sub(hour).Truncate(n.period))
+}
+
+// Update feeds a message to the netting
+func (n *Netting) Update(msg *kaifa.Message) error {
+	now := msg.Timestamp
+	changed := n.integrate(now)
+
+	if msg.ActivePowerPositive != nil {
+		v := float64(*msg.ActivePowerPositive)
+		n.st.LastImport = &v
+	}
+	if msg.ActivePowerNegative != nil {
+		v := float64(*msg.ActivePowerNegative)
+		n.st.LastExport = &v
+	}
+	if msg.ActivePowerPositive != nil || msg.ActivePowerNegative != nil {
+		n.st.LastTime = now
+	}
+
+	if msg.EnergyTimestamp != nil && msg.ActiveEnergyPositive != nil && msg.ActiveEnergyNegative != nil {
+		changed = n.register(*msg.EnergyTimestamp, int64(*msg.ActiveEnergyPositive), int64(*msg.ActiveEnergyNegative)) || changed
+	}
+
+	if changed && n.path != "" {
+		return persist.Save(n.path, &n.st)
+	}
+	return nil
+}
+
+// Save persists the state, including the energy of the current period, which
+// is otherwise only saved when the period ends
+func (n *Netting) Save() error {
+	if n.path == "" {
+		return nil
+	}
+	return persist.Save(n.path, &n.st)
+}
+
+// integrate adds the energy since the last reading, and returns true if a
+// period was closed
+func (n *Netting) integrate(now time.Time) bool {
+	closed := false
+	next := func(t time.Time) time.Time {
+		return n.periodStart(t).Add(n.period)
+	}
+	integrate.Split(n.st.LastTime, now, next, func(start, end time.Time) {
+		closed = n.advance(start) || closed
+		h := end.Sub(start).Hours()
+		if n.st.LastImport != nil {
+			n.st.Current.Import += *n.st.LastImport * h
+		}
+		if n.st.LastExport != nil {
+			n.st.Current.Export += *n.st.LastExport * h
+		}
+		// Integrated up to here, also when the frame has no power readings
+		n.st.LastTime = end
+	})
+	return n.advance(now) || closed
+}
+
+// advance starts a new period if t is in one, and returns true if a period
+// was closed
+func (n *Netting) advance(t time.Time) bool {
+	start := n.periodStart(t)
+	if start.Equal(n.st.Current.Start) {
+		return false
+	}
+	closed := !n.st.Current.Start.IsZero()
+	if closed {
+		n.close()
+	}
+	n.st.Current = Period{Start: start}
+	return closed
+}
+
+// close ends the current period, which is settled once the register of its
+// hour has arrived
+func (n *Netting) close() {
+	p := n.st.Current
+	n.st.Closed = append(n.st.Closed, p)
+	// Without registers the periods are settled as integrated
+	for len(n.st.Closed) > 0 && p.Start.Sub(n.st.Closed[0].Start) > 2*time.Hour {
+		n.settle(n.st.Closed[0])
+		n.st.Closed = n.st.Closed[1:]
+	}
+}
+
+// settle adds a period that won't be corrected any more to the settled totals
+func (n *Netting) settle(p Period) {
+	imp, exp := p.Net()
+	n.st.SettledImport += imp
+	n.st.SettledExport += exp
+}
+
+// register corrects the closed periods of the hour before ts with the exact
+// energy from the registers, and returns true if the state changed
+func (n *Netting) register(ts time.Time, imp, exp int64) bool {
+	last := n.st.RegisterTime
+	if last != nil && ts.Equal(*last) {
+		return false
+	}
+	if last != nil && ts.Sub(*last) == time.Hour && imp >= n.st.RegImport && exp >= n.st.RegExport {
+		n.correct(*last, ts, float64(imp-n.st.RegImport), float64(exp-n.st.RegExport))
+	}
+	n.st.RegisterTime = &ts
+	n.st.RegImport, n.st.RegExport = imp, exp
+
+	// Periods before the register can't be corrected any more
+	var keep []Period
+	for _, p := range n.st.Closed {
+		if p.Start.Before(ts) {
+			n.settle(p)
+		} else {
+			keep = append(keep, p)
+		}
+	}
+	n.st.Closed = keep
+	return true
+}
+
+// correct scales the periods in [from, to) so that they add up to the energy
+// from the registers. Nothing is done unless the periods cover all of it.
+func (n *Netting) correct(from, to time.Time, imp, exp float64) {
+	var periods []*Period
+	var sumImp, sumExp float64
+	next := from
+	for i := range n.st.Closed {
+		p := &n.st.Closed[i]
+		if p.Start.Before(from) || !p.Start.Before(to) {
+			continue
+		}
+		if !p.Start.Equal(next) {
+			return
+		}
+		periods = append(periods, p)
+		sumImp += p.Import
+		sumExp += p.Export
+		next = p.Start.Add(n.period)
+	}
+	if !next.Equal(to) {
+		return
+	}
+	scale := func(v, sum, exact float64) float64 {
+		if sum == 0 {
+			return exact / float64(len(periods))
+		}
+		return v * exact / sum
+	}
+	for _, p := range periods {
+		p.Import = scale(p.Import, sumImp, imp)
+		p.Export = scale(p.Export, sumExp, exp)
+		p.Exact = true
+	}
+}
+
+// Balance returns the net energy of the current period so far in Wh, positive
+// when importing, and the balance at the end of the period if the current
+// power stays the same
+func (n *Netting) Balance() (balance, projected float64) {
+	balance = n.st.Current.Import - n.st.Current.Export
+	projected = balance
+	if n.st.LastTime.IsZero() {
+		return balance, projected
+	}
+	var power float64
+	if n.st.LastImport != nil {
+		power += *n.st.LastImport
+	}
+	if n.st.LastExport != nil {
+		power -= *n.st.LastExport
+	}
+	remaining := n.st.Current.Start.Add(n.period).Sub(n.st.LastTime)
+	return balance, balance + power*remaining.Hours()
+}
+
+// Last returns the last closed period
+func (n *Netting) Last() (Period, bool) {
+	if len(n.st.Closed) == 0 {
+		return Period{}, false
+	}
+	return n.st.Closed[len(n.st.Closed)-1], true
+}
+
+// Sensors implements sensor.Source
+func (n *Netting) Sensors() []sensor.Sensor {
+	// Not energy sensors to Home Assistant, as they start over every period
+	energy := func(id, feature, name string) sensor.Sensor {
+		return sensor.Sensor{
+			ID:         id,
+			Feature:    feature,
+			Name:       name,
+			Unit:       "Wh",
+			StateClass: "measurement",
+		}
+	}
+	settled := func(id, feature, name string) sensor.Sensor {
+		return sensor.Sensor{
+			ID:          id,
+			Feature:     feature,
+			Name:        name,
+			Unit:        "kWh",
+			DeviceClass: "energy",
+			StateClass:  "total_increasing",
+			Precision:   3,
+		}
+	}
+	return []sensor.Sensor{
+		energy("period_import", "periodImport", "Period Import"),
+		energy("period_export", "periodExport", "Period Export"),
+		energy("period_balance", "periodBalance", "Period Net Balance"),
+		energy("period_balance_projected", "periodBalanceProjected", "Projected Period Net Balance"),
+		settled("settled_import", "settledImport", "Settled Import"),
+		settled("settled_export", "settledExport", "Settled Export"),
+	}
+}
+
+// Values implements sensor.Source
+func (n *Netting) Values() sensor.Values {
+	if n.st.Current.Start.IsZero() {
+		return sensor.Values{}
+	}
+	balance, projected := n.Balance()
+	return sensor.Values{
+		"period_import":            n.st.Current.Import,
+		"period_export":            n.st.Current.Export,
+		"period_balance":           balance,
+		"period_balance_projected": projected,
+		"settled_import":           n.st.SettledImport / 1000,
+		"settled_export":           n.st.SettledExport / 1000,
+	}
+}
@@ -0,0 +1,111 @@
+package netting
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/kaifa/kaifatest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = kaifatest.Start
+
+func TestPeriod(t *testing.T) {
+	imp, exp := Period{Import: 300, Export: 100}.Net()
+	assert.Equal(t, 200.0, imp)
+	assert.Equal(t, 0.0, exp)
+	imp, exp = Period{Import: 100, Export: 400}.Net()
+	assert.Equal(t, 0.0, imp)
+	assert.Equal(t, 300.0, exp)
+
+	_, err := New(7*time.Minute, "")
+	assert.Error(t, err)
+}
+
+func TestHourly(t *testing.T) {
+	n, err := New(time.Hour, "")
+	assert.NoError(t, err)
+
+	// Importing 2 kW for half an hour, then exporting 2 kW
+	assert.NoError(t, kaifatest.Feed(n.Update, start, start.Add(30*time.Minute), 2000, 0))
+	v := n.Values()
+	assert.InDelta(t, 1000, v["period_import"], 10)
+	assert.InDelta(t, 1000, v["period_balance"], 10)
+	assert.NoError(t, kaifatest.Feed(n.Update, start.Add(30*time.Minute), start.Add(40*time.Minute), 0, 2000))
+	balance, projected := n.Balance()
+	assert.InDelta(t, 667, balance, 10)
+	// 20 more minutes of export absorbs the import
+	assert.InDelta(t, 0, projected, 10)
+
+	assert.NoError(t, kaifatest.Feed(n.Update, start.Add(40*time.Minute), start.Add(61*time.Minute), 0, 2000))
+	last, ok := n.Last()
+	assert.True(t, ok)
+	assert.InDelta(t, 1000, last.Import, 1)
+	assert.InDelta(t, 1000, last.Export, 1)
+	assert.False(t, last.Exact)
+
+	v = n.Values()
+	assert.InDelta(t, 0, v["settled_import"], 0.001)
+	assert.InDelta(t, 0, v["settled_export"], 0.001)
+	assert.InDelta(t, 28, v["period_export"], 1)
+}
+
+func TestRegisters(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kraft")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "netting.json")
+
+	n, err := New(15*time.Minute, path)
+	assert.NoError(t, err)
+	assert.NoError(t, n.Update(kaifatest.Register(start, 10000, 5000)))
+
+	// Quarters: import 500 Wh, export 250 Wh, import 250 Wh, export 500 Wh
+	assert.NoError(t, kaifatest.Feed(n.Update, start.Add(10*time.Second), start.Add(15*time.Minute), 2000, 0))
+	assert.NoError(t, kaifatest.Feed(n.Update, start.Add(15*time.Minute), start.Add(30*time.Minute), 0, 1000))
+	assert.NoError(t, kaifatest.Feed(n.Update, start.Add(30*time.Minute), start.Add(45*time.Minute), 1000, 0))
+	assert.NoError(t, kaifatest.Feed(n.Update, start.Add(45*time.Minute), start.Add(time.Hour), 0, 2000))
+	assert.NoError(t, n.Update(kaifatest.Power(start.Add(time.Hour), 0, 0)))
+	// Held back until the register has corrected the periods
+	v := n.Values()
+	assert.Equal(t, 0.0, v["settled_import"])
+	assert.Equal(t, 0.0, v["settled_export"])
+
+	// The meter measured 10 % more of everything
+	n, err = New(15*time.Minute, path)
+	assert.NoError(t, err)
+	assert.NoError(t, n.Update(kaifatest.Register(start.Add(time.Hour), 10000+825, 5000+825)))
+	v = n.Values()
+	assert.InDelta(t, 0.825, v["settled_import"], 0.01)
+	assert.InDelta(t, 0.825, v["settled_export"], 0.01)
+	assert.Empty(t, n.st.Closed)
+}
+
+func TestSettledIncreasing(t *testing.T) {
+	n, err := New(time.Hour, "")
+	assert.NoError(t, err)
+	assert.NoError(t, n.Update(kaifatest.Register(start, 10000, 5000)))
+	last := 0.0
+	for h := 0; h < 4; h++ {
+		from := start.Add(time.Duration(h) * time.Hour)
+		assert.NoError(t, kaifatest.Feed(n.Update, from.Add(10*time.Second), from.Add(time.Hour), 2000, 0))
+		// The meter measured 20 % less than the power readings add up to
+		assert.NoError(t, n.Update(kaifatest.Register(from.Add(time.Hour), 10000+int32(h+1)*1600, 5000)))
+		v := n.Values()["settled_import"]
+		assert.True(t, v >= last, "settled import went from %g to %g", last, v)
+		last = v
+	}
+	assert.InDelta(t, 6.4, last, 0.01)
+}
+
+func TestWithoutRegisters(t *testing.T) {
+	n, err := New(time.Hour, "")
+	assert.NoError(t, err)
+	assert.NoError(t, kaifatest.Feed(n.Update, start, start.Add(3*time.Hour+time.Minute), 1000, 0))
+	// Settled as integrated once too old to be corrected
+	assert.InDelta(t, 0, n.Values()["settled_import"], 0.001)
+	assert.NoError(t, kaifatest.Feed(n.Update, start.Add(3*time.Hour+time.Minute), start.Add(4*time.Hour), 1000, 0))
+	assert.NoError(t, n.Update(kaifatest.Power(start.Add(4*time.Hour), 1000, 0)))
+	assert.InDelta(t, 1, n.Values()["settled_import"], 0.01)
+}
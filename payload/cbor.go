@@ -0,0 +1,93 @@
+package payload
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"time"
+)
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNegint = 1
+	cborText   = 3
+	cborMap    = 5
+	cborTag    = 6
+)
+
+// cborEpoch is the tag for a time as seconds since the Unix epoch
+const cborEpoch = 1
+
+// encodeCBOR encodes o as a CBOR map, with the units as a nested map
+func encodeCBOR(o *flatObject) []byte {
+	var b []byte
+	b = cborHead(b, cborMap, uint64(len(o.keys)+1))
+	for _, k := range o.keys {
+		b = cborString(b, k)
+		b = cborValue(b, o.values[k])
+	}
+	b = cborString(b, "units")
+	keys := make([]string, 0, len(o.units))
+	for k := range o.units {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = cborHead(b, cborMap, uint64(len(keys)))
+	for _, k := range keys {
+		b = cborString(b, k)
+		b = cborString(b, o.units[k])
+	}
+	return b
+}
+
+func cborValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return cborHead(b, cborNegint, uint64(-1-v))
+		}
+		return cborHead(b, cborUint, uint64(v))
+	case float64:
+		b = append(b, 0xfb)
+		return appendUint64(b, math.Float64bits(v))
+	case time.Time:
+		b = cborHead(b, cborTag, cborEpoch)
+		return cborValue(b, v.Unix())
+	case string:
+		return cborString(b, v)
+	}
+	// null
+	return append(b, 0xf6)
+}
+
+func cborString(b []byte, s string) []byte {
+	b = cborHead(b, cborText, uint64(len(s)))
+	return append(b, s...)
+}
+
+// cborHead appends the initial byte and argument of a data item
+func cborHead(b []byte, major byte, n uint64) []byte {
+	m := major << 5
+	switch {
+	case n < 24:
+		return append(b, m|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, m|24, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, m|25, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(n))
+		return b
+	case n <= math.MaxUint32:
+		b = append(b, m|26, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], uint32(n))
+		return b
+	}
+	return appendUint64(append(b, m|27), n)
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(b[len(b)-8:], n)
+	return b
+}
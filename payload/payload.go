@@ -0,0 +1,285 @@
+// Package payload encodes the meter readings for publishing over MQTT, in the
+// formats consumers of kraft can choose between.
+package payload
+
+import (
+	"encoding/json"
+	"fmt"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/sensor"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is a payload format
+type Format string
+
+const (
+	// JSON is the kaifa.Message as JSON, with the derived values under Kraft
+	JSON Format = "json"
+	// Flat is a single level JSON object with a units object next to the values
+	Flat Format = "flat"
+	// Tree publishes each value as plain text to its own topic, e.g. <topic>/phase1/voltage
+	Tree Format = "tree"
+	// CBOR is the same object as Flat, encoded as CBOR (RFC 8949)
+	CBOR Format = "cbor"
+)
+
+// Formats are the supported formats
+var Formats = []Format{JSON, Flat, Tree, CBOR}
+
+// ParseFormat parses the name of a format
+func ParseFormat(s string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == s {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown payload format %q", s)
+}
+
+// State is a frame together with the values kraft derived from it
+type State struct {
+	*kaifa.Message
+	// Kraft holds the values derived by kraft
+	Kraft sensor.Values `json:",omitempty"`
+	// Received is when kraft received the frame
+	Received time.Time
+	// Sensors describes the values in Kraft
+	Sensors []sensor.Sensor `json:"-"`
+	// Changed limits Tree to the fields with these keys, if set
+	Changed map[string]bool `json:"-"`
+}
+
+// Field is a single value of a State
+type Field struct {
+	// Path is the name of the field, joined by _ in Flat and by / in Tree
+	Path []string
+	// Value is an int64, float64, string or time.Time
+	Value interface{}
+	Unit  string
+}
+
+// Key returns the name of the field in Flat
+func (f Field) Key() string {
+	return strings.Join(f.Path, "_")
+}
+
+// Topic returns the topic of the field in Tree, relative to the base topic
+func (f Field) Topic() string {
+	return strings.Join(f.Path, "/")
+}
+
+// Text formats the value as plain text
+func (f Field) Text() string {
+	switch v := f.Value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case string:
+		return v
+	}
+	return fmt.Sprint(f.Value)
+}
+
+// Fields flattens the state. Only fields that are present in the frame are
+// included.
+func (s *State) Fields() []Field {
+	var res []Field
+	add := func(v interface{}, unit string, path ...string) {
+		res = append(res, Field{Path: path, Value: v, Unit: unit})
+	}
+	str := func(v *string, path ...string) {
+		if v != nil {
+			add(*v, "", path...)
+		}
+	}
+	num := func(v *int32, unit string, path ...string) {
+		if v != nil {
+			add(int64(*v), unit, path...)
+		}
+	}
+
+	m := s.Message
+	if m == nil {
+		m = &kaifa.Message{}
+	}
+	add(m.Timestamp, "", "timestamp")
+	if !s.Received.IsZero() {
+		add(s.Received, "", "received")
+	}
+	str(m.Version, "version")
+	str(m.MeterID, "meter_id")
+	str(m.MeterType, "meter_type")
+	num(m.ActivePowerPositive, "W", "power", "import")
+	num(m.ActivePowerNegative, "W", "power", "export")
+	num(m.ReactivePowerPositive, "var", "reactive_power", "import")
+	num(m.ReactivePowerNegative, "var", "reactive_power", "export")
+	for _, ph := range m.Phases {
+		p := fmt.Sprintf("phase%d", ph.Index)
+		add(ph.Current, "A", p, "current")
+		add(ph.Voltage, "V", p, "voltage")
+	}
+	if m.EnergyTimestamp != nil {
+		add(*m.EnergyTimestamp, "", "energy", "timestamp")
+	}
+	num(m.ActiveEnergyPositive, "Wh", "energy", "import")
+	num(m.ActiveEnergyNegative, "Wh", "energy", "export")
+	num(m.ReactiveEnergyPositive, "varh", "reactive_energy", "import")
+	num(m.ReactiveEnergyNegative, "varh", "reactive_energy", "export")
+
+	for _, sn := range s.Sensors {
+		if v, ok := s.Kraft[sn.ID]; ok {
+			add(v, sn.Unit, sn.ID)
+		}
+	}
+	return res
+}
+
+// With returns a copy of the state with the numeric values replaced by those
+// in fields. Values not in fields are kept.
+func (s *State) With(fields []Field) *State {
+	res := *s
+	m := kaifa.Message{}
+	if s.Message != nil {
+		m = *s.Message
+	}
+	m.Phases = append([]kaifa.Phase(nil), m.Phases...)
+	res.Message = &m
+	res.Kraft = sensor.Values{}
+	for k, v := range s.Kraft {
+		res.Kraft[k] = v
+	}
+
+	regs := map[string]**int32{
+		"power_import":           &m.ActivePowerPositive,
+		"power_export":           &m.ActivePowerNegative,
+		"reactive_power_import":  &m.ReactivePowerPositive,
+		"reactive_power_export":  &m.ReactivePowerNegative,
+		"energy_import":          &m.ActiveEnergyPositive,
+		"energy_export":          &m.ActiveEnergyNegative,
+		"reactive_energy_import": &m.ReactiveEnergyPositive,
+		"reactive_energy_export": &m.ReactiveEnergyNegative,
+	}
+	for _, f := range fields {
+		var v float64
+		switch n := f.Value.(type) {
+		case int64:
+			v = float64(n)
+		case float64:
+			v = n
+		default:
+			continue
+		}
+		key := f.Key()
+		if r, ok := regs[key]; ok {
+			i := int32(math.Round(v))
+			*r = &i
+			continue
+		}
+		if _, ok := res.Kraft[key]; ok {
+			res.Kraft[key] = v
+			continue
+		}
+		for i := range m.Phases {
+			switch key {
+			case fmt.Sprintf("phase%d_current", m.Phases[i].Index):
+				m.Phases[i].Current = v
+			case fmt.Sprintf("phase%d_voltage", m.Phases[i].Index):
+				m.Phases[i].Voltage = v
+			}
+		}
+	}
+	return &res
+}
+
+// Part is a single message to publish
+type Part struct {
+	// Topic is relative to the base topic, empty for the base topic itself
+	Topic   string
+	Payload []byte
+}
+
+// Encode encodes the state in format f
+func Encode(f Format, s *State) ([]Part, error) {
+	switch f {
+	case JSON:
+		b, err := json.Marshal(s)
+		return []Part{{Payload: b}}, err
+	case Flat:
+		b, err := json.Marshal(flat(s.Fields()))
+		return []Part{{Payload: b}}, err
+	case CBOR:
+		return []Part{{Payload: encodeCBOR(flat(s.Fields()))}}, nil
+	case Tree:
+		var res []Part
+		for _, fl := range s.Fields() {
+			if s.Changed != nil && !s.Changed[fl.Key()] {
+				continue
+			}
+			res = append(res, Part{Topic: fl.Topic(), Payload: []byte(fl.Text())})
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unknown payload format %q", f)
+}
+
+// flatObject is the object encoded by Flat and CBOR. The keys are kept in
+// order so that the encoding is stable.
+type flatObject struct {
+	keys   []string
+	values map[string]interface{}
+	units  map[string]string
+}
+
+func flat(fields []Field) *flatObject {
+	o := &flatObject{values: map[string]interface{}{}, units: map[string]string{}}
+	for _, f := range fields {
+		k := f.Key()
+		o.keys = append(o.keys, k)
+		o.values[k] = f.Value
+		if f.Unit != "" {
+			o.units[k] = f.Unit
+		}
+	}
+	return o
+}
+
+func (o *flatObject) MarshalJSON() ([]byte, error) {
+	var b strings.Builder
+	b.WriteByte('{')
+	for _, k := range o.keys {
+		v, err := json.Marshal(o.values[k])
+		if err != nil {
+			return nil, err
+		}
+		kb, _ := json.Marshal(k)
+		b.Write(kb)
+		b.WriteByte(':')
+		b.Write(v)
+		b.WriteByte(',')
+	}
+	units, err := json.Marshal(o.units)
+	if err != nil {
+		return nil, err
+	}
+	b.WriteString(`"units":`)
+	b.Write(units)
+	b.WriteByte('}')
+	return []byte(b.String()), nil
+}
+
+// Topic expands the placeholders in a topic template, e.g. {name} is replaced
+// by vars["name"]
+func Topic(tmpl string, vars map[string]string) string {
+	var pairs []string
+	for k, v := range vars {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(tmpl)
+}
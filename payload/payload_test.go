@@ -0,0 +1,106 @@
+package payload
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/sensor"
+	"testing"
+	"time"
+)
+
+func testState() *State {
+	power := int32(1234)
+	id := "7350000000000000"
+	return &State{
+		Message: &kaifa.Message{
+			Timestamp:           time.Date(2020, 8, 20, 11, 27, 15, 0, time.UTC),
+			MeterID:             &id,
+			ActivePowerPositive: &power,
+			Phases:              []kaifa.Phase{{Index: 1, Current: 5.2, Voltage: 230.1}},
+		},
+		Kraft:   sensor.Values{"net_power": 1234},
+		Sensors: []sensor.Sensor{{ID: "net_power", Unit: "W"}},
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("tree")
+	assert.NoError(t, err)
+	assert.Equal(t, Tree, f)
+	_, err = ParseFormat("xml")
+	assert.Error(t, err)
+}
+
+func TestFlat(t *testing.T) {
+	p, err := Encode(Flat, testState())
+	assert.NoError(t, err)
+	if assert.Len(t, p, 1) {
+		assert.Equal(t, "", p[0].Topic)
+		assert.JSONEq(t, `{
+			"timestamp": "2020-08-20T11:27:15Z",
+			"meter_id": "7350000000000000",
+			"power_import": 1234,
+			"phase1_current": 5.2,
+			"phase1_voltage": 230.1,
+			"net_power": 1234,
+			"units": {"power_import": "W", "phase1_current": "A", "phase1_voltage": "V", "net_power": "W"}
+		}`, string(p[0].Payload))
+	}
+}
+
+func TestTree(t *testing.T) {
+	p, err := Encode(Tree, testState())
+	assert.NoError(t, err)
+	res := map[string]string{}
+	for _, part := range p {
+		res[part.Topic] = string(part.Payload)
+	}
+	assert.Equal(t, map[string]string{
+		"timestamp":      "2020-08-20T11:27:15Z",
+		"meter_id":       "7350000000000000",
+		"power/import":   "1234",
+		"phase1/current": "5.2",
+		"phase1/voltage": "230.1",
+		"net_power":      "1234",
+	}, res)
+}
+
+func TestCBOR(t *testing.T) {
+	o := flat([]Field{
+		{Path: []string{"a"}, Value: int64(1), Unit: "W"},
+		{Path: []string{"b"}, Value: int64(-500)},
+		{Path: []string{"c"}, Value: 1.5},
+		{Path: []string{"d"}, Value: time.Unix(1597922835, 0)},
+	})
+	assert.Equal(t, []byte{
+		0xa5,
+		0x61, 'a', 0x01,
+		0x61, 'b', 0x39, 0x01, 0xf3,
+		0x61, 'c', 0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+		0x61, 'd', 0xc1, 0x1a, 0x5f, 0x3e, 0x5e, 0x13,
+		0x65, 'u', 'n', 'i', 't', 's', 0xa1, 0x61, 'a', 0x61, 'W',
+	}, encodeCBOR(o))
+}
+
+func TestTopic(t *testing.T) {
+	assert.Equal(t, "meter/123/state", Topic("meter/{meter}/state", map[string]string{"meter": "123"}))
+	assert.Equal(t, "homeassistant/grid/state", Topic("{prefix}/{name}/state", map[string]string{"prefix": "homeassistant", "name": "grid"}))
+}
+
+func TestWith(t *testing.T) {
+	st := testState()
+	res := st.With([]Field{
+		{Path: []string{"power", "import"}, Value: 1000.4},
+		{Path: []string{"phase1", "voltage"}, Value: 231.0},
+		{Path: []string{"net_power"}, Value: 1000.0},
+	})
+	assert.Equal(t, int32(1000), *res.ActivePowerPositive)
+	assert.Equal(t, 231.0, res.Phases[0].Voltage)
+	assert.Equal(t, 5.2, res.Phases[0].Current)
+	assert.Equal(t, 1000.0, res.Kraft["net_power"])
+
+	// The original is untouched
+	assert.Equal(t, int32(1234), *st.ActivePowerPositive)
+	assert.Equal(t, 230.1, st.Phases[0].Voltage)
+	assert.Equal(t, 1234.0, st.Kraft["net_power"])
+}
@@ -0,0 +1,272 @@
+// Package peak tracks the highest hourly average power of each month, which
+// is what capacity tariffs (effekttariff) are billed on.
+package peak
+
+import (
+	"fmt"
+	"hemtjan.st/kraft/integrate"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/persist"
+	"hemtjan.st/kraft/sensor"
+	"sort"
+	"time"
+)
+
+// Rules decides which hours count towards the monthly peaks
+type Rules struct {
+	// Count is the number of peaks that are averaged for the bill
+	Count int
+	// OnePerDay only counts the highest hour of each day
+	OnePerDay bool
+	// WeekdaysOnly only counts hours Monday to Friday
+	WeekdaysOnly bool
+	// From and To limit the counted hours to [From, To), e.g. 7 and 19 for
+	// daytime only. Both zero counts all hours.
+	From, To int
+}
+
+// Counts reports whether the hour starting at t counts towards the peaks
+func (r Rules) Counts(t time.Time) bool {
+	if r.WeekdaysOnly && (t.Weekday() == time.Saturday || t.Weekday() == time.Sunday) {
+		return false
+	}
+	if r.From != r.To && (t.Hour() < r.From || t.Hour() >= r.To) {
+		return false
+	}
+	return true
+}
+
+// Hour is the average power drawn from the grid during one hour
+type Hour struct {
+	Start time.Time
+	// Average power in W, which is the same as the energy in Wh for a full hour
+	Average float64
+	// Exact is set when the value comes from the meter's energy register
+	// rather than from integrating the power readings
+	Exact bool
+}
+
+type state struct {
+	// Month is the start of the month being tracked
+	Month time.Time
+	// Hours holds every closed hour of the month that counts towards the peaks
+	Hours []Hour
+
+	// Integration of the current hour
+	HourStart time.Time
+	Energy    float64
+	LastTime  time.Time
+	LastPower *float64
+
+	// Last seen energy register, used for the exact hourly values
+	RegisterTime *time.Time
+	Register     int64
+}
+
+// Tracker keeps track of the current hour and the peaks of the month
+type Tracker struct {
+	rules Rules
+	path  string
+	st    state
+}
+
+// New creates a Tracker, restoring the state persisted at path if set
+func New(rules Rules, path string) (*Tracker, error) {
+	if rules.Count < 1 {
+		return nil, fmt.Errorf("peak count must be at least 1")
+	}
+	t := &Tracker{rules: rules, path: path}
+	if path != "" {
+		if err := persist.Load(path, &t.st); err != nil {
+			return nil, fmt.Errorf("loading peak state: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// Update feeds a message to the tracker
+func (t *Tracker) Update(msg *kaifa.Message) error {
+	changed := false
+	now := msg.Timestamp
+	hour := hourStart(now)
+
+	if !t.st.HourStart.IsZero() && !hour.Equal(t.st.HourStart) {
+		// Only close the hour if we have been integrating for most of it
+		if t.st.LastTime.Sub(t.st.HourStart) > time.Hour-integrate.MaxGap {
+			t.add(Hour{Start: t.st.HourStart, Average: t.hourEnergy(t.st.HourStart.Add(time.Hour), now)})
+		}
+		t.st.HourStart = hour
+		t.st.Energy = 0
+		changed = true
+	}
+	if t.st.HourStart.IsZero() {
+		t.st.HourStart = hour
+	}
+
+	if msg.ActivePowerPositive != nil {
+		t.st.Energy = t.hourEnergy(now, now)
+		p := float64(*msg.ActivePowerPositive)
+		t.st.LastPower = &p
+		t.st.LastTime = now
+	}
+
+	if msg.EnergyTimestamp != nil && msg.ActiveEnergyPositive != nil {
+		ts, reg := *msg.EnergyTimestamp, int64(*msg.ActiveEnergyPositive)
+		if t.st.RegisterTime != nil && ts.Sub(*t.st.RegisterTime) == time.Hour && reg >= t.st.Register {
+			t.add(Hour{Start: hourStart(*t.st.RegisterTime), Average: float64(reg - t.st.Register), Exact: true})
+			changed = true
+		}
+		if t.st.RegisterTime == nil || !ts.Equal(*t.st.RegisterTime) {
+			t.st.RegisterTime = &ts
+			t.st.Register = reg
+			changed = true
+		}
+	}
+
+	if changed && t.path != "" {
+		return persist.Save(t.path, &t.st)
+	}
+	return nil
+}
+
+// Save persists the state, including the energy integrated so far this hour,
+// which is otherwise only saved when the hour ends
+func (t *Tracker) Save() error {
+	if t.path == "" {
+		return nil
+	}
+	return persist.Save(t.path, &t.st)
+}
+
+// hourEnergy returns the energy of the current hour, integrated up to at.
+// The last power reading only counts if now is within MaxGap of it.
+func (t *Tracker) hourEnergy(at, now time.Time) float64 {
+	if t.st.LastPower == nil || integrate.Span(t.st.LastTime, now) == 0 {
+		return t.st.Energy
+	}
+	from := t.st.LastTime
+	if from.Before(t.st.HourStart) {
+		from = t.st.HourStart
+	}
+	if !at.After(from) {
+		return t.st.Energy
+	}
+	return t.st.Energy + *t.st.LastPower*at.Sub(from).Hours()
+}
+
+// add records a closed hour, replacing an earlier value for the same hour
+func (t *Tracker) add(h Hour) {
+	month := time.Date(h.Start.Year(), h.Start.Month(), 1, 0, 0, 0, 0, h.Start.Location())
+	if !month.Equal(t.st.Month) {
+		if month.Before(t.st.Month) {
+			return
+		}
+		t.st.Month = month
+		t.st.Hours = nil
+	}
+	if !t.rules.Counts(h.Start) {
+		return
+	}
+	for i, v := range t.st.Hours {
+		if v.Start.Equal(h.Start) {
+			if !v.Exact || h.Exact {
+				t.st.Hours[i] = h
+			}
+			return
+		}
+	}
+	t.st.Hours = append(t.st.Hours, h)
+}
+
+// Peaks returns the current peaks of the month, highest first
+func (t *Tracker) Peaks() []Hour {
+	hours := append([]Hour(nil), t.st.Hours...)
+	sort.Slice(hours, func(i, j int) bool {
+		return hours[i].Average > hours[j].Average
+	})
+	var res []Hour
+	days := map[string]bool{}
+	for _, h := range hours {
+		if len(res) >= t.rules.Count {
+			break
+		}
+		if t.rules.OnePerDay {
+			d := h.Start.Format("2006-01-02")
+			if days[d] {
+				continue
+			}
+			days[d] = true
+		}
+		res = append(res, h)
+	}
+	return res
+}
+
+// Current returns the average power of the current hour so far and the
+// projected average if the current power is kept for the rest of the hour
+func (t *Tracker) Current(now time.Time) (average, projection float64) {
+	if t.st.HourStart.IsZero() || now.Before(t.st.HourStart) {
+		return 0, 0
+	}
+	e := t.hourEnergy(now, now)
+	elapsed := now.Sub(t.st.HourStart).Hours()
+	if elapsed > 0 {
+		average = e / elapsed
+	}
+	projection = e
+	if t.st.LastPower != nil && elapsed < 1 {
+		projection += *t.st.LastPower * (1 - elapsed)
+	}
+	return average, projection
+}
+
+// Sensors implements sensor.Source
+func (t *Tracker) Sensors() []sensor.Sensor {
+	res := []sensor.Sensor{
+		{ID: "peak_hour_average", Feature: "peakHourAverage", Name: "Current Hour Average Power"},
+		{ID: "peak_hour_projection", Feature: "peakHourProjection", Name: "Current Hour Projected Power"},
+		{ID: "peak_threshold", Feature: "peakThreshold", Name: "Peak Threshold"},
+		{ID: "peak_average", Feature: "peakAverage", Name: "Monthly Peak Average"},
+	}
+	for i := 1; i <= t.rules.Count; i++ {
+		res = append(res, sensor.Sensor{
+			ID:      fmt.Sprintf("peak_%d", i),
+			Feature: fmt.Sprintf("peak%d", i),
+			Name:    fmt.Sprintf("Monthly Peak %d", i),
+		})
+	}
+	for i := range res {
+		res[i].Unit = "W"
+		res[i].DeviceClass = "power"
+		res[i].StateClass = "measurement"
+	}
+	return res
+}
+
+// Values implements sensor.Source
+func (t *Tracker) Values() sensor.Values {
+	v := sensor.Values{}
+	if !t.st.LastTime.IsZero() {
+		v["peak_hour_average"], v["peak_hour_projection"] = t.Current(t.st.LastTime)
+	}
+	peaks := t.Peaks()
+	var sum float64
+	for i, p := range peaks {
+		v[fmt.Sprintf("peak_%d", i+1)] = p.Average
+		sum += p.Average
+	}
+	v["peak_average"] = 0
+	v["peak_threshold"] = 0
+	if len(peaks) > 0 {
+		v["peak_average"] = sum / float64(len(peaks))
+	}
+	if len(peaks) == t.rules.Count {
+		// The current hour has to exceed the lowest peak to change the bill
+		v["peak_threshold"] = peaks[len(peaks)-1].Average
+	}
+	return v
+}
+
+func hourStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
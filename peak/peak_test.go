@@ -0,0 +1,120 @@
+package peak
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/kaifa/kaifatest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRules(t *testing.T) {
+	r := Rules{WeekdaysOnly: true, From: 7, To: 19}
+	// 2020-08-20 is a Thursday
+	assert.True(t, r.Counts(time.Date(2020, 8, 20, 7, 0, 0, 0, time.UTC)))
+	assert.True(t, r.Counts(time.Date(2020, 8, 20, 18, 0, 0, 0, time.UTC)))
+	assert.False(t, r.Counts(time.Date(2020, 8, 20, 19, 0, 0, 0, time.UTC)))
+	assert.False(t, r.Counts(time.Date(2020, 8, 20, 6, 0, 0, 0, time.UTC)))
+	assert.False(t, r.Counts(time.Date(2020, 8, 22, 12, 0, 0, 0, time.UTC)))
+	assert.True(t, Rules{}.Counts(time.Date(2020, 8, 22, 3, 0, 0, 0, time.UTC)))
+}
+
+func TestIntegration(t *testing.T) {
+	tr, err := New(Rules{Count: 2}, "")
+	assert.NoError(t, err)
+
+	start := kaifatest.Start
+	assert.NoError(t, kaifatest.Feed(tr.Update, start, start.Add(30*time.Minute), 1000, 0))
+
+	avg, proj := tr.Current(start.Add(30 * time.Minute))
+	assert.InDelta(t, 1000, avg, 1)
+	assert.InDelta(t, 1000, proj, 1)
+
+	assert.NoError(t, kaifatest.Feed(tr.Update, start.Add(30*time.Minute), start.Add(2*time.Hour), 3000, 0))
+	assert.NoError(t, tr.Update(kaifatest.Power(start.Add(2*time.Hour), 0, 0)))
+
+	peaks := tr.Peaks()
+	assert.Len(t, peaks, 2)
+	assert.InDelta(t, 3000, peaks[0].Average, 1)
+	assert.InDelta(t, 2000, peaks[1].Average, 1)
+	assert.False(t, peaks[0].Exact)
+
+	v := tr.Values()
+	assert.InDelta(t, 2500, v["peak_average"], 1)
+	assert.InDelta(t, 2000, v["peak_threshold"], 1)
+}
+
+func TestRegister(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kraft")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peak.json")
+
+	tr, err := New(Rules{Count: 3, OnePerDay: true}, path)
+	assert.NoError(t, err)
+
+	start := kaifatest.Start
+	assert.NoError(t, tr.Update(kaifatest.Register(start, 10000, 0)))
+	assert.NoError(t, tr.Update(kaifatest.Register(start.Add(time.Hour), 12500, 0)))
+	assert.NoError(t, tr.Update(kaifatest.Register(start.Add(2*time.Hour), 16500, 0)))
+	// Repeated register is ignored
+	assert.NoError(t, tr.Update(kaifatest.Register(start.Add(2*time.Hour), 16500, 0)))
+	assert.NoError(t, tr.Update(kaifatest.Register(start.Add(24*time.Hour), 20000, 0)))
+	assert.NoError(t, tr.Update(kaifatest.Register(start.Add(25*time.Hour), 21000, 0)))
+
+	// Only the highest hour of each day counts
+	peaks := tr.Peaks()
+	assert.Len(t, peaks, 2)
+	assert.Equal(t, 4000.0, peaks[0].Average)
+	assert.True(t, peaks[0].Exact)
+	assert.Equal(t, 1000.0, peaks[1].Average)
+
+	// State is restored after a restart
+	tr, err = New(Rules{Count: 3, OnePerDay: true}, path)
+	assert.NoError(t, err)
+	assert.Len(t, tr.Peaks(), 2)
+
+	// A new month starts over
+	next := time.Date(2020, 9, 1, 1, 0, 0, 0, time.UTC)
+	assert.NoError(t, tr.Update(kaifatest.Register(next, 30000, 0)))
+	assert.NoError(t, tr.Update(kaifatest.Register(next.Add(time.Hour), 30500, 0)))
+	peaks = tr.Peaks()
+	assert.Len(t, peaks, 1)
+	assert.Equal(t, 500.0, peaks[0].Average)
+}
+
+func TestSave(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kraft")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peak.json")
+
+	tr, err := New(Rules{Count: 1}, path)
+	assert.NoError(t, err)
+	start := kaifatest.Start
+	assert.NoError(t, kaifatest.Feed(tr.Update, start, start.Add(30*time.Minute), 2000, 0))
+	assert.NoError(t, tr.Save())
+
+	// The energy of the current hour carries over a restart
+	tr, err = New(Rules{Count: 1}, path)
+	assert.NoError(t, err)
+	avg, _ := tr.Current(start.Add(30 * time.Minute))
+	assert.InDelta(t, 2000, avg, 1)
+}
+
+func TestGap(t *testing.T) {
+	tr, err := New(Rules{Count: 1}, "")
+	assert.NoError(t, err)
+
+	// The frames stop at 10:58 and return at 11:04
+	start := kaifatest.Start
+	assert.NoError(t, kaifatest.Feed(tr.Update, start, start.Add(58*time.Minute+10*time.Second), 1200, 0))
+	assert.NoError(t, tr.Update(kaifatest.Power(start.Add(64*time.Minute), 3000, 0)))
+
+	// The power before the gap isn't carried into the new hour, or the end
+	// of the last one
+	assert.Equal(t, 0.0, tr.st.Energy)
+	peaks := tr.Peaks()
+	assert.Len(t, peaks, 1)
+	assert.InDelta(t, 1200*58.0/60, peaks[0].Average, 1)
+}
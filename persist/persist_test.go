@@ -0,0 +1,30 @@
+package persist
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kraft")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	v := map[string]int{"a": 1}
+	assert.NoError(t, Load(path, &v), "missing file")
+	assert.Equal(t, map[string]int{"a": 1}, v)
+
+	assert.NoError(t, Save(path, map[string]int{"b": 2}))
+	var res map[string]int
+	assert.NoError(t, Load(path, &res))
+	assert.Equal(t, map[string]int{"b": 2}, res)
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "temporary file left behind")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/tarm/serial"
+	"hemtjan.st/kraft/probe"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// probeCmd listens with each candidate serial setting and reports which
+// protocol the meter most likely speaks
+func probeCmd(args []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	device := fs.String("device", "/dev/ttyUSB0", "Serial device")
+	duration := fs.Duration("duration", 5*time.Second, "How long to listen with each setting")
+	_ = fs.Parse(args)
+
+	results, err := probeSerial(*device, *duration)
+	if err != nil {
+		log.Fatalf("error reading %s: %v", *device, err)
+	}
+	probe.Rank(results)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Settings\tUsed by\tBytes\tHDLC\tDSMR\tSML\tDecoded")
+	for _, r := range results {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%.2f\t%.2f\t%.2f\t%d\n", r.Settings, r.Meters, r.Bytes,
+			r.Scores[probe.HDLC], r.Scores[probe.DSMR], r.Scores[probe.SML], r.Kaifa)
+	}
+	_ = w.Flush()
+	fmt.Println()
+
+	best := results[0]
+	p, score := best.Best()
+	switch {
+	case score < 0.5:
+		fmt.Println("No protocol detected. Check the cable, and that the customer port of the meter is enabled.")
+		os.Exit(1)
+	case p == probe.HDLC && best.Kaifa > 0:
+		fmt.Printf("Kaifa meter at %s, run kraft with:\n\n  -device %s -speed %d -framing %s\n",
+			best.Settings, *device, best.Baud, best.Framing())
+	case p == probe.HDLC:
+		fmt.Printf("HDLC at %s, but the frames aren't in the Kaifa format that kraft decodes.\n", best.Settings)
+	default:
+		fmt.Printf("%s at %s, which kraft doesn't decode.\n", p, best.Settings)
+	}
+}
+
+// probeSerial reads from device with each candidate setting for duration
+func probeSerial(device string, duration time.Duration) ([]probe.Result, error) {
+	var results []probe.Result
+	for _, c := range probe.Candidates {
+		log.Printf("Listening at %s for %s", c.Settings, duration)
+		data, err := capture(device, c.Settings, duration)
+		if err != nil {
+			return nil, fmt.Errorf("listening at %s: %w", c.Settings, err)
+		}
+		results = append(results, probe.Score(c, data))
+	}
+	return results, nil
+}
+
+// autoDetect returns the settings at which Kaifa frames could be decoded
+func autoDetect(device string, duration time.Duration) (probe.Settings, error) {
+	results, err := probeSerial(device, duration)
+	if err != nil {
+		return probe.Settings{}, err
+	}
+	probe.Rank(results)
+	for _, r := range results {
+		if r.Kaifa > 0 {
+			return r.Settings, nil
+		}
+	}
+	p, score := results[0].Best()
+	if score < 0.5 {
+		return probe.Settings{}, fmt.Errorf("no meter detected")
+	}
+	return probe.Settings{}, fmt.Errorf("detected %s at %s, which kraft doesn't decode", p, results[0].Settings)
+}
+
+// capture reads everything the meter sends during duration
+func capture(device string, s probe.Settings, duration time.Duration) ([]byte, error) {
+	cfg := serialConfig(device, s)
+	cfg.ReadTimeout = 500 * time.Millisecond
+	port, err := serial.OpenPort(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer port.Close()
+
+	var data []byte
+	buf := make([]byte, 4096)
+	for end := time.Now().Add(duration); time.Now().Before(end); {
+		n, err := port.Read(buf)
+		data = append(data, buf[:n]...)
+		// The read times out with EOF if nothing arrives
+		if err != nil && err != io.EOF {
+			return data, err
+		}
+	}
+	return data, nil
+}
+
+func serialConfig(device string, s probe.Settings) *serial.Config {
+	return &serial.Config{
+		Name:     device,
+		Baud:     s.Baud,
+		Parity:   serial.Parity(s.Parity),
+		Size:     s.Size,
+		StopBits: serial.StopBits(s.StopBits),
+	}
+}
@@ -0,0 +1,200 @@
+// Package probe guesses the protocol and serial settings of a meter from the
+// bytes read from its port.
+package probe
+
+import (
+	"bytes"
+	"fmt"
+	"hemtjan.st/kraft/kaifa"
+	"sort"
+)
+
+// Protocol is a protocol spoken by meters on their customer port
+type Protocol string
+
+const (
+	// HDLC is DLMS/COSEM in HDLC frames, used by Kaifa and Aidon meters
+	HDLC Protocol = "hdlc"
+	// DSMR is the ASCII telegram format of Dutch and Belgian meters
+	DSMR Protocol = "dsmr"
+	// SML is the Smart Message Language of German meters
+	SML Protocol = "sml"
+)
+
+// Settings are the settings of a serial port
+type Settings struct {
+	Baud int
+	// Size is the number of data bits
+	Size byte
+	// Parity is N, E or O
+	Parity   byte
+	StopBits byte
+}
+
+// Framing returns the data bits, parity and stop bits, e.g. 8E1
+func (s Settings) Framing() string {
+	return fmt.Sprintf("%d%c%d", s.Size, s.Parity, s.StopBits)
+}
+
+func (s Settings) String() string {
+	return fmt.Sprintf("%d %s", s.Baud, s.Framing())
+}
+
+// ParseFraming parses framing like 8E1
+func ParseFraming(framing string) (size, parity, stopBits byte, err error) {
+	if len(framing) != 3 || framing[0] < '5' || framing[0] > '8' ||
+		bytes.IndexByte([]byte("NEO"), framing[1]) < 0 ||
+		(framing[2] != '1' && framing[2] != '2') {
+		return 0, 0, 0, fmt.Errorf("invalid framing %q, expected e.g. 8E1", framing)
+	}
+	return framing[0] - '0', framing[1], framing[2] - '0', nil
+}
+
+// Candidate is serial settings used by some meters
+type Candidate struct {
+	Settings
+	// Meters describes which meters use the settings
+	Meters string
+}
+
+// Candidates are the settings tried, most common first
+var Candidates = []Candidate{
+	{Settings{2400, 8, 'E', 1}, "Kaifa, Aidon (HDLC)"},
+	{Settings{2400, 8, 'N', 1}, "Aidon, Kamstrup (HDLC)"},
+	{Settings{115200, 8, 'N', 1}, "DSMR 4 and 5"},
+	{Settings{9600, 7, 'E', 1}, "DSMR 2 and 3"},
+	{Settings{9600, 8, 'N', 1}, "SML"},
+}
+
+// Result is how well data read with some settings matches each protocol
+type Result struct {
+	Candidate
+	// Bytes is how many bytes were read
+	Bytes int
+	// Scores is between 0 and 1 for each protocol
+	Scores map[Protocol]float64
+	// Kaifa is the number of HDLC frames that kraft could decode
+	Kaifa int
+}
+
+// Best returns the protocol with the highest score
+func (r Result) Best() (Protocol, float64) {
+	var best Protocol
+	var score float64
+	for _, p := range []Protocol{HDLC, DSMR, SML} {
+		if r.Scores[p] > score {
+			best, score = p, r.Scores[p]
+		}
+	}
+	return best, score
+}
+
+// Score rates data read from a port with candidate c
+func Score(c Candidate, data []byte) Result {
+	hdlc, decoded := scoreHDLC(data)
+	return Result{
+		Candidate: c,
+		Bytes:     len(data),
+		Scores: map[Protocol]float64{
+			HDLC: hdlc,
+			DSMR: scoreDSMR(data),
+			SML:  scoreSML(data),
+		},
+		Kaifa: decoded,
+	}
+}
+
+// Rank sorts results by their best score, highest first
+func Rank(results []Result) {
+	sort.SliceStable(results, func(i, j int) bool {
+		_, a := results[i].Best()
+		_, b := results[j].Best()
+		return a > b
+	})
+}
+
+// scoreHDLC returns the share of data in HDLC frames with a valid header
+// checksum, and the number of those frames that could be decoded
+func scoreHDLC(data []byte) (float64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	covered, decoded := 0, 0
+	for i := 0; i+2 < len(data); {
+		if data[i] != 0x7e || data[i+1]&0xf0 != 0xa0 {
+			i++
+			continue
+		}
+		length := int(data[i+1]&0x07)<<8 | int(data[i+2])
+		end := i + length + 1
+		if length < 8 || end >= len(data) || data[end] != 0x7e {
+			i++
+			continue
+		}
+		fr := data[i+1 : end]
+		if header, _ := kaifa.VerifyChecksums(fr); !header {
+			i++
+			continue
+		}
+		if _, err := kaifa.Unmarshal(fr); err == nil {
+			decoded++
+		}
+		covered += length + 2
+		i = end + 1
+	}
+	return float64(covered) / float64(len(data)), decoded
+}
+
+// scoreDSMR returns the share of printable ASCII in data, weighed by whether
+// telegram headers (/XXX5...) and footers (!CRC) are found
+func scoreDSMR(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	printable := 0
+	for _, b := range data {
+		if b >= 0x20 && b < 0x7f || b == '\r' || b == '\n' {
+			printable++
+		}
+	}
+	weight := 0.5
+	if bytes.Contains(data, []byte("\n/")) || bytes.HasPrefix(data, []byte("/")) {
+		weight += 0.25
+	}
+	if bytes.Contains(data, []byte("\r\n!")) {
+		weight += 0.25
+	}
+	return float64(printable) / float64(len(data)) * weight
+}
+
+var (
+	smlStart = []byte{0x1b, 0x1b, 0x1b, 0x1b, 0x01, 0x01, 0x01, 0x01}
+	smlEnd   = []byte{0x1b, 0x1b, 0x1b, 0x1b, 0x1a}
+)
+
+// scoreSML returns the share of data between SML start and end escapes
+func scoreSML(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	covered := 0
+	rest := data
+	for {
+		start := bytes.Index(rest, smlStart)
+		if start < 0 {
+			break
+		}
+		end := bytes.Index(rest[start:], smlEnd)
+		if end < 0 {
+			break
+		}
+		// The end escape is followed by the padding and a CRC
+		end = start + end + len(smlEnd) + 3
+		if end > len(rest) {
+			end = len(rest)
+		}
+		covered += end - start
+		rest = rest[end:]
+	}
+	return float64(covered) / float64(len(data))
+}
@@ -0,0 +1,97 @@
+package probe
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/kaifa"
+	"math/rand"
+	"testing"
+)
+
+// shortFrame returns a Kaifa frame with only the current power, including the flags
+func shortFrame() []byte {
+	body := []byte{
+		0x01, 0x00, 0x01, 0x10, // Addresses and control field
+		0x00, 0x00, // Header checksum
+		0xe6, 0xe7, 0x00, 0x0f, 0x40, 0x00, 0x00, 0x00,
+		0x09, 0x0c, 0x07, 0xe4, 0x08, 0x14, 0x04, 0x0b, 0x1b, 0x0f, 0xff, 0x80, 0x00, 0x00,
+		0x02, 0x01,
+		0x06, 0x00, 0x00, 0x04, 0xd2,
+		0x00, 0x00, // Frame checksum
+	}
+	fr := append([]byte{0xa0, byte(len(body) + 2)}, body...)
+	hcs := kaifa.Checksum(fr[:6])
+	fr[6], fr[7] = byte(hcs>>8), byte(hcs)
+	fcs := kaifa.Checksum(fr[:len(fr)-2])
+	fr[len(fr)-2], fr[len(fr)-1] = byte(fcs>>8), byte(fcs)
+	return append(append([]byte{0x7e}, fr...), 0x7e)
+}
+
+func noise(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+func TestHDLC(t *testing.T) {
+	var data []byte
+	for i := 0; i < 5; i++ {
+		data = append(data, shortFrame()...)
+	}
+	// Started listening in the middle of a frame
+	data = append(shortFrame()[10:], data...)
+
+	r := Score(Candidates[0], data)
+	p, score := r.Best()
+	assert.Equal(t, HDLC, p)
+	assert.True(t, score > 0.8)
+	assert.Equal(t, 5, r.Kaifa)
+}
+
+func TestDSMR(t *testing.T) {
+	telegram := "/ISK5\\2M550T-1012\r\n\r\n1-3:0.2.8(50)\r\n0-0:1.0.0(200820112715S)\r\n1-0:1.8.1(001581.123*kWh)\r\n!1A2B\r\n"
+	r := Score(Candidates[2], []byte(telegram+telegram))
+	p, score := r.Best()
+	assert.Equal(t, DSMR, p)
+	assert.Equal(t, 1.0, score)
+	assert.Equal(t, 0, r.Kaifa)
+}
+
+func TestSML(t *testing.T) {
+	msg := append(append(append([]byte{}, smlStart...), noise(200)...), smlEnd...)
+	msg = append(msg, 0x00, 0x12, 0x34)
+	p, score := Score(Candidates[4], append(msg, msg...)).Best()
+	assert.Equal(t, SML, p)
+	assert.Equal(t, 1.0, score)
+}
+
+func TestNoise(t *testing.T) {
+	// Wrong baud rates give garbage, which shouldn't look like any protocol
+	r := Score(Candidates[0], noise(2000))
+	_, score := r.Best()
+	assert.True(t, score < 0.5)
+	assert.Equal(t, 0.0, r.Scores[HDLC])
+
+	_, score = Score(Candidates[0], nil).Best()
+	assert.Equal(t, 0.0, score)
+}
+
+func TestRank(t *testing.T) {
+	res := []Result{
+		Score(Candidates[0], noise(100)),
+		Score(Candidates[1], shortFrame()),
+	}
+	Rank(res)
+	assert.Equal(t, Candidates[1], res[0].Candidate)
+}
+
+func TestFraming(t *testing.T) {
+	size, parity, stop, err := ParseFraming("7E1")
+	assert.NoError(t, err)
+	assert.Equal(t, Settings{9600, 7, 'E', 1}, Settings{9600, size, parity, stop})
+	assert.Equal(t, "9600 7E1", Settings{9600, size, parity, stop}.String())
+
+	_, _, _, err = ParseFraming("8X1")
+	assert.Error(t, err)
+	_, _, _, err = ParseFraming("81")
+	assert.Error(t, err)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/payload"
+	"hemtjan.st/kraft/queue"
+	"hemtjan.st/kraft/throttle"
+	"lib.hemtjan.st/transport/mqtt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sink publishes the readings to MQTT in one of the payload formats
+type sink struct {
+	mq     mqtt.MQTT
+	format payload.Format
+	retain bool
+	// queue holds the energy registers while the broker is unreachable, may be nil
+	queue *queue.Queue
+	// filter decides which values are published, nil publishes everything
+	filter *throttle.Filter
+	// keepalive publishes all values if nothing has been published for this
+	// long, so that Home Assistant doesn't expire them
+	keepalive time.Duration
+	// text holds the last published value of the fields that aren't numbers
+	text        map[string]string
+	lastPublish time.Time
+}
+
+// publish publishes b to topic with the retain flag of the sink
+func (s *sink) publish(topic string, b []byte) {
+	s.mq.Publish(topic, b, s.retain)
+}
+
+// publishState encodes st and publishes it to topic, or to topics below it
+// for payload.Tree. It returns the topics published to.
+func (s *sink) publishState(topic string, st *payload.State) []string {
+	if s.filter != nil {
+		if st = s.apply(st); st == nil {
+			return nil
+		}
+	}
+	parts, err := payload.Encode(s.format, st)
+	if err != nil {
+		log.Printf("Error encoding %s payload: %v", s.format, err)
+		return nil
+	}
+	at := st.Received
+	if at.IsZero() {
+		at = time.Now()
+	}
+	var res []string
+	for _, p := range parts {
+		t := topic
+		if p.Topic != "" {
+			t += "/" + p.Topic
+		}
+		if s.queue != nil && registers(s.format, st, p) {
+			m := queue.Message{Topic: t, Payload: p.Payload, Retain: s.retain, Time: at}
+			if s.format != payload.Tree {
+				// The power, voltage and current would be stale when
+				// replayed, only the registers are worth replaying. They
+				// go to their own topic to leave the retained state alone.
+				if rp, err := payload.Encode(s.format, registerState(st)); err == nil {
+					m.Replay, m.ReplayTopic = rp[0].Payload, t+"/replay"
+				}
+			}
+			s.queue.Publish(m)
+		} else {
+			s.publish(t, p.Payload)
+		}
+		res = append(res, t)
+	}
+	return res
+}
+
+// apply runs the numeric fields of st through the filter. It returns nil if
+// no number is due, otherwise st with the values to publish and the changed
+// fields marked.
+func (s *sink) apply(st *payload.State) *payload.State {
+	if s.text == nil {
+		s.text = map[string]string{}
+	}
+	now := time.Now()
+	changed := map[string]bool{}
+	due := false
+	var held []payload.Field
+	for _, f := range st.Fields() {
+		key := f.Key()
+		var v float64
+		switch n := f.Value.(type) {
+		case int64:
+			v = float64(n)
+		case float64:
+			v = n
+		default:
+			// Timestamps and identity follow along, but don't cause a publish
+			if t := f.Text(); t != s.text[key] {
+				s.text[key] = t
+				changed[key] = true
+			}
+			continue
+		}
+		out, ok := s.filter.Offer(key, now, v)
+		if ok {
+			changed[key] = true
+			due = true
+		}
+		if !s.filter.Published(key) {
+			continue
+		}
+		if _, isInt := f.Value.(int64); isInt {
+			f.Value = int64(math.Round(out))
+		} else {
+			f.Value = out
+		}
+		held = append(held, f)
+	}
+	res := st.With(held)
+	res.Changed = changed
+	if s.keepalive > 0 && now.Sub(s.lastPublish) >= s.keepalive {
+		res.Changed = nil
+	} else if !due {
+		return nil
+	}
+	s.lastPublish = now
+	return res
+}
+
+// registers returns if p carries the energy registers, which are only sent
+// once an hour and are worth queueing. Live values like the current power are
+// dropped instead.
+func registers(f payload.Format, st *payload.State, p payload.Part) bool {
+	if st.Message == nil || st.EnergyTimestamp == nil {
+		return false
+	}
+	return f != payload.Tree || strings.HasPrefix(p.Topic, "energy/") || strings.HasPrefix(p.Topic, "reactive_energy/")
+}
+
+// registerState returns st with only the meter identity and the energy registers
+func registerState(st *payload.State) *payload.State {
+	m := st.Message
+	return &payload.State{Message: &kaifa.Message{
+		Timestamp:              m.Timestamp,
+		MeterID:                m.MeterID,
+		EnergyTimestamp:        m.EnergyTimestamp,
+		ActiveEnergyPositive:   m.ActiveEnergyPositive,
+		ActiveEnergyNegative:   m.ActiveEnergyNegative,
+		ReactiveEnergyPositive: m.ReactiveEnergyPositive,
+		ReactiveEnergyNegative: m.ReactiveEnergyNegative,
+	}}
+}
+
+// watchBroker marks q online once a ping published to a private topic comes
+// back, which only happens once the broker is reachable. It is marked offline
+// by the reconnect loop. online is called each time the broker is reachable again.
+func watchBroker(mq mqtt.MQTT, q *queue.Queue, online func()) {
+	topic := "kraft/ping/" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	echo := mq.Subscribe(topic)
+	tick := time.NewTicker(2 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case _, ok := <-echo:
+			if !ok {
+				return
+			}
+			if !q.Online() {
+				q.SetOnline(true)
+				online()
+			}
+		case <-tick.C:
+			if !q.Online() {
+				mq.Publish(topic, []byte("ping"), false)
+			}
+		}
+	}
+}
+
+// flush waits until everything published to mq before the call has reached
+// the broker, by publishing to a private topic until the message comes back.
+// It returns false if that takes longer than timeout.
+func flush(mq mqtt.MQTT, timeout time.Duration) bool {
+	topic := "kraft/flush/" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	echo := mq.Subscribe(topic)
+	defer mq.Unsubscribe(topic)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	deadline := time.After(timeout)
+	mq.Publish(topic, []byte("flush"), false)
+	for {
+		select {
+		case _, ok := <-echo:
+			return ok
+		case <-tick.C:
+			// The subscription may not have been in place yet
+			mq.Publish(topic, []byte("flush"), false)
+		case <-deadline:
+			return false
+		}
+	}
+}
@@ -0,0 +1,307 @@
+// Package quality monitors the supply voltage, loosely following EN 50160.
+//
+// The meter only reports RMS voltages every few seconds, so short dips are
+// only caught if they happen to be sampled. Conditions are still useful as
+// evidence of a poor supply.
+package quality
+
+import (
+	"fmt"
+	"hemtjan.st/kraft/event"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/sensor"
+	"time"
+)
+
+// Condition types, as used for event.Event.Type
+const (
+	Overvoltage  = "overvoltage"
+	Undervoltage = "undervoltage"
+	// Dip is an undervoltage that ended within Config.DipDuration
+	Dip = "dip"
+	// MissingPhase is a phase that is normally present dropping to zero
+	MissingPhase = "missing_phase"
+	// Outage is when all phases are lost, or no frames arrive at all
+	Outage = "outage"
+)
+
+// window is the length of the mean values used for compliance
+const window = 10 * time.Minute
+
+// Config holds the voltage limits
+type Config struct {
+	// Phases is the number of phases, normally 1 or 3
+	Phases int
+	// Nominal is the nominal voltage, e.g. 230
+	Nominal float64
+	// Tolerance is the allowed deviation from Nominal as a fraction, e.g. 0.1 for ±10%
+	Tolerance float64
+	// Interruption is the fraction of Nominal below which a phase counts as lost
+	Interruption float64
+	// DipDuration is the longest undervoltage that is reported as a dip
+	DipDuration time.Duration
+	// OutageGap is the longest time without frames before it is reported as an outage
+	OutageGap time.Duration
+}
+
+type condition struct {
+	typ     string
+	start   time.Time
+	extreme float64
+}
+
+type phase struct {
+	// present is set once the phase has had a voltage
+	present bool
+	cond    *condition
+
+	// Current 10 minute window
+	winStart time.Time
+	sum      float64
+	n        int
+	mean     *float64
+
+	// Number of 10 minute means this week, and how many were within limits
+	total, within int
+}
+
+// Monitor detects voltage events and keeps compliance statistics
+type Monitor struct {
+	cfg       Config
+	phases    []phase
+	last      time.Time
+	weekStart time.Time
+}
+
+// New creates a Monitor
+func New(cfg Config) (*Monitor, error) {
+	if cfg.Phases < 1 || cfg.Nominal <= 0 || cfg.Tolerance <= 0 {
+		return nil, fmt.Errorf("invalid voltage limits: %d phases, %g V ±%g", cfg.Phases, cfg.Nominal, cfg.Tolerance)
+	}
+	return &Monitor{cfg: cfg, phases: make([]phase, cfg.Phases)}, nil
+}
+
+// Update feeds a message to the monitor and returns the events that started or ended
+func (m *Monitor) Update(msg *kaifa.Message) []event.Event {
+	var res []event.Event
+	now := msg.Timestamp
+
+	if m.cfg.OutageGap > 0 && !m.last.IsZero() && now.Sub(m.last) > m.cfg.OutageGap {
+		// The meter is powered by the grid, so a full outage shows up as missing frames
+		start := m.last
+		res = append(res, event.Event{
+			Source:  "quality",
+			Type:    Outage,
+			Level:   event.Clear,
+			Time:    now,
+			Start:   &start,
+			Message: fmt.Sprintf("No frames from %s to %s", start.Format(time.RFC3339), now.Format(time.RFC3339)),
+		})
+	}
+	if now.After(m.last) {
+		m.last = now
+	}
+	if len(msg.Phases) == 0 {
+		return res
+	}
+
+	lost, present := 0, 0
+	for _, ph := range msg.Phases {
+		if ph.Index >= 1 && ph.Index <= len(m.phases) && m.phases[ph.Index-1].present {
+			present++
+			if ph.Voltage < m.cfg.Interruption*m.cfg.Nominal {
+				lost++
+			}
+		}
+	}
+
+	for _, ph := range msg.Phases {
+		if ph.Index < 1 || ph.Index > len(m.phases) {
+			continue
+		}
+		p := &m.phases[ph.Index-1]
+		m.addMean(p, now, ph.Voltage)
+
+		typ := m.classify(ph.Voltage)
+		if typ == MissingPhase {
+			if !p.present {
+				// Never been present, e.g. a single phase installation
+				typ = ""
+			} else if lost == present {
+				typ = Outage
+			}
+		} else {
+			p.present = true
+		}
+
+		if p.cond != nil && p.cond.typ != typ {
+			res = append(res, m.end(ph.Index, p, now, ph.Voltage))
+		}
+		if p.cond == nil && typ != "" {
+			p.cond = &condition{typ: typ, start: now, extreme: ph.Voltage}
+			level := event.Warning
+			if typ == MissingPhase || typ == Outage {
+				level = event.Critical
+			}
+			res = append(res, event.Event{
+				Source:  "quality",
+				Type:    typ,
+				Level:   level,
+				Phase:   ph.Index,
+				Time:    now,
+				Value:   ph.Voltage,
+				Message: fmt.Sprintf("Phase %d %s at %.1f V", ph.Index, typ, ph.Voltage),
+			})
+		} else if p.cond != nil {
+			if (typ == Overvoltage && ph.Voltage > p.cond.extreme) || (typ != Overvoltage && ph.Voltage < p.cond.extreme) {
+				p.cond.extreme = ph.Voltage
+			}
+		}
+	}
+
+	// Done after the samples so that the last window of the week is included
+	return append(res, m.rollWeek(now)...)
+}
+
+// classify returns the condition a voltage sample indicates, or an empty string
+func (m *Monitor) classify(v float64) string {
+	switch {
+	case v < m.cfg.Interruption*m.cfg.Nominal:
+		return MissingPhase
+	case v < m.cfg.Nominal*(1-m.cfg.Tolerance):
+		return Undervoltage
+	case v > m.cfg.Nominal*(1+m.cfg.Tolerance):
+		return Overvoltage
+	}
+	return ""
+}
+
+// end ends the current condition of phase p
+func (m *Monitor) end(idx int, p *phase, now time.Time, v float64) event.Event {
+	c := p.cond
+	p.cond = nil
+	typ := c.typ
+	if typ == Undervoltage && now.Sub(c.start) <= m.cfg.DipDuration {
+		typ = Dip
+	}
+	start, extreme := c.start, c.extreme
+	return event.Event{
+		Source:  "quality",
+		Type:    typ,
+		Level:   event.Clear,
+		Phase:   idx,
+		Time:    now,
+		Value:   v,
+		Start:   &start,
+		Extreme: &extreme,
+		Message: fmt.Sprintf("Phase %d %s from %s to %s, extreme %.1f V",
+			idx, typ, start.Format(time.RFC3339), now.Format(time.RFC3339), extreme),
+	}
+}
+
+// addMean adds a sample to the 10 minute mean of p
+func (m *Monitor) addMean(p *phase, now time.Time, v float64) {
+	win := now.Truncate(window)
+	if !win.Equal(p.winStart) {
+		if p.n > 0 {
+			mean := p.sum / float64(p.n)
+			p.mean = &mean
+			if p.present {
+				p.total++
+				if mean >= m.cfg.Nominal*(1-m.cfg.Tolerance) && mean <= m.cfg.Nominal*(1+m.cfg.Tolerance) {
+					p.within++
+				}
+			}
+		}
+		p.winStart, p.sum, p.n = win, 0, 0
+	}
+	p.sum += v
+	p.n++
+}
+
+// rollWeek resets the compliance statistics when a new week starts and
+// returns a summary of the previous week
+func (m *Monitor) rollWeek(now time.Time) []event.Event {
+	ws := weekStart(now)
+	if ws.Equal(m.weekStart) {
+		return nil
+	}
+	var res []event.Event
+	if !m.weekStart.IsZero() {
+		for i := range m.phases {
+			p := &m.phases[i]
+			if p.total == 0 {
+				continue
+			}
+			start := m.weekStart
+			c := compliance(p)
+			res = append(res, event.Event{
+				Source:  "quality",
+				Type:    "compliance",
+				Level:   event.Info,
+				Phase:   i + 1,
+				Time:    now,
+				Value:   c,
+				Start:   &start,
+				Message: fmt.Sprintf("Phase %d: %.1f%% of 10 minute means within limits during week of %s", i+1, c, start.Format("2006-01-02")),
+			})
+		}
+	}
+	for i := range m.phases {
+		m.phases[i].total, m.phases[i].within = 0, 0
+	}
+	m.weekStart = ws
+	return res
+}
+
+func compliance(p *phase) float64 {
+	return float64(p.within) / float64(p.total) * 100
+}
+
+func weekStart(t time.Time) time.Time {
+	d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	// Weeks start on Monday
+	return d.AddDate(0, 0, -((int(d.Weekday()) + 6) % 7))
+}
+
+// Sensors implements sensor.Source
+func (m *Monitor) Sensors() []sensor.Sensor {
+	var res []sensor.Sensor
+	for i := 1; i <= m.cfg.Phases; i++ {
+		res = append(res,
+			sensor.Sensor{
+				ID:          fmt.Sprintf("phase_%d_voltage_10min", i),
+				Feature:     fmt.Sprintf("phase%dVoltage10Min", i),
+				Name:        fmt.Sprintf("Phase %d Voltage (10 min mean)", i),
+				Unit:        "V",
+				DeviceClass: "voltage",
+				StateClass:  "measurement",
+				Precision:   1,
+			},
+			sensor.Sensor{
+				ID:         fmt.Sprintf("phase_%d_voltage_compliance", i),
+				Feature:    fmt.Sprintf("phase%dVoltageCompliance", i),
+				Name:       fmt.Sprintf("Phase %d Voltage Compliance", i),
+				Unit:       "%",
+				StateClass: "measurement",
+				Precision:  1,
+			},
+		)
+	}
+	return res
+}
+
+// Values implements sensor.Source
+func (m *Monitor) Values() sensor.Values {
+	v := sensor.Values{}
+	for i := range m.phases {
+		p := &m.phases[i]
+		if p.mean != nil {
+			v[fmt.Sprintf("phase_%d_voltage_10min", i+1)] = *p.mean
+		}
+		if p.total > 0 {
+			v[fmt.Sprintf("phase_%d_voltage_compliance", i+1)] = compliance(p)
+		}
+	}
+	return v
+}
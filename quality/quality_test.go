@@ -0,0 +1,109 @@
+package quality
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/event"
+	"hemtjan.st/kraft/kaifa/kaifatest"
+	"testing"
+	"time"
+)
+
+var testConfig = Config{
+	Phases:       3,
+	Nominal:      230,
+	Tolerance:    0.1,
+	Interruption: 0.05,
+	DipDuration:  time.Minute,
+	OutageGap:    time.Minute,
+}
+
+func TestEvents(t *testing.T) {
+	m, err := New(testConfig)
+	assert.NoError(t, err)
+	// A Thursday
+	start := kaifatest.Start
+
+	assert.Empty(t, m.Update(kaifatest.Voltages(start, 230, 231, 229)))
+
+	// Short undervoltage is reported as a dip
+	evs := m.Update(kaifatest.Voltages(start.Add(10*time.Second), 200, 231, 229))
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, Undervoltage, evs[0].Type)
+		assert.Equal(t, event.Warning, evs[0].Level)
+		assert.Equal(t, 1, evs[0].Phase)
+	}
+	assert.Empty(t, m.Update(kaifatest.Voltages(start.Add(20*time.Second), 190, 231, 229)))
+	evs = m.Update(kaifatest.Voltages(start.Add(30*time.Second), 228, 231, 229))
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, Dip, evs[0].Type)
+		assert.Equal(t, event.Clear, evs[0].Level)
+		assert.Equal(t, start.Add(10*time.Second), *evs[0].Start)
+		assert.Equal(t, 190.0, *evs[0].Extreme)
+	}
+
+	// Overvoltage keeps track of the maximum
+	m.Update(kaifatest.Voltages(start.Add(40*time.Second), 228, 255, 229))
+	m.Update(kaifatest.Voltages(start.Add(50*time.Second), 228, 258, 229))
+	evs = m.Update(kaifatest.Voltages(start.Add(time.Minute), 228, 240, 229))
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, Overvoltage, evs[0].Type)
+		assert.Equal(t, 258.0, *evs[0].Extreme)
+	}
+
+	// Losing a single phase
+	evs = m.Update(kaifatest.Voltages(start.Add(2*time.Minute), 228, 231, 0))
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, MissingPhase, evs[0].Type)
+		assert.Equal(t, event.Critical, evs[0].Level)
+		assert.Equal(t, 3, evs[0].Phase)
+	}
+
+	// No frames for a while is an outage
+	evs = m.Update(kaifatest.Voltages(start.Add(20*time.Minute), 228, 231, 229))
+	if assert.Len(t, evs, 2) {
+		assert.Equal(t, Outage, evs[0].Type)
+		assert.Equal(t, start.Add(2*time.Minute), *evs[0].Start)
+		assert.Equal(t, MissingPhase, evs[1].Type)
+		assert.Equal(t, event.Clear, evs[1].Level)
+	}
+}
+
+func TestNeverPresent(t *testing.T) {
+	m, _ := New(testConfig)
+	start := kaifatest.Start
+	// A phase that has never had a voltage isn't reported as missing
+	assert.Empty(t, m.Update(kaifatest.Voltages(start, 230, 0, 0)))
+}
+
+func TestCompliance(t *testing.T) {
+	m, _ := New(testConfig)
+	// Sunday evening
+	start := time.Date(2020, 8, 23, 22, 0, 0, 0, time.UTC)
+
+	var evs []event.Event
+	for ts := start; ts.Before(start.Add(3 * time.Hour)); ts = ts.Add(time.Minute) {
+		v := 230.0
+		if ts.Hour() == 22 && ts.Minute() < 30 {
+			v = 200
+		}
+		evs = append(evs, m.Update(kaifatest.Voltages(ts, v, v, v))...)
+		if ts.Equal(start.Add(2*time.Hour - time.Minute)) {
+			// 11 closed windows, 3 of them outside the limits
+			v := m.Values()
+			assert.InDelta(t, 8.0/11*100, v["phase_1_voltage_compliance"], 0.01)
+			assert.InDelta(t, 230, v["phase_1_voltage_10min"], 0.01)
+		}
+	}
+
+	var summary []event.Event
+	for _, ev := range evs {
+		if ev.Type == "compliance" {
+			summary = append(summary, ev)
+		}
+	}
+	// The last window of the week is included in the summary
+	if assert.Len(t, summary, 3) {
+		assert.InDelta(t, 75, summary[0].Value, 0.01)
+		assert.Equal(t, time.Date(2020, 8, 17, 0, 0, 0, 0, time.UTC), *summary[0].Start)
+	}
+}
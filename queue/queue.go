@@ -0,0 +1,205 @@
+// Package queue holds important MQTT messages while the broker is
+// unreachable and replays them when it comes back.
+package queue
+
+import (
+	"hemtjan.st/kraft/persist"
+	"log"
+	"sync"
+	"time"
+)
+
+// Message is a queued message
+type Message struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	// Replay is published instead of Payload if the message is replayed,
+	// e.g. without the live values that would be stale by then
+	Replay []byte `json:"replay,omitempty"`
+	// ReplayTopic is the topic Replay is published on instead of Topic, not
+	// retained, so that it doesn't replace the retained state
+	ReplayTopic string `json:"replay_topic,omitempty"`
+	Retain      bool   `json:"retain"`
+	// Time is when the message was published by the host clock, which
+	// decides if it is within the grace period
+	Time time.Time `json:"time"`
+}
+
+// replayed returns m as it is replayed
+func (m Message) replayed() Message {
+	if m.Replay != nil {
+		m.Payload, m.Replay = m.Replay, nil
+	}
+	if m.ReplayTopic != "" {
+		m.Topic, m.ReplayTopic, m.Retain = m.ReplayTopic, "", false
+	}
+	return m
+}
+
+// file is what the queue persists
+type file struct {
+	Queued []Message `json:"queued"`
+	// Sent are the messages published within grace, they are replayed if
+	// kraft died before that had passed
+	Sent []Message `json:"sent,omitempty"`
+}
+
+// PublishFunc publishes a message
+type PublishFunc func(topic string, payload []byte, retain bool)
+
+// Queue is a bounded queue of messages, persisted to a file
+type Queue struct {
+	path    string
+	max     int
+	grace   time.Duration
+	publish PublishFunc
+
+	// pub keeps the publishes in order, they are made without holding mu so
+	// that a slow publish doesn't hold up Online and Len
+	pub    sync.Mutex
+	mu     sync.Mutex
+	online bool
+	msgs   []Message
+	// sent are the messages published within grace, in case the connection
+	// was already lost when they were published
+	sent []Message
+}
+
+// Open creates a Queue with room for max messages. Messages published less
+// than grace before the connection is found to be lost are replayed too. If
+// path isn't empty, messages queued before a restart are loaded from it,
+// including those published within grace before kraft died.
+func Open(path string, max int, grace time.Duration, publish PublishFunc) (*Queue, error) {
+	q := &Queue{path: path, max: max, grace: grace, publish: publish}
+	if path != "" {
+		var f file
+		if err := persist.Load(path, &f); err != nil {
+			return nil, err
+		}
+		for _, m := range q.expire(f.Sent, time.Now()) {
+			q.msgs = append(q.msgs, m.replayed())
+		}
+		q.msgs = append(q.msgs, f.Queued...)
+		q.trim()
+	}
+	return q, nil
+}
+
+// Publish publishes m, or queues it if the broker is unreachable
+func (q *Queue) Publish(m Message) {
+	q.pub.Lock()
+	defer q.pub.Unlock()
+	q.mu.Lock()
+	online := q.online
+	if online {
+		q.sent = append(q.expire(q.sent, m.Time), m)
+	} else {
+		q.enqueue(m)
+	}
+	q.save()
+	q.mu.Unlock()
+	if online {
+		q.publish(m.Topic, m.Payload, m.Retain)
+	}
+}
+
+// SetOnline tells the queue if the broker is reachable. The queued messages
+// are published in order when it becomes reachable.
+func (q *Queue) SetOnline(online bool) {
+	q.pub.Lock()
+	defer q.pub.Unlock()
+	q.mu.Lock()
+	if online == q.online {
+		q.mu.Unlock()
+		return
+	}
+	q.online = online
+	now := time.Now()
+	if !online {
+		sent := q.expire(q.sent, now)
+		q.sent = nil
+		if len(sent) > 0 {
+			for i := range sent {
+				sent[i] = sent[i].replayed()
+			}
+			q.msgs = append(sent, q.msgs...)
+			q.trim()
+			q.save()
+		}
+		q.mu.Unlock()
+		return
+	}
+	msgs := q.msgs
+	q.msgs = nil
+	// The replayed messages are kept like the ones just published, until
+	// the grace has passed
+	for _, m := range msgs {
+		m.Time = now
+		q.sent = append(q.sent, m)
+	}
+	q.save()
+	q.mu.Unlock()
+
+	if len(msgs) == 0 {
+		return
+	}
+	log.Printf("Replaying %d queued messages", len(msgs))
+	for _, m := range msgs {
+		q.publish(m.Topic, m.Payload, m.Retain)
+	}
+}
+
+// Delivered tells the queue that everything published so far has reached the
+// broker, so that it isn't replayed after a restart
+func (q *Queue) Delivered() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.sent) > 0 {
+		q.sent = nil
+		q.save()
+	}
+}
+
+// Online returns if the broker is reachable
+func (q *Queue) Online() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.online
+}
+
+// Len returns the number of queued messages
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.msgs)
+}
+
+func (q *Queue) enqueue(m Message) {
+	q.msgs = append(q.msgs, m.replayed())
+	q.trim()
+}
+
+// trim drops the oldest messages if the queue is full
+func (q *Queue) trim() {
+	if q.max > 0 && len(q.msgs) > q.max {
+		log.Printf("Queue full, dropping %d messages", len(q.msgs)-q.max)
+		q.msgs = q.msgs[len(q.msgs)-q.max:]
+	}
+}
+
+// expire returns the messages sent within grace of now
+func (q *Queue) expire(msgs []Message, now time.Time) []Message {
+	for len(msgs) > 0 && now.Sub(msgs[0].Time) > q.grace {
+		msgs = msgs[1:]
+	}
+	return msgs
+}
+
+func (q *Queue) save() {
+	if q.path == "" {
+		return
+	}
+	if err := persist.Save(q.path, file{Queued: q.msgs, Sent: q.sent}); err != nil {
+		log.Printf("Error saving queue: %v", err)
+	}
+}
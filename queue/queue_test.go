@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	topics   []string
+	payloads []string
+}
+
+func (r *recorder) publish(topic string, payload []byte, retain bool) {
+	r.topics = append(r.topics, topic)
+	r.payloads = append(r.payloads, string(payload))
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.json")
+
+	r := &recorder{}
+	q, err := Open(path, 2, 0, r.publish)
+	assert.NoError(t, err)
+
+	// Offline until told otherwise, the oldest message is dropped when full
+	now := time.Now()
+	q.Publish(Message{Topic: "a", Time: now})
+	q.Publish(Message{Topic: "b", Time: now})
+	q.Publish(Message{Topic: "c", Time: now})
+	assert.Empty(t, r.topics)
+	assert.Equal(t, 2, q.Len())
+
+	// Survives a restart
+	q, err = Open(path, 2, 0, r.publish)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, q.Len())
+
+	q.SetOnline(true)
+	assert.Equal(t, []string{"b", "c"}, r.topics)
+	assert.Equal(t, 0, q.Len())
+
+	q.Publish(Message{Topic: "d", Time: now})
+	assert.Equal(t, []string{"b", "c", "d"}, r.topics)
+}
+
+func TestGrace(t *testing.T) {
+	r := &recorder{}
+	q, _ := Open("", 10, time.Minute, r.publish)
+	q.SetOnline(true)
+
+	now := time.Now()
+	q.Publish(Message{Topic: "old", Time: now.Add(-2 * time.Minute)})
+	q.Publish(Message{Topic: "recent", Time: now.Add(-10 * time.Second)})
+	q.SetOnline(false)
+	q.Publish(Message{Topic: "offline", Time: now})
+
+	// The recent message may have been lost with the connection
+	r.topics = nil
+	q.SetOnline(true)
+	assert.Equal(t, []string{"recent", "offline"}, r.topics)
+}
+
+func TestReplay(t *testing.T) {
+	r := &recorder{}
+	q, _ := Open("", 10, time.Minute, r.publish)
+	q.SetOnline(true)
+
+	now := time.Now()
+	state := Message{Topic: "state", Payload: []byte("full"), Replay: []byte("registers"), ReplayTopic: "state/replay", Retain: true, Time: now}
+	q.Publish(state)
+	q.SetOnline(false)
+	q.Publish(state)
+	q.Publish(Message{Topic: "event", Payload: []byte("event"), Time: now})
+	assert.Equal(t, []string{"full"}, r.payloads)
+
+	// Stale live values aren't replayed, and the retained state is left alone
+	r.topics, r.payloads = nil, nil
+	q.SetOnline(true)
+	assert.Equal(t, []string{"registers", "registers", "event"}, r.payloads)
+	assert.Equal(t, []string{"state/replay", "state/replay", "event"}, r.topics)
+}
+
+func TestCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.json")
+
+	r := &recorder{}
+	q, _ := Open(path, 10, time.Minute, r.publish)
+	q.SetOnline(true)
+	q.Publish(Message{Topic: "old", Time: time.Now().Add(-2 * time.Minute)})
+	q.Publish(Message{Topic: "a", Time: time.Now()})
+
+	// A message published within grace may have been lost if kraft died
+	q, _ = Open(path, 10, time.Minute, r.publish)
+	assert.Equal(t, 1, q.Len())
+
+	// Replayed messages are kept until the grace has passed too
+	q.SetOnline(true)
+	q, _ = Open(path, 10, time.Minute, r.publish)
+	assert.Equal(t, 1, q.Len())
+
+	// Not once the broker is known to have them
+	q.SetOnline(true)
+	q.Delivered()
+	q, _ = Open(path, 10, time.Minute, r.publish)
+	assert.Equal(t, 0, q.Len())
+}
@@ -0,0 +1,181 @@
+// Package register checks the energy registers of the meter before they are
+// published, so that a corrupted frame doesn't show up as a huge jump in the
+// statistics of e.g. Home Assistant, and a replaced meter as a reset.
+package register
+
+import (
+	"fmt"
+	"hemtjan.st/kraft/event"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/persist"
+	"time"
+)
+
+// Config decides which registers are plausible
+type Config struct {
+	// MaxPower is the most power in W that the connection can pass. Registers
+	// increasing faster than that are rejected. Unlimited if 0.
+	MaxPower float64
+	// Confirm is how many consecutive registers that agree with each other
+	// are needed to accept a register that went backwards or jumped as a
+	// reset of the counter. Defaults to 3.
+	Confirm int
+}
+
+// value is the last accepted value of a register
+type value struct {
+	Time  time.Time
+	Value int64
+	// Pending is a rejected value that later registers agree with
+	Pending      *int64     `json:",omitempty"`
+	PendingTime  *time.Time `json:",omitempty"`
+	PendingCount int        `json:",omitempty"`
+}
+
+type state struct {
+	// MeterID is the meter the last registers came from
+	MeterID string
+	// Meters holds the registers of each meter seen
+	Meters map[string]map[string]*value
+}
+
+// Checker checks the registers of each frame
+type Checker struct {
+	cfg  Config
+	path string
+	st   state
+}
+
+// New creates a Checker, restoring the registers persisted at path if set
+func New(cfg Config, path string) (*Checker, error) {
+	if cfg.Confirm < 1 {
+		cfg.Confirm = 3
+	}
+	c := &Checker{cfg: cfg, path: path, st: state{Meters: map[string]map[string]*value{}}}
+	if path != "" {
+		if err := persist.Load(path, &c.st); err != nil {
+			return nil, fmt.Errorf("loading registers: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// Check removes the implausible registers from msg and returns events for
+// rejected registers and resets
+func (c *Checker) Check(msg *kaifa.Message) ([]event.Event, error) {
+	if msg.EnergyTimestamp == nil {
+		return nil, nil
+	}
+	ts := *msg.EnergyTimestamp
+	var res []event.Event
+
+	id := c.st.MeterID
+	if msg.MeterID != nil {
+		id = *msg.MeterID
+	}
+	if id != c.st.MeterID {
+		if c.st.MeterID != "" {
+			res = append(res, event.Event{
+				Source:  "register",
+				Type:    "reset",
+				Level:   event.Warning,
+				Time:    msg.Timestamp,
+				Message: fmt.Sprintf("Meter %s replaced by %s, energy registers start over", c.st.MeterID, id),
+			})
+		}
+		c.st.MeterID = id
+	}
+	regs, ok := c.st.Meters[id]
+	if !ok {
+		regs = map[string]*value{}
+		c.st.Meters[id] = regs
+	}
+
+	for _, r := range []struct {
+		name string
+		v    **int32
+	}{
+		{"energy_import", &msg.ActiveEnergyPositive},
+		{"energy_export", &msg.ActiveEnergyNegative},
+		{"reactive_energy_import", &msg.ReactiveEnergyPositive},
+		{"reactive_energy_export", &msg.ReactiveEnergyNegative},
+	} {
+		if *r.v == nil {
+			continue
+		}
+		v := int64(**r.v)
+		last, ok := regs[r.name]
+		if !ok {
+			regs[r.name] = &value{Time: ts, Value: v}
+			continue
+		}
+		if err := c.plausible(last.Time, last.Value, ts, v); err == nil {
+			*last = value{Time: ts, Value: v}
+			continue
+		} else if c.confirms(last, ts, v) {
+			res = append(res, event.Event{
+				Source:  "register",
+				Type:    "reset",
+				Level:   event.Warning,
+				Time:    msg.Timestamp,
+				Value:   float64(v),
+				Message: fmt.Sprintf("Register %s of meter %s changed from %d to %d, accepted as a reset", r.name, id, last.Value, v),
+			})
+			*last = value{Time: ts, Value: v}
+		} else {
+			res = append(res, event.Event{
+				Source:  "register",
+				Type:    "rejected",
+				Level:   event.Warning,
+				Time:    msg.Timestamp,
+				Value:   float64(v),
+				Message: fmt.Sprintf("Rejected register %s of meter %s: %v", r.name, id, err),
+			})
+			*r.v = nil
+		}
+	}
+	if msg.ActiveEnergyPositive == nil && msg.ActiveEnergyNegative == nil &&
+		msg.ReactiveEnergyPositive == nil && msg.ReactiveEnergyNegative == nil {
+		// Nothing is left of the registers, later steps shouldn't take the
+		// frame for an hourly one
+		msg.EnergyTimestamp = nil
+	}
+
+	if c.path != "" {
+		return res, persist.Save(c.path, &c.st)
+	}
+	return res, nil
+}
+
+// plausible returns an error if the register can't have gone from v0 at t0 to v at t
+func (c *Checker) plausible(t0 time.Time, v0 int64, t time.Time, v int64) error {
+	delta := v - v0
+	if delta < 0 {
+		return fmt.Errorf("went backwards from %d to %d", v0, v)
+	}
+	if !t.After(t0) {
+		if delta != 0 {
+			return fmt.Errorf("changed from %d to %d without time passing", v0, v)
+		}
+		return nil
+	}
+	if c.cfg.MaxPower > 0 {
+		max := c.cfg.MaxPower * t.Sub(t0).Hours()
+		if float64(delta) > max+1 {
+			return fmt.Errorf("increased by %d in %s, more than %.0f is possible", delta, t.Sub(t0), max)
+		}
+	}
+	return nil
+}
+
+// confirms tracks rejected values of a register and returns true once enough
+// of them agree with each other to be a reset of the counter
+func (c *Checker) confirms(last *value, t time.Time, v int64) bool {
+	if last.Pending != nil && c.plausible(*last.PendingTime, *last.Pending, t, v) == nil {
+		last.PendingCount++
+	} else {
+		last.PendingCount = 1
+	}
+	last.Pending, last.PendingTime = &v, &t
+	return last.PendingCount >= c.cfg.Confirm
+}
@@ -0,0 +1,112 @@
+package register
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/kaifa/kaifatest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = kaifatest.Start
+
+func TestCheck(t *testing.T) {
+	// 3x20 A at 230 V
+	c, err := New(Config{MaxPower: 13800}, "")
+	assert.NoError(t, err)
+
+	evs, err := c.Check(kaifatest.Meter("A", kaifatest.Register(start, 10000, 500)))
+	assert.NoError(t, err)
+	assert.Empty(t, evs)
+
+	msg := kaifatest.Meter("A", kaifatest.Register(start.Add(time.Hour), 12000, 500))
+	evs, _ = c.Check(msg)
+	assert.Empty(t, evs)
+	assert.NotNil(t, msg.ActiveEnergyPositive)
+
+	// Going backwards
+	msg = kaifatest.Meter("A", kaifatest.Register(start.Add(2*time.Hour), 11000, 500))
+	evs, _ = c.Check(msg)
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, "rejected", evs[0].Type)
+	}
+	assert.Nil(t, msg.ActiveEnergyPositive)
+	assert.NotNil(t, msg.ActiveEnergyNegative)
+	assert.NotNil(t, msg.EnergyTimestamp)
+
+	// More than the fuse can pass in two hours, compared to the last accepted
+	msg = kaifatest.Meter("A", kaifatest.Register(start.Add(3*time.Hour), 12000+2*13800+100, 500))
+	evs, _ = c.Check(msg)
+	assert.Len(t, evs, 1)
+	assert.Nil(t, msg.ActiveEnergyPositive)
+
+	// Three hours since the last accepted register
+	msg = kaifatest.Meter("A", kaifatest.Register(start.Add(4*time.Hour), 12000+3*13800, 500))
+	evs, _ = c.Check(msg)
+	assert.Empty(t, evs)
+	assert.NotNil(t, msg.ActiveEnergyPositive)
+
+	// Without any register left the frame isn't an hourly one
+	msg = kaifatest.Meter("A", kaifatest.Register(start.Add(5*time.Hour), 1000, 100))
+	evs, _ = c.Check(msg)
+	assert.Len(t, evs, 2)
+	assert.Nil(t, msg.EnergyTimestamp)
+}
+
+func TestReset(t *testing.T) {
+	c, _ := New(Config{MaxPower: 13800, Confirm: 3}, "")
+	_, _ = c.Check(kaifatest.Meter("A", kaifatest.Register(start, 500000, 0)))
+
+	// The counter starts over, accepted once three registers agree
+	for h := 1; h <= 3; h++ {
+		msg := kaifatest.Meter("A", kaifatest.Register(start.Add(time.Duration(h)*time.Hour), int32(h*1000), 0))
+		evs, _ := c.Check(msg)
+		if !assert.Len(t, evs, 1) {
+			return
+		}
+		if h < 3 {
+			assert.Equal(t, "rejected", evs[0].Type)
+			assert.Nil(t, msg.ActiveEnergyPositive)
+		} else {
+			assert.Equal(t, "reset", evs[0].Type)
+			assert.NotNil(t, msg.ActiveEnergyPositive)
+		}
+	}
+	evs, _ := c.Check(kaifatest.Meter("A", kaifatest.Register(start.Add(4*time.Hour), 4000, 0)))
+	assert.Empty(t, evs)
+}
+
+func TestMeterReplaced(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kraft")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registers.json")
+
+	c, err := New(Config{MaxPower: 13800}, path)
+	assert.NoError(t, err)
+	_, _ = c.Check(kaifatest.Meter("A", kaifatest.Register(start, 500000, 1000)))
+
+	// Registers are restored after a restart
+	c, err = New(Config{MaxPower: 13800}, path)
+	assert.NoError(t, err)
+	msg := kaifatest.Meter("A", kaifatest.Register(start.Add(time.Hour), 400000, 1000))
+	evs, _ := c.Check(msg)
+	assert.Len(t, evs, 1)
+	assert.Nil(t, msg.ActiveEnergyPositive)
+
+	msg = kaifatest.Meter("B", kaifatest.Register(start.Add(2*time.Hour), 10, 0))
+	evs, _ = c.Check(msg)
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, "reset", evs[0].Type)
+		assert.Contains(t, evs[0].Message, "Meter A replaced by B")
+	}
+	assert.NotNil(t, msg.ActiveEnergyPositive)
+	assert.NotNil(t, msg.ActiveEnergyNegative)
+
+	// Frames without registers are left alone
+	evs, err = c.Check(&kaifa.Message{Timestamp: start})
+	assert.NoError(t, err)
+	assert.Empty(t, evs)
+}
@@ -0,0 +1,367 @@
+// Package rules raises alarms from conditions on the readings, defined in a
+// config file, e.g. the import staying above 11 kW for a minute or no frame
+// arriving for two minutes.
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hemtjan.st/kraft/event"
+	"hemtjan.st/kraft/payload"
+	"hemtjan.st/kraft/sensor"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// FrameAge is the value holding the seconds since the last frame, or since
+// kraft started if no frame has arrived yet
+const FrameAge = "frame_age"
+
+// Duration is a time.Duration written as e.g. "60s" or "5m" in the config
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"60s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Condition compares one value against a threshold
+type Condition struct {
+	// Value is the name of a field in the flat payload, e.g. power_import or
+	// phase2_voltage, a sensor like solar_power, or frame_age
+	Value string
+	// Above and Below are the thresholds, at least one must be set
+	Above *float64 `json:",omitempty"`
+	Below *float64 `json:",omitempty"`
+	// Hysteresis is how far back past the threshold the value must go
+	// before an active rule is cleared
+	Hysteresis float64 `json:",omitempty"`
+}
+
+// holds returns true if v meets the condition, active relaxes the thresholds
+// by the hysteresis
+func (c Condition) holds(v float64, active bool) bool {
+	h := 0.0
+	if active {
+		h = c.Hysteresis
+	}
+	if c.Above != nil && !(v > *c.Above-h) {
+		return false
+	}
+	if c.Below != nil && !(v < *c.Below+h) {
+		return false
+	}
+	return true
+}
+
+func (c Condition) String() string {
+	var parts []string
+	if c.Above != nil {
+		parts = append(parts, fmt.Sprintf("%s > %g", c.Value, *c.Above))
+	}
+	if c.Below != nil {
+		parts = append(parts, fmt.Sprintf("%s < %g", c.Value, *c.Below))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// Rule raises an event when all its conditions have held for Hold
+type Rule struct {
+	// Name identifies the rule, it is used as the event type and in the
+	// sensor ID, e.g. high_import
+	Name string
+	// When are the conditions, which must all hold
+	When []Condition
+	// Hold is how long the conditions must hold before the rule fires
+	Hold Duration `json:",omitempty"`
+	// Between limits the rule to a time of day, e.g. "11:00-14:00". It may
+	// span midnight.
+	Between string `json:",omitempty"`
+	// Days is weekdays or weekends, all days if empty
+	Days string `json:",omitempty"`
+	// Level is info, warning or critical, warning if empty
+	Level event.Level `json:",omitempty"`
+	// Message is the text of the event, describing the conditions if empty
+	Message string `json:",omitempty"`
+	// Webhook is a URL the events are POSTed to as JSON
+	Webhook string `json:",omitempty"`
+}
+
+// Config is the list of rules
+type Config struct {
+	Rules []Rule
+}
+
+// LoadConfig reads the rules from the JSON file at path
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+var validName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+type rule struct {
+	Rule
+	// from and to are the window in minutes since midnight, equal for all day
+	from, to int
+	active   bool
+	// since is when the conditions started to hold, zero if they don't
+	since time.Time
+}
+
+// inWindow returns true if t is within the days and hours of the rule
+func (r *rule) inWindow(t time.Time) bool {
+	weekend := t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+	if r.Days == "weekdays" && weekend || r.Days == "weekends" && !weekend {
+		return false
+	}
+	if r.from == r.to {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	if r.from < r.to {
+		return m >= r.from && m < r.to
+	}
+	return m >= r.from || m < r.to
+}
+
+// parseWindow parses a time of day range like "11:00-14:00"
+func parseWindow(s string) (from, to int, err error) {
+	var fh, fm, th, tm int
+	if _, err := fmt.Sscanf(s, "%d:%d-%d:%d", &fh, &fm, &th, &tm); err != nil {
+		return 0, 0, fmt.Errorf("invalid time range %q, expected e.g. 11:00-14:00", s)
+	}
+	if fh < 0 || fh > 24 || th < 0 || th > 24 || fm < 0 || fm > 59 || tm < 0 || tm > 59 {
+		return 0, 0, fmt.Errorf("invalid time range %q", s)
+	}
+	return fh*60 + fm, th*60 + tm, nil
+}
+
+// Engine evaluates the rules on every frame, and every second for the rules
+// on frame_age
+type Engine struct {
+	rules  []*rule
+	values map[string]float64
+	// last is the time of the last frame
+	last   time.Time
+	client *http.Client
+}
+
+// New creates an Engine after checking the rules
+func New(cfg Config) (*Engine, error) {
+	e := &Engine{values: map[string]float64{}, client: &http.Client{Timeout: 10 * time.Second}}
+	seen := map[string]bool{}
+	for _, r := range cfg.Rules {
+		if !validName.MatchString(r.Name) {
+			return nil, fmt.Errorf("invalid rule name %q, use lower case letters, digits and _", r.Name)
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("duplicate rule %s", r.Name)
+		}
+		seen[r.Name] = true
+		if len(r.When) == 0 {
+			return nil, fmt.Errorf("rule %s has no conditions", r.Name)
+		}
+		for _, c := range r.When {
+			if c.Value == "" || (c.Above == nil && c.Below == nil) {
+				return nil, fmt.Errorf("rule %s: conditions need a value and a threshold", r.Name)
+			}
+		}
+		switch r.Level {
+		case "":
+			r.Level = event.Warning
+		case event.Info, event.Warning, event.Critical:
+		default:
+			return nil, fmt.Errorf("rule %s: invalid level %q", r.Name, r.Level)
+		}
+		if r.Days != "" && r.Days != "weekdays" && r.Days != "weekends" {
+			return nil, fmt.Errorf("rule %s: days must be weekdays or weekends", r.Name)
+		}
+		rr := &rule{Rule: r}
+		if r.Between != "" {
+			var err error
+			if rr.from, rr.to, err = parseWindow(r.Between); err != nil {
+				return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+			}
+		}
+		e.rules = append(e.rules, rr)
+	}
+	return e, nil
+}
+
+// Values returns the numeric fields of st, keyed like the flat payload
+func Values(st *payload.State) map[string]float64 {
+	res := map[string]float64{}
+	for _, f := range st.Fields() {
+		switch v := f.Value.(type) {
+		case int64:
+			res[f.Key()] = float64(v)
+		case float64:
+			res[f.Key()] = v
+		}
+	}
+	return res
+}
+
+// Update evaluates the rules with the values of a frame received at now,
+// and returns the events of rules that fired or cleared. Values missing from
+// the frame, like the hourly energy registers, keep their last value.
+func (e *Engine) Update(values map[string]float64, now time.Time) []event.Event {
+	for k, v := range values {
+		e.values[k] = v
+	}
+	e.last = now
+	return e.Tick(now)
+}
+
+// Tick evaluates the rules at now without a new frame, so that rules on
+// frame_age and hold times fire without waiting for the next frame
+func (e *Engine) Tick(now time.Time) []event.Event {
+	if e.last.IsZero() {
+		e.last = now
+	}
+	e.values[FrameAge] = now.Sub(e.last).Seconds()
+
+	var res []event.Event
+	for _, r := range e.rules {
+		if ev, ok := e.eval(r, now); ok {
+			res = append(res, ev)
+			if r.Webhook != "" {
+				go e.post(r.Webhook, ev)
+			}
+		}
+	}
+	return res
+}
+
+// eval updates the state of r, returning an event if it fired or cleared
+func (e *Engine) eval(r *rule, now time.Time) (event.Event, bool) {
+	holds := r.inWindow(now)
+	for _, c := range r.When {
+		v, ok := e.values[c.Value]
+		holds = holds && ok && c.holds(v, r.active)
+	}
+	ev := event.Event{
+		Source:  "rule",
+		Type:    r.Name,
+		Time:    now,
+		Value:   e.values[r.When[0].Value],
+		Message: r.describe(),
+	}
+	if !holds {
+		if !r.active {
+			r.since = time.Time{}
+			return ev, false
+		}
+		start := r.since
+		r.active, r.since = false, time.Time{}
+		ev.Level, ev.Start = event.Clear, &start
+		ev.Message = "Cleared: " + ev.Message
+		return ev, true
+	}
+	if r.since.IsZero() {
+		r.since = now
+	}
+	if r.active || now.Sub(r.since) < time.Duration(r.Hold) {
+		return ev, false
+	}
+	r.active = true
+	ev.Level = r.Level
+	return ev, true
+}
+
+// describe returns the message of the rule, or its conditions if unset
+func (r *rule) describe() string {
+	if r.Message != "" {
+		return r.Message
+	}
+	var conds []string
+	for _, c := range r.When {
+		conds = append(conds, c.String())
+	}
+	s := strings.Join(conds, " and ")
+	if r.Hold > 0 {
+		s += fmt.Sprintf(" for %s", time.Duration(r.Hold))
+	}
+	if r.Between != "" {
+		s += " between " + r.Between
+	}
+	return s
+}
+
+// post sends ev to url, errors are only logged
+func (e *Engine) post(url string, ev event.Event) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	res, err := e.client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Printf("Error calling webhook of rule %s: %v", ev.Type, err)
+		return
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.Printf("Webhook of rule %s returned %s", ev.Type, res.Status)
+	}
+}
+
+// Sensors implements sensor.Source, with a binary sensor per rule that is
+// on while the rule is active
+func (e *Engine) Sensors() []sensor.Sensor {
+	var res []sensor.Sensor
+	for _, r := range e.rules {
+		words := strings.Split(r.Name, "_")
+		feature := "rule"
+		for i, w := range words {
+			if w != "" {
+				feature += strings.ToUpper(w[:1]) + w[1:]
+				words[i] = strings.ToUpper(w[:1]) + w[1:]
+			}
+		}
+		res = append(res, sensor.Sensor{
+			ID:          "rule_" + r.Name,
+			Feature:     feature,
+			Name:        strings.Join(words, " "),
+			DeviceClass: "problem",
+			Binary:      true,
+		})
+	}
+	return res
+}
+
+// Values implements sensor.Source
+func (e *Engine) Values() sensor.Values {
+	v := sensor.Values{}
+	for _, r := range e.rules {
+		v["rule_"+r.Name] = 0
+		if r.active {
+			v["rule_"+r.Name] = 1
+		}
+	}
+	return v
+}
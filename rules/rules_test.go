@@ -0,0 +1,225 @@
+package rules
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/event"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/payload"
+	"hemtjan.st/kraft/sensor"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capture holds three phase frames every 10 seconds from 10:50 to 11:05 on a
+// Thursday:
+//   - 10:53:00-10:55:00 import 12 kW, 10.8 kW at 10:55:10
+//   - 10:56:00-10:56:20 phase 2 at 195 V, 201 V at 10:56:30
+//   - no export at all
+//   - no frames between 11:02:00 and 11:05:00
+func capture(t *testing.T) []*kaifa.Message {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "capture.hex"))
+	assert.NoError(t, err)
+	var res []*kaifa.Message
+	for _, line := range strings.Fields(string(b)) {
+		fr, err := hex.DecodeString(strings.TrimSuffix(strings.TrimPrefix(line, "7E"), "7E"))
+		assert.NoError(t, err)
+		header, frame := kaifa.VerifyChecksums(fr)
+		assert.True(t, header && frame)
+		msg, err := kaifa.Unmarshal(fr)
+		assert.NoError(t, err)
+		res = append(res, msg)
+	}
+	return res
+}
+
+func limit(v float64) *float64 {
+	return &v
+}
+
+// replay feeds the capture to e, ticking every second between the frames
+// like the main loop does, and returns the events
+func replay(t *testing.T, e *Engine, solar float64) []event.Event {
+	var res []event.Event
+	var last time.Time
+	for _, msg := range capture(t) {
+		for ts := last.Add(time.Second); !last.IsZero() && ts.Before(msg.Timestamp); ts = ts.Add(time.Second) {
+			res = append(res, e.Tick(ts)...)
+		}
+		st := &payload.State{
+			Message: msg,
+			Kraft:   sensor.Values{"solar_power": solar},
+			Sensors: []sensor.Sensor{{ID: "solar_power"}},
+		}
+		res = append(res, e.Update(Values(st), msg.Timestamp)...)
+		last = msg.Timestamp
+	}
+	return res
+}
+
+func at(h, m, s int) time.Time {
+	return time.Date(2020, 8, 20, h, m, s, 0, time.Local)
+}
+
+func TestReplay(t *testing.T) {
+	e, err := New(Config{Rules: []Rule{
+		{
+			Name:  "high_import",
+			When:  []Condition{{Value: "power_import", Above: limit(11000), Hysteresis: 500}},
+			Hold:  Duration(time.Minute),
+			Level: event.Critical,
+		},
+		{
+			Name: "low_voltage",
+			When: []Condition{{Value: "phase2_voltage", Below: limit(200), Hysteresis: 2}},
+		},
+		{
+			Name: "no_export",
+			When: []Condition{
+				{Value: "power_export", Below: limit(1)},
+				{Value: "solar_power", Above: limit(1000)},
+			},
+			Hold:    Duration(5 * time.Minute),
+			Between: "11:00-14:00",
+			Days:    "weekdays",
+			Message: "The inverter isn't exporting",
+		},
+		{
+			Name: "no_frame",
+			When: []Condition{{Value: FrameAge, Above: limit(120)}},
+		},
+	}})
+	assert.NoError(t, err)
+
+	evs := replay(t, e, 3000)
+	type fired struct {
+		Type  string
+		Level event.Level
+		Time  time.Time
+	}
+	var got []fired
+	for _, ev := range evs {
+		got = append(got, fired{ev.Type, ev.Level, ev.Time})
+	}
+	assert.Equal(t, []fired{
+		{"high_import", event.Critical, at(10, 54, 0)},
+		// 10.8 kW is within the hysteresis
+		{"high_import", event.Clear, at(10, 55, 20)},
+		{"low_voltage", event.Warning, at(10, 56, 0)},
+		{"low_voltage", event.Clear, at(10, 56, 40)},
+		{"no_frame", event.Warning, at(11, 4, 1)},
+		// Rules are evaluated in the order of the config
+		{"no_export", event.Warning, at(11, 5, 0)},
+		{"no_frame", event.Clear, at(11, 5, 0)},
+	}, got)
+
+	assert.Equal(t, "power_import > 11000 for 1m0s", evs[0].Message)
+	assert.Equal(t, 12000.0, evs[0].Value)
+	assert.Equal(t, at(10, 53, 0), *evs[1].Start)
+	assert.Equal(t, "The inverter isn't exporting", evs[5].Message)
+
+	v := e.Values()
+	assert.Equal(t, 1.0, v["rule_no_export"])
+	assert.Equal(t, 0.0, v["rule_high_import"])
+}
+
+func TestNoSun(t *testing.T) {
+	e, err := New(Config{Rules: []Rule{{
+		Name: "no_export",
+		When: []Condition{
+			{Value: "power_export", Below: limit(1)},
+			{Value: "solar_power", Above: limit(1000)},
+		},
+		Between: "11:00-14:00",
+	}}})
+	assert.NoError(t, err)
+	assert.Empty(t, replay(t, e, 200))
+}
+
+func TestWindow(t *testing.T) {
+	r := &rule{Rule: Rule{Days: "weekends"}}
+	r.from, r.to, _ = parseWindow("22:30-06:00")
+	assert.True(t, r.inWindow(time.Date(2020, 8, 22, 23, 0, 0, 0, time.UTC)))
+	assert.True(t, r.inWindow(time.Date(2020, 8, 22, 5, 59, 0, 0, time.UTC)))
+	assert.False(t, r.inWindow(time.Date(2020, 8, 22, 22, 29, 0, 0, time.UTC)))
+	assert.False(t, r.inWindow(time.Date(2020, 8, 20, 23, 0, 0, 0, time.UTC)))
+
+	_, _, err := parseWindow("11-14")
+	assert.Error(t, err)
+}
+
+func TestConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kraft")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.json")
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"Rules": [
+		{"Name": "high_import", "When": [{"Value": "power_import", "Above": 11000}], "Hold": "60s"}
+	]}`), 0644))
+	cfg, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, Duration(time.Minute), cfg.Rules[0].Hold)
+	e, err := New(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []sensor.Sensor{{
+		ID:          "rule_high_import",
+		Feature:     "ruleHighImport",
+		Name:        "High Import",
+		DeviceClass: "problem",
+		Binary:      true,
+	}}, e.Sensors())
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"Rules": [{"Name": "x", "Hold": 60}]}`), 0644))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+
+	for _, r := range []Rule{
+		{Name: "High Import", When: []Condition{{Value: "power_import", Above: limit(1)}}},
+		{Name: "no_conditions"},
+		{Name: "no_threshold", When: []Condition{{Value: "power_import"}}},
+		{Name: "level", When: []Condition{{Value: "power_import", Above: limit(1)}}, Level: event.Clear},
+	} {
+		_, err := New(Config{Rules: []Rule{r}})
+		assert.Error(t, err, r.Name)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	got := make(chan event.Event, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev event.Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&ev))
+		got <- ev
+	}))
+	defer srv.Close()
+
+	e, err := New(Config{Rules: []Rule{{
+		Name:    "high_import",
+		When:    []Condition{{Value: "power_import", Above: limit(11000)}},
+		Webhook: srv.URL,
+	}}})
+	assert.NoError(t, err)
+	now := at(12, 0, 0)
+	assert.Len(t, e.Update(map[string]float64{"power_import": 12000}, now), 1)
+	assert.Len(t, e.Update(map[string]float64{"power_import": 2000}, now.Add(10*time.Second)), 1)
+
+	// The webhooks are called concurrently
+	var levels []event.Level
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-got:
+			assert.Equal(t, "high_import", ev.Type)
+			levels = append(levels, ev.Level)
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook not called")
+		}
+	}
+	assert.ElementsMatch(t, []event.Level{event.Warning, event.Clear}, levels)
+}
@@ -0,0 +1,73 @@
+// Package sdnotify implements the systemd service notification protocol, see
+// sd_notify(3).
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States that can be sent with Notify
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notifier sends notifications to systemd
+type Notifier struct {
+	conn *net.UnixConn
+}
+
+// New connects to the socket in $NOTIFY_SOCKET. It returns nil if kraft
+// isn't run by systemd with notifications enabled, all methods can be called
+// on a nil Notifier.
+func New() (*Notifier, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil, nil
+	}
+	// Abstract sockets start with @, which is handled by net
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &Notifier{conn: conn}, nil
+}
+
+// Notify sends state, e.g. Ready
+func (n *Notifier) Notify(state string) error {
+	if n == nil {
+		return nil
+	}
+	_, err := n.conn.Write([]byte(state))
+	return err
+}
+
+// Status sends a free-form status line, shown by systemctl status
+func (n *Notifier) Status(status string) error {
+	return n.Notify("STATUS=" + status)
+}
+
+// Close closes the connection to systemd
+func (n *Notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	return n.conn.Close()
+}
+
+// WatchdogInterval returns the watchdog timeout of the service, and false if
+// the watchdog isn't enabled for this process
+func WatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
@@ -0,0 +1,73 @@
+package sdnotify
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdnotify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A fake systemd
+	path := filepath.Join(dir, "notify")
+	sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.NoError(t, err)
+	defer sock.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	n, err := New()
+	assert.NoError(t, err)
+	defer n.Close()
+
+	read := func() string {
+		buf := make([]byte, 256)
+		_ = sock.SetReadDeadline(time.Now().Add(time.Second))
+		l, err := sock.Read(buf)
+		assert.NoError(t, err)
+		return string(buf[:l])
+	}
+	assert.NoError(t, n.Notify(Ready))
+	assert.Equal(t, "READY=1", read())
+	assert.NoError(t, n.Status("Last frame 2s ago"))
+	assert.Equal(t, "STATUS=Last frame 2s ago", read())
+}
+
+func TestDisabled(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	n, err := New()
+	assert.NoError(t, err)
+	assert.Nil(t, n)
+	assert.NoError(t, n.Notify(Ready))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	_, ok := WatchdogInterval()
+	assert.False(t, ok)
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	d, ok := WatchdogInterval()
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	// Meant for another process
+	os.Setenv("WATCHDOG_PID", "1")
+	_, ok = WatchdogInterval()
+	assert.Equal(t, os.Getpid() == 1, ok)
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	_, ok = WatchdogInterval()
+	assert.True(t, ok)
+}
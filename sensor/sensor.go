@@ -0,0 +1,62 @@
+// Package sensor describes values that kraft derives from the meter readings,
+// so that they can be published next to the values reported by the meter.
+package sensor
+
+import (
+	"strconv"
+)
+
+// Sensor describes a single derived value
+type Sensor struct {
+	// ID is the key of the value in the state payload and the Home Assistant component
+	ID string
+	// Feature is the name of the Hemtjänst feature
+	Feature string
+	// Name is the human-readable name
+	Name string
+	// Unit is the unit of measurement, e.g. W or Wh
+	Unit string
+	// DeviceClass and StateClass are passed on to Home Assistant
+	DeviceClass string
+	StateClass  string
+	// Reset is the period a total starts over after, Hour, Day or Month,
+	// which Home Assistant needs as the last reset. Empty if it never does.
+	Reset string
+	// Precision is the number of decimals used when formatting the value
+	Precision int
+	// Category is the Home Assistant entity category, Diagnostic or empty for a normal sensor
+	Category string
+	// Binary sensors are either 0 or 1, and are announced to Home Assistant
+	// as a binary_sensor
+	Binary bool
+}
+
+// Diagnostic is the Category of sensors describing kraft or the meter rather
+// than the electricity
+const Diagnostic = "diagnostic"
+
+// The periods of Sensor.Reset, in the local time of kraft
+const (
+	Hour  = "hour"
+	Day   = "day"
+	Month = "month"
+)
+
+// Format formats v with the precision of the sensor
+func (s Sensor) Format(v float64) string {
+	return strconv.FormatFloat(v, 'f', s.Precision, 64)
+}
+
+// Values maps sensor IDs to their current value. Sensors without a known
+// value are left out.
+type Values map[string]float64
+
+// Source is implemented by modules that derive values from the meter readings
+type Source interface {
+	// Sensors returns the sensors the module provides. It is called when
+	// the devices are created, after the module has been fed the first frame
+	// carrying the meter identity.
+	Sensors() []Sensor
+	// Values returns the current values
+	Values() Values
+}
@@ -0,0 +1,277 @@
+// Package solar combines the grid meter with the production of e.g. a solar
+// inverter into the consumption of the house and how much of the production
+// it used itself.
+package solar
+
+import (
+	"encoding/json"
+	"fmt"
+	"hemtjan.st/kraft/integrate"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/persist"
+	"hemtjan.st/kraft/sensor"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Energy is the energy flows during a period, in Wh
+type Energy struct {
+	Start      time.Time
+	Production float64
+	Import     float64
+	Export     float64
+	// Consumed and SelfConsumedEnergy are summed per interval, see add
+	Consumed           float64
+	SelfConsumedEnergy float64
+}
+
+// Consumption returns the energy used by the house
+func (e Energy) Consumption() float64 {
+	return e.Consumed
+}
+
+// SelfConsumed returns the part of the production used by the house
+func (e Energy) SelfConsumed() float64 {
+	return e.SelfConsumedEnergy
+}
+
+// SelfConsumption returns the share of the production used by the house, in percent
+func (e Energy) SelfConsumption() (float64, bool) {
+	if e.Production <= 0 {
+		return 0, false
+	}
+	return e.SelfConsumed() / e.Production * 100, true
+}
+
+// SelfSufficiency returns the share of the consumption covered by the production, in percent
+func (e Energy) SelfSufficiency() (float64, bool) {
+	if e.Consumption() <= 0 {
+		return 0, false
+	}
+	return e.SelfConsumed() / e.Consumption() * 100, true
+}
+
+func (e *Energy) add(production, imp, exp, hours float64) {
+	e.Production += production * hours
+	e.Import += imp * hours
+	e.Export += exp * hours
+	// A stale production reading while exporting would make these negative.
+	// Each interval counts at least 0, so that the totals never go down.
+	e.Consumed += math.Max(production+imp-exp, 0) * hours
+	e.SelfConsumedEnergy += math.Max(production-exp, 0) * hours
+}
+
+type state struct {
+	Hour     Energy
+	LastHour *Energy `json:",omitempty"`
+	Day      Energy
+}
+
+// Balance tracks the energy flows of the house. It is safe for concurrent use.
+type Balance struct {
+	stale time.Duration
+	path  string
+
+	mu sync.Mutex
+	st state
+	// reading is the last production reading in W, and readAt when it was received
+	reading float64
+	readAt  time.Time
+	// The powers at the last frame, in W
+	lastTime       time.Time
+	prod, imp, exp float64
+	gridKnown      bool
+	prodKnown      bool
+}
+
+// New creates a Balance, restoring the state persisted at path if set. The
+// production is taken to be 0 when no reading has arrived for stale, as
+// inverters often go quiet at night.
+func New(stale time.Duration, path string) (*Balance, error) {
+	b := &Balance{stale: stale, path: path}
+	if path != "" {
+		if err := persist.Load(path, &b.st); err != nil {
+			return nil, fmt.Errorf("loading solar state: %w", err)
+		}
+	}
+	return b, nil
+}
+
+// SetProduction records a production reading in W
+func (b *Balance) SetProduction(w float64, at time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reading, b.readAt = w, at
+}
+
+// currentProduction returns the production at now
+func (b *Balance) currentProduction(now time.Time) (float64, bool) {
+	if b.readAt.IsZero() {
+		return 0, false
+	}
+	if now.Sub(b.readAt) > b.stale {
+		return 0, true
+	}
+	return b.reading, true
+}
+
+// Update feeds a message from the grid meter. received is when it arrived,
+// as the production readings are timestamped by the host clock.
+func (b *Balance) Update(msg *kaifa.Message, received time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	closed := false
+	if b.gridKnown && b.prodKnown {
+		next := func(t time.Time) time.Time {
+			return hourStart(t).Add(time.Hour)
+		}
+		integrate.Split(b.lastTime, received, next, func(start, end time.Time) {
+			closed = b.advance(start) || closed
+			h := end.Sub(start).Hours()
+			b.st.Hour.add(b.prod, b.imp, b.exp, h)
+			b.st.Day.add(b.prod, b.imp, b.exp, h)
+		})
+	}
+	closed = b.advance(received) || closed
+
+	if msg.ActivePowerPositive != nil {
+		b.imp = float64(*msg.ActivePowerPositive)
+		b.gridKnown = true
+	}
+	if msg.ActivePowerNegative != nil {
+		b.exp = float64(*msg.ActivePowerNegative)
+	}
+	b.lastTime = received
+	b.prod, b.prodKnown = b.currentProduction(received)
+
+	if closed && b.path != "" {
+		return persist.Save(b.path, &b.st)
+	}
+	return nil
+}
+
+// advance starts a new hour or day if t is in one, and returns true if it did
+func (b *Balance) advance(t time.Time) bool {
+	changed := false
+	if h := hourStart(t); !h.Equal(b.st.Hour.Start) {
+		if !b.st.Hour.Start.IsZero() {
+			last := b.st.Hour
+			b.st.LastHour = &last
+		}
+		b.st.Hour = Energy{Start: h}
+		changed = true
+	}
+	if d := dayStart(t); !d.Equal(b.st.Day.Start) {
+		b.st.Day = Energy{Start: d}
+		changed = true
+	}
+	return changed
+}
+
+// Save persists the state
+func (b *Balance) Save() error {
+	if b.path == "" {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return persist.Save(b.path, &b.st)
+}
+
+// ParsePower parses a production reading in W. The payload is a number, or
+// a JSON object with the reading at key, e.g. ac.power for nested objects.
+func ParsePower(payload []byte, key string) (float64, error) {
+	if key == "" {
+		return strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	}
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return 0, err
+	}
+	for _, k := range strings.Split(key, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("no %s in payload", key)
+		}
+		v = obj[k]
+	}
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, fmt.Errorf("no number at %s in payload", key)
+}
+
+// Sensors implements sensor.Source
+func (b *Balance) Sensors() []sensor.Sensor {
+	power := func(id, feature, name string) sensor.Sensor {
+		return sensor.Sensor{ID: id, Feature: feature, Name: name, Unit: "W", DeviceClass: "power", StateClass: "measurement"}
+	}
+	// Starts over every day
+	energy := func(id, feature, name string) sensor.Sensor {
+		return sensor.Sensor{ID: id, Feature: feature, Name: name, Unit: "kWh", DeviceClass: "energy", StateClass: "total_increasing", Precision: 3}
+	}
+	hourly := func(id, feature, name string) sensor.Sensor {
+		return sensor.Sensor{ID: id, Feature: feature, Name: name, Unit: "kWh", StateClass: "measurement", Precision: 3}
+	}
+	ratio := func(id, feature, name string) sensor.Sensor {
+		return sensor.Sensor{ID: id, Feature: feature, Name: name, Unit: "%", StateClass: "measurement", Precision: 1}
+	}
+	return []sensor.Sensor{
+		power("solar_power", "solarPower", "Solar Power"),
+		power("house_power", "housePower", "House Power"),
+		energy("solar_energy_today", "solarEnergyToday", "Solar Energy Today"),
+		energy("house_energy_today", "houseEnergyToday", "House Energy Today"),
+		energy("self_consumed_energy_today", "selfConsumedEnergyToday", "Self-Consumed Energy Today"),
+		ratio("self_consumption_today", "selfConsumptionToday", "Self-Consumption Today"),
+		ratio("self_sufficiency_today", "selfSufficiencyToday", "Self-Sufficiency Today"),
+		hourly("solar_energy_last_hour", "solarEnergyLastHour", "Solar Energy Last Hour"),
+		hourly("house_energy_last_hour", "houseEnergyLastHour", "House Energy Last Hour"),
+		hourly("self_consumed_energy_last_hour", "selfConsumedEnergyLastHour", "Self-Consumed Energy Last Hour"),
+		ratio("self_consumption_last_hour", "selfConsumptionLastHour", "Self-Consumption Last Hour"),
+		ratio("self_sufficiency_last_hour", "selfSufficiencyLastHour", "Self-Sufficiency Last Hour"),
+	}
+}
+
+// Values implements sensor.Source. Nothing is reported until both the grid
+// and the production are known.
+func (b *Balance) Values() sensor.Values {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	v := sensor.Values{}
+	if !b.gridKnown || !b.prodKnown {
+		return v
+	}
+	v["solar_power"] = b.prod
+	v["house_power"] = math.Max(b.prod+b.imp-b.exp, 0)
+	period := func(suffix string, e Energy) {
+		v["solar_energy_"+suffix] = e.Production / 1000
+		v["house_energy_"+suffix] = e.Consumption() / 1000
+		v["self_consumed_energy_"+suffix] = e.SelfConsumed() / 1000
+		if r, ok := e.SelfConsumption(); ok {
+			v["self_consumption_"+suffix] = r
+		}
+		if r, ok := e.SelfSufficiency(); ok {
+			v["self_sufficiency_"+suffix] = r
+		}
+	}
+	period("today", b.st.Day)
+	if b.st.LastHour != nil {
+		period("last_hour", *b.st.LastHour)
+	}
+	return v
+}
+
+func hourStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+func dayStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,108 @@
+package solar
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/kaifa/kaifatest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = kaifatest.Start
+
+// feed sends constant readings every 10 seconds during [from, to)
+func feed(b *Balance, from, to time.Time, production float64, imp, exp int32) error {
+	return kaifatest.Feed(func(msg *kaifa.Message) error {
+		b.SetProduction(production, msg.Timestamp)
+		return b.Update(msg, msg.Timestamp)
+	}, from, to, imp, exp)
+}
+
+func TestEnergy(t *testing.T) {
+	var e Energy
+	e.add(3000, 1000, 2000, 1)
+	assert.Equal(t, 2000.0, e.Consumption())
+	assert.Equal(t, 1000.0, e.SelfConsumed())
+	r, ok := e.SelfConsumption()
+	assert.True(t, ok)
+	assert.InDelta(t, 33.3, r, 0.1)
+	r, _ = e.SelfSufficiency()
+	assert.Equal(t, 50.0, r)
+
+	_, ok = Energy{Import: 1000}.SelfConsumption()
+	assert.False(t, ok)
+
+	// The production reading is stale while exporting
+	e.add(0, 0, 2000, 0.5)
+	assert.Equal(t, 2000.0, e.Consumption())
+	assert.Equal(t, 1000.0, e.SelfConsumed())
+}
+
+func TestBalance(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kraft")
+	defer os.RemoveAll(dir)
+	b, err := New(time.Minute, filepath.Join(dir, "solar.json"))
+	assert.NoError(t, err)
+
+	// Nothing until the production is known
+	assert.NoError(t, b.Update(kaifatest.Power(start, 500, 0), start))
+	assert.Empty(t, b.Values())
+
+	// 4 kW of production, 1 kW used by the house and 3 kW exported
+	assert.NoError(t, feed(b, start, start.Add(30*time.Minute), 4000, 0, 3000))
+	v := b.Values()
+	assert.Equal(t, 1000.0, v["house_power"])
+	assert.InDelta(t, 2, v["solar_energy_today"], 0.02)
+	assert.InDelta(t, 0.5, v["self_consumed_energy_today"], 0.01)
+	assert.InDelta(t, 25, v["self_consumption_today"], 0.5)
+	assert.InDelta(t, 100, v["self_sufficiency_today"], 0.5)
+
+	// A cloud, the house imports 1 kW of its 2 kW
+	assert.NoError(t, feed(b, start.Add(30*time.Minute), start.Add(61*time.Minute), 1000, 1000, 0))
+	v = b.Values()
+	assert.InDelta(t, 2.5, v["solar_energy_last_hour"], 0.01)
+	assert.InDelta(t, 1.5, v["house_energy_last_hour"], 0.01)
+	assert.InDelta(t, 1.0, v["self_consumed_energy_last_hour"], 0.01)
+	assert.InDelta(t, 40, v["self_consumption_last_hour"], 0.5)
+	assert.InDelta(t, 66.7, v["self_sufficiency_last_hour"], 0.5)
+	assert.InDelta(t, 2.5+1.0/60, v["solar_energy_today"], 0.01)
+
+	// The inverter goes quiet at night
+	assert.NoError(t, b.Update(kaifatest.Power(start.Add(63*time.Minute), 300, 0), start.Add(63*time.Minute)))
+	v = b.Values()
+	assert.Equal(t, 0.0, v["solar_power"])
+	assert.Equal(t, 300.0, v["house_power"])
+
+	// A new day starts over, and the state survives a restart
+	assert.NoError(t, b.Save())
+	b, err = New(time.Minute, filepath.Join(dir, "solar.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, b.Update(kaifatest.Power(start.Add(14*time.Hour), 300, 0), start.Add(14*time.Hour)))
+	b.SetProduction(0, start.Add(14*time.Hour))
+	assert.NoError(t, b.Update(kaifatest.Power(start.Add(14*time.Hour+10*time.Second), 300, 0), start.Add(14*time.Hour+10*time.Second)))
+	v = b.Values()
+	assert.Equal(t, 0.0, v["solar_energy_today"])
+	assert.Equal(t, 0.0, v["house_energy_today"])
+}
+
+func TestParsePower(t *testing.T) {
+	v, err := ParsePower([]byte(" 1234.5\n"), "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1234.5, v)
+
+	v, err = ParsePower([]byte(`{"ac": {"power": 800}}`), "ac.power")
+	assert.NoError(t, err)
+	assert.Equal(t, 800.0, v)
+
+	v, err = ParsePower([]byte(`{"power": "42"}`), "power")
+	assert.NoError(t, err)
+	assert.Equal(t, 42.0, v)
+
+	_, err = ParsePower([]byte(`{"power": 1}`), "ac.power")
+	assert.Error(t, err)
+	_, err = ParsePower([]byte("on"), "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"hemtjan.st/kraft/link"
+	"hemtjan.st/kraft/queue"
+	"hemtjan.st/kraft/sdnotify"
+	"log"
+	"time"
+)
+
+// superviseSystemd tells systemd that kraft is ready once the broker is
+// reachable, keeps the status line up to date and pings the watchdog as long
+// as frames are decoded. The serial port must be open before it is called.
+func superviseSystemd(n *sdnotify.Notifier, stats *link.Stats, q *queue.Queue) {
+	if n == nil {
+		return
+	}
+	started := time.Now()
+	watchdog, useWatchdog := sdnotify.WatchdogInterval()
+	interval := 10 * time.Second
+	if useWatchdog && watchdog/2 < interval {
+		// systemd recommends pinging at half the timeout
+		interval = watchdog / 2
+	}
+
+	ready := false
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+	var lastUpdate time.Time
+	for now := range check.C {
+		if !ready && q.Online() {
+			ready = true
+			log.Printf("Ready, notifying systemd")
+			_ = n.Notify(sdnotify.Ready)
+		}
+		if now.Sub(lastUpdate) < interval {
+			continue
+		}
+		lastUpdate = now
+
+		last := stats.LastFrame()
+		_ = n.Status(systemdStatus(now, last, stats.Errors(), q, ready))
+		if last.IsZero() {
+			// Give the meter the watchdog timeout to send the first frame
+			last = started
+		}
+		if useWatchdog && now.Sub(last) < watchdog {
+			_ = n.Notify(sdnotify.Watchdog)
+		}
+	}
+}
+
+// systemdStatus is the status line shown by systemctl status
+func systemdStatus(now, last time.Time, errors int, q *queue.Queue, ready bool) string {
+	if !ready {
+		return "Waiting for the MQTT broker"
+	}
+	frame := "no frames yet"
+	if !last.IsZero() {
+		frame = fmt.Sprintf("last frame %s ago", now.Sub(last).Truncate(time.Second))
+	}
+	broker := "broker online"
+	if !q.Online() {
+		broker = fmt.Sprintf("broker offline, %d queued", q.Len())
+	}
+	return fmt.Sprintf("%s, %d decode errors, %s", frame, errors, broker)
+}
@@ -0,0 +1,150 @@
+package tariff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval is the spot price of an hour or a quarter of an hour
+type Interval struct {
+	Start time.Time `json:"start"`
+	// End defaults to the start of the next interval
+	End time.Time `json:"end"`
+	// Price is per kWh, excluding VAT
+	Price float64 `json:"price"`
+}
+
+// ParsePrices parses a JSON array of intervals
+func ParsePrices(r io.Reader) ([]Interval, error) {
+	var list []Interval
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	for i := range list {
+		if !list[i].End.IsZero() {
+			continue
+		}
+		switch {
+		case i+1 < len(list):
+			list[i].End = list[i+1].Start
+		case i > 0:
+			list[i].End = list[i].Start.Add(list[i].Start.Sub(list[i-1].Start))
+		default:
+			list[i].End = list[i].Start.Add(time.Hour)
+		}
+	}
+	return list, nil
+}
+
+// keepPrices is how long prices are kept after they were valid
+const keepPrices = 40 * 24 * time.Hour
+
+// Prices holds the known spot prices. It is safe for concurrent use.
+type Prices struct {
+	mu   sync.RWMutex
+	list []Interval
+}
+
+// Set merges list into the known prices, replacing the intervals it covers
+func (p *Prices) Set(list []Interval, now time.Time) {
+	if len(list) == 0 {
+		return
+	}
+	from, to := list[0].Start, list[len(list)-1].End
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var res []Interval
+	for _, iv := range p.list {
+		if (iv.End.After(from) && iv.Start.Before(to)) || now.Sub(iv.End) > keepPrices {
+			continue
+		}
+		res = append(res, iv)
+	}
+	res = append(res, list...)
+	sort.Slice(res, func(i, j int) bool { return res[i].Start.Before(res[j].Start) })
+	p.list = res
+}
+
+// Mean returns the mean price during [from, to), and false unless the whole
+// period has prices
+func (p *Prices) Mean(from, to time.Time) (float64, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var sum float64
+	var covered time.Duration
+	for _, iv := range p.list {
+		start, end := iv.Start, iv.End
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			sum += iv.Price * end.Sub(start).Seconds()
+			covered += end.Sub(start)
+		}
+	}
+	if covered < to.Sub(from) || covered == 0 {
+		return 0, false
+	}
+	return sum / covered.Seconds(), true
+}
+
+// Watch loads prices from src, a file or an http:// URL, into p every refresh
+func Watch(src string, p *Prices, refresh time.Duration) {
+	var modified time.Time
+	// A hanging request must not stop the refreshes
+	client := &http.Client{Timeout: 30 * time.Second}
+	for {
+		if err := load(client, src, p, &modified); err != nil {
+			log.Printf("Error loading spot prices from %s: %v", src, err)
+		}
+		time.Sleep(refresh)
+	}
+}
+
+func load(client *http.Client, src string, p *Prices, modified *time.Time) error {
+	var r io.ReadCloser
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		res, err := client.Get(src)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			_ = res.Body.Close()
+			return fmt.Errorf("unexpected status %s", res.Status)
+		}
+		r = res.Body
+	} else {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().Equal(*modified) {
+			return nil
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		*modified = fi.ModTime()
+		r = f
+	}
+	defer r.Close()
+	list, err := ParsePrices(r)
+	if err != nil {
+		return err
+	}
+	p.Set(list, time.Now())
+	return nil
+}
@@ -0,0 +1,397 @@
+// Package tariff prices the energy imported and exported each hour, from the
+// energy registers of the meter and optionally the spot prices.
+package tariff
+
+import (
+	"encoding/json"
+	"fmt"
+	"hemtjan.st/kraft/integrate"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/persist"
+	"hemtjan.st/kraft/sensor"
+	"math"
+	"os"
+	"time"
+)
+
+// Rate is a price per kWh, optionally only during some hours, days or months
+type Rate struct {
+	// Months the rate applies to, 1-12, all if empty
+	Months []int `json:",omitempty"`
+	// Days is weekdays or weekends, all days if empty
+	Days string `json:",omitempty"`
+	// From and To are the hours the rate applies to, e.g. 6 and 22. All day if equal.
+	From int `json:",omitempty"`
+	To   int `json:",omitempty"`
+	// Price is per kWh
+	Price float64
+}
+
+// applies returns true if the rate applies at t
+func (r Rate) applies(t time.Time) bool {
+	if len(r.Months) > 0 {
+		found := false
+		for _, m := range r.Months {
+			found = found || time.Month(m) == t.Month()
+		}
+		if !found {
+			return false
+		}
+	}
+	weekend := t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+	if r.Days == "weekdays" && weekend || r.Days == "weekends" && !weekend {
+		return false
+	}
+	if r.From == r.To {
+		return true
+	}
+	if r.From < r.To {
+		return t.Hour() >= r.From && t.Hour() < r.To
+	}
+	// Over midnight, e.g. 22 to 6
+	return t.Hour() >= r.From || t.Hour() < r.To
+}
+
+// price returns the price of the first rate that applies at t, or 0
+func price(rates []Rate, t time.Time) float64 {
+	for _, r := range rates {
+		if r.applies(t) {
+			return r.Price
+		}
+	}
+	return 0
+}
+
+// Export is the compensation for exported energy, per kWh
+type Export struct {
+	// Spot adds the spot price
+	Spot bool
+	// Price is paid by the supplier or the grid operator, on top of the spot price
+	Price []Rate
+	// TaxCredit is e.g. the Swedish skattereduktion
+	TaxCredit float64
+}
+
+// Config describes the tariff. Prices are per kWh and exclude VAT.
+type Config struct {
+	// Currency is used as the unit of the costs
+	Currency string
+	// Spot adds the spot price to the energy price
+	Spot bool
+	// Energy is the price of the energy from the supplier, e.g. the markup on the spot price
+	Energy []Rate
+	// Transfer is the grid transfer fee
+	Transfer []Rate
+	// Tax is the energy tax
+	Tax float64
+	// VAT is added to the imported energy and the fixed fees, e.g. 0.25 for 25 %
+	VAT float64
+	// Fixed is the sum of the fixed fees per month, spread evenly over its hours
+	Fixed  float64
+	Export Export
+}
+
+// LoadConfig reads a tariff from the JSON file at path
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Hour is the energy of an hour, in kWh
+type Hour struct {
+	Start  time.Time
+	Import float64
+	Export float64
+}
+
+type state struct {
+	// Last seen energy registers
+	RegisterTime *time.Time
+	Import       int64
+	Export       int64
+	// Pending are the hours that couldn't be priced yet, oldest first
+	Pending []Hour `json:",omitempty"`
+
+	// Hour is the start of the last priced hour
+	Hour      time.Time
+	HourCost  float64
+	Day       time.Time
+	DayCost   float64
+	Month     time.Time
+	MonthCost float64
+}
+
+// Engine prices each hour from the energy registers
+type Engine struct {
+	cfg    Config
+	prices *Prices
+	path   string
+	st     state
+	// now is the time of the last frame
+	now time.Time
+	// current is the energy of the current hour so far, integrated from the
+	// power as its register only arrives after the hour. It isn't persisted.
+	current Hour
+	// powerTime, powerImport and powerExport are the last power reading in W
+	powerTime                time.Time
+	powerImport, powerExport float64
+}
+
+// maxGap is the longest time between two registers that is priced. The
+// energy is spread evenly over the hours in between.
+const maxGap = 24 * time.Hour
+
+// maxPending is how long an hour waits for its spot price. The prices are
+// published the day before, an hour still without one after this won't get one.
+const maxPending = 48 * time.Hour
+
+// New creates an Engine, restoring the state persisted at path if set.
+// prices may be nil unless the tariff uses spot prices.
+func New(cfg Config, prices *Prices, path string) (*Engine, error) {
+	if (cfg.Spot || cfg.Export.Spot) && prices == nil {
+		return nil, fmt.Errorf("tariff uses spot prices, but there is no price source")
+	}
+	e := &Engine{cfg: cfg, prices: prices, path: path}
+	if path != "" {
+		if err := persist.Load(path, &e.st); err != nil {
+			return nil, fmt.Errorf("loading tariff state: %w", err)
+		}
+	}
+	return e, nil
+}
+
+// Price returns the price of imported and the compensation for exported
+// energy per kWh, during the hour starting at hour
+func (e *Engine) Price(hour time.Time) (imp, exp float64, err error) {
+	var spot float64
+	if e.cfg.Spot || e.cfg.Export.Spot {
+		var ok bool
+		if spot, ok = e.prices.Mean(hour, hour.Add(time.Hour)); !ok {
+			return 0, 0, fmt.Errorf("no spot price for %s", hour.Format("2006-01-02 15:04"))
+		}
+	}
+	imp = price(e.cfg.Energy, hour) + price(e.cfg.Transfer, hour) + e.cfg.Tax
+	if e.cfg.Spot {
+		imp += spot
+	}
+	imp *= 1 + e.cfg.VAT
+	exp = price(e.cfg.Export.Price, hour) + e.cfg.Export.TaxCredit
+	if e.cfg.Export.Spot {
+		exp += spot
+	}
+	return imp, exp, nil
+}
+
+// Cost returns the cost of the hour starting at hour, with imp kWh imported and exp kWh exported
+func (e *Engine) Cost(hour time.Time, imp, exp float64) (float64, error) {
+	pi, pe, err := e.Price(hour)
+	if err != nil {
+		return 0, err
+	}
+	month := monthStart(hour)
+	hours := month.AddDate(0, 1, 0).Sub(month).Hours()
+	fixed := e.cfg.Fixed / hours * (1 + e.cfg.VAT)
+	return imp*pi - exp*pe + fixed, nil
+}
+
+// Update feeds a message to the engine. Hours that can't be priced, because
+// the spot price is missing, are kept until it arrives. The error is returned
+// when the register of the hour arrives, and when the hour is given up after
+// maxPending.
+func (e *Engine) Update(msg *kaifa.Message) error {
+	e.now = msg.Timestamp
+	e.integrate(msg)
+	changed := e.register(msg)
+	var err error
+	if len(e.st.Pending) > 0 {
+		// Errors are only returned when something happened, rather than for
+		// every frame while waiting for a price
+		priced, perr := e.price()
+		if changed || priced {
+			err = perr
+		}
+		changed = changed || priced
+	}
+	if changed && e.path != "" {
+		if serr := persist.Save(e.path, &e.st); serr != nil {
+			return serr
+		}
+	}
+	return err
+}
+
+// integrate adds the energy since the last power reading to the current hour
+func (e *Engine) integrate(msg *kaifa.Message) {
+	if msg.ActivePowerPositive == nil {
+		return
+	}
+	integrate.Split(e.powerTime, msg.Timestamp, nextHour, func(start, end time.Time) {
+		if hour := hourStart(start); !hour.Equal(e.current.Start) {
+			e.current = Hour{Start: hour}
+		}
+		h := end.Sub(start).Hours()
+		e.current.Import += e.powerImport * h / 1000
+		e.current.Export += e.powerExport * h / 1000
+	})
+	e.powerTime = msg.Timestamp
+	e.powerImport, e.powerExport = float64(*msg.ActivePowerPositive), 0
+	if msg.ActivePowerNegative != nil {
+		e.powerExport = float64(*msg.ActivePowerNegative)
+	}
+}
+
+// register adds the hours since the last register to the pending hours, and
+// returns true if msg has a new register
+func (e *Engine) register(msg *kaifa.Message) bool {
+	if msg.EnergyTimestamp == nil || msg.ActiveEnergyPositive == nil {
+		return false
+	}
+	ts, imp := *msg.EnergyTimestamp, int64(*msg.ActiveEnergyPositive)
+	exp := int64(0)
+	if msg.ActiveEnergyNegative != nil {
+		exp = int64(*msg.ActiveEnergyNegative)
+	}
+	if e.st.RegisterTime != nil && ts.Equal(*e.st.RegisterTime) {
+		return false
+	}
+
+	if last := e.st.RegisterTime; last != nil && ts.After(*last) && ts.Sub(*last) <= maxGap && imp >= e.st.Import && exp >= e.st.Export {
+		hours := int(math.Round(ts.Sub(*last).Hours()))
+		for i := 0; i < hours; i++ {
+			e.st.Pending = append(e.st.Pending, Hour{
+				Start:  last.Add(time.Duration(i) * time.Hour),
+				Import: float64(imp-e.st.Import) / 1000 / float64(hours),
+				Export: float64(exp-e.st.Export) / 1000 / float64(hours),
+			})
+		}
+	}
+	e.st.RegisterTime = &ts
+	e.st.Import, e.st.Export = imp, exp
+	return true
+}
+
+// price prices the pending hours in order, up to the first one that can't be
+// priced yet. It returns true if any hour was priced or given up, and the
+// error of the hour it stopped at or gave up.
+func (e *Engine) price() (bool, error) {
+	changed := false
+	var err error
+	for len(e.st.Pending) > 0 {
+		h := e.st.Pending[0]
+		cost, cerr := e.Cost(h.Start, h.Import, h.Export)
+		if cerr != nil && e.now.Sub(h.Start) <= maxPending {
+			return changed, cerr
+		}
+		if cerr != nil {
+			err = fmt.Errorf("%w, giving up", cerr)
+		} else {
+			e.add(h.Start, cost)
+		}
+		e.st.Pending = e.st.Pending[1:]
+		changed = true
+	}
+	return changed, err
+}
+
+// add adds the cost of an hour to the totals
+func (e *Engine) add(hour time.Time, cost float64) {
+	e.st.Hour, e.st.HourCost = hour, cost
+	if day := dayStart(hour); !day.Equal(e.st.Day) {
+		e.st.Day, e.st.DayCost = day, 0
+	}
+	e.st.DayCost += cost
+	if month := monthStart(hour); !month.Equal(e.st.Month) {
+		e.st.Month, e.st.MonthCost = month, 0
+	}
+	e.st.MonthCost += cost
+}
+
+// Sensors implements sensor.Source
+func (e *Engine) Sensors() []sensor.Sensor {
+	cost := func(id, feature, name, reset string) sensor.Sensor {
+		return sensor.Sensor{
+			ID:          id,
+			Feature:     feature,
+			Name:        name,
+			Unit:        e.cfg.Currency,
+			DeviceClass: "monetary",
+			StateClass:  "total",
+			Reset:       reset,
+			Precision:   2,
+		}
+	}
+	price := func(id, feature, name string) sensor.Sensor {
+		return sensor.Sensor{
+			ID:        id,
+			Feature:   feature,
+			Name:      name,
+			Unit:      e.cfg.Currency + "/kWh",
+			Precision: 3,
+		}
+	}
+	return []sensor.Sensor{
+		cost("cost_hour", "costHour", "Cost Last Hour", ""),
+		cost("cost_current_hour", "costCurrentHour", "Cost This Hour", sensor.Hour),
+		cost("cost_today", "costToday", "Cost Today", sensor.Day),
+		cost("cost_month", "costMonth", "Cost This Month", sensor.Month),
+		price("price_import", "priceImport", "Import Price"),
+		price("price_export", "priceExport", "Export Price"),
+	}
+}
+
+// Values implements sensor.Source. The costs are of the hours priced so far,
+// the hour that just ended is priced when its energy register arrives. The
+// cost of the current hour is estimated from the power readings.
+func (e *Engine) Values() sensor.Values {
+	v := sensor.Values{}
+	if e.now.IsZero() {
+		return v
+	}
+	if !e.st.Hour.IsZero() {
+		v["cost_hour"] = e.st.HourCost
+	}
+	v["cost_today"], v["cost_month"] = 0, 0
+	if dayStart(e.now).Equal(e.st.Day) {
+		v["cost_today"] = e.st.DayCost
+	}
+	if monthStart(e.now).Equal(e.st.Month) {
+		v["cost_month"] = e.st.MonthCost
+	}
+	hour := hourStart(e.now)
+	if imp, exp, err := e.Price(hour); err == nil {
+		v["price_import"], v["price_export"] = imp, exp
+	}
+	if e.current.Start.Equal(hour) {
+		if cost, err := e.Cost(hour, e.current.Import, e.current.Export); err == nil {
+			v["cost_current_hour"] = cost
+		}
+	}
+	return v
+}
+
+func hourStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+// nextHour returns the start of the hour after the one t is in
+func nextHour(t time.Time) time.Time {
+	return hourStart(t).Add(time.Hour)
+}
+
+func dayStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,171 @@
+package tariff
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hemtjan.st/kraft/kaifa"
+	"hemtjan.st/kraft/kaifa/kaifatest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A Thursday
+var start = kaifatest.Start
+
+func TestRate(t *testing.T) {
+	winterDays := Rate{Months: []int{11, 12, 1, 2, 3}, Days: "weekdays", From: 6, To: 22, Price: 0.8}
+	assert.True(t, winterDays.applies(time.Date(2020, 1, 15, 6, 0, 0, 0, time.UTC)))
+	assert.False(t, winterDays.applies(time.Date(2020, 1, 15, 22, 0, 0, 0, time.UTC)))
+	assert.False(t, winterDays.applies(time.Date(2020, 1, 18, 12, 0, 0, 0, time.UTC)))
+	assert.False(t, winterDays.applies(start))
+
+	night := Rate{From: 22, To: 6}
+	assert.True(t, night.applies(time.Date(2020, 1, 15, 23, 0, 0, 0, time.UTC)))
+	assert.True(t, night.applies(time.Date(2020, 1, 15, 5, 0, 0, 0, time.UTC)))
+	assert.False(t, night.applies(start))
+
+	rates := []Rate{winterDays, {Price: 0.2}}
+	assert.Equal(t, 0.8, price(rates, time.Date(2020, 1, 15, 12, 0, 0, 0, time.UTC)))
+	assert.Equal(t, 0.2, price(rates, start))
+	assert.Equal(t, 0.0, price(nil, start))
+}
+
+func TestPrices(t *testing.T) {
+	list, err := ParsePrices(strings.NewReader(`[
+		{"start": "2020-08-20T10:15:00Z", "price": 2},
+		{"start": "2020-08-20T10:00:00Z", "price": 1},
+		{"start": "2020-08-20T10:30:00Z", "price": 3},
+		{"start": "2020-08-20T10:45:00Z", "price": 4}
+	]`))
+	assert.NoError(t, err)
+	assert.Equal(t, start.Add(time.Hour), list[3].End)
+
+	var p Prices
+	p.Set(list, start)
+	mean, ok := p.Mean(start, start.Add(time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, 2.5, mean)
+	_, ok = p.Mean(start, start.Add(2*time.Hour))
+	assert.False(t, ok)
+
+	// A new list replaces the intervals it covers
+	p.Set([]Interval{{Start: start, End: start.Add(time.Hour), Price: 5}}, start)
+	mean, _ = p.Mean(start, start.Add(time.Hour))
+	assert.Equal(t, 5.0, mean)
+}
+
+func TestCost(t *testing.T) {
+	var p Prices
+	p.Set([]Interval{
+		{Start: start, End: start.Add(time.Hour), Price: 1},
+		{Start: start.Add(time.Hour), End: start.Add(2 * time.Hour), Price: 2},
+	}, start)
+	cfg := Config{
+		Currency: "SEK",
+		Spot:     true,
+		Energy:   []Rate{{Price: 0.05}},
+		Transfer: []Rate{{From: 6, To: 22, Price: 0.5}, {Price: 0.2}},
+		Tax:      0.45,
+		VAT:      0.25,
+		Fixed:    744,
+		Export:   Export{Spot: true, TaxCredit: 0.6},
+	}
+	e, err := New(cfg, &p, "")
+	assert.NoError(t, err)
+
+	imp, exp, err := e.Price(start)
+	assert.NoError(t, err)
+	assert.InDelta(t, (1+0.05+0.5+0.45)*1.25, imp, 1e-9)
+	assert.InDelta(t, 1.6, exp, 1e-9)
+
+	// August has 744 hours
+	cost, err := e.Cost(start, 2, 1)
+	assert.NoError(t, err)
+	assert.InDelta(t, 2*2.5-1.6+1.25, cost, 1e-9)
+
+	_, err = e.Cost(start.Add(2*time.Hour), 1, 0)
+	assert.Error(t, err)
+
+	_, err = New(cfg, nil, "")
+	assert.Error(t, err)
+}
+
+func TestUpdate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kraft")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tariff.json")
+
+	cfg := Config{Currency: "SEK", Energy: []Rate{{Price: 1}}}
+	e, err := New(cfg, nil, path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, e.Update(kaifatest.Register(start, 10000, 0)))
+	assert.NoError(t, e.Update(kaifatest.Register(start.Add(time.Hour), 12000, 0)))
+	// Repeated register is ignored
+	assert.NoError(t, e.Update(kaifatest.Register(start.Add(time.Hour), 12000, 0)))
+	v := e.Values()
+	assert.Equal(t, 2.0, v["cost_hour"])
+	assert.Equal(t, 2.0, v["cost_today"])
+	assert.Equal(t, 1.0, v["price_import"])
+
+	// Two hours missed, the energy is spread over them
+	e, err = New(cfg, nil, path)
+	assert.NoError(t, err)
+	assert.NoError(t, e.Update(kaifatest.Register(start.Add(3*time.Hour), 16000, 0)))
+	v = e.Values()
+	assert.Equal(t, 2.0, v["cost_hour"])
+	assert.Equal(t, 6.0, v["cost_today"])
+	assert.Equal(t, 6.0, v["cost_month"])
+
+	// The next day starts over, the month doesn't
+	next := time.Date(2020, 8, 21, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, e.Update(kaifatest.Register(next, 16000, 0)))
+	assert.NoError(t, e.Update(kaifatest.Register(next.Add(time.Hour), 16500, 0)))
+	v = e.Values()
+	assert.Equal(t, 0.5, v["cost_today"])
+	assert.Equal(t, 6.5, v["cost_month"])
+}
+
+func TestPending(t *testing.T) {
+	var p Prices
+	p.Set([]Interval{{Start: start, End: start.Add(time.Hour), Price: 1}}, start)
+	e, err := New(Config{Currency: "SEK", Spot: true}, &p, "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, e.Update(kaifatest.Register(start, 10000, 0)))
+	assert.NoError(t, e.Update(kaifatest.Register(start.Add(time.Hour), 12000, 0)))
+	// The price of the second hour isn't known yet
+	assert.Error(t, e.Update(kaifatest.Register(start.Add(2*time.Hour), 15000, 0)))
+	assert.Equal(t, 2.0, e.Values()["cost_today"])
+	// Not reported again for every frame
+	assert.NoError(t, e.Update(&kaifa.Message{Timestamp: start.Add(2*time.Hour + 20*time.Second)}))
+
+	// Priced once the price arrives
+	p.Set([]Interval{{Start: start.Add(time.Hour), End: start.Add(2 * time.Hour), Price: 2}}, start)
+	assert.NoError(t, e.Update(&kaifa.Message{Timestamp: start.Add(2*time.Hour + 30*time.Second)}))
+	v := e.Values()
+	assert.Equal(t, 6.0, v["cost_hour"])
+	assert.Equal(t, 8.0, v["cost_today"])
+
+	// Given up after two days
+	assert.Error(t, e.Update(kaifatest.Register(start.Add(3*time.Hour), 16000, 0)))
+	assert.NoError(t, e.Update(&kaifa.Message{Timestamp: start.Add(40 * time.Hour)}))
+	assert.Error(t, e.Update(&kaifa.Message{Timestamp: start.Add(52 * time.Hour)}))
+	assert.Empty(t, e.st.Pending)
+}
+
+func TestCurrentHour(t *testing.T) {
+	e, err := New(Config{Currency: "SEK", Energy: []Rate{{Price: 1}}, Export: Export{TaxCredit: 0.5}}, nil, "")
+	assert.NoError(t, err)
+
+	// 1 kWh imported and 0.5 kWh exported in the first half hour
+	assert.NoError(t, kaifatest.Feed(e.Update, start, start.Add(30*time.Minute+10*time.Second), 2000, 1000))
+	assert.InDelta(t, 1-0.5*0.5, e.Values()["cost_current_hour"], 1e-9)
+
+	// The next hour starts over
+	assert.NoError(t, kaifatest.Feed(e.Update, start.Add(30*time.Minute+10*time.Second), start.Add(time.Hour+30*time.Minute+10*time.Second), 2000, 0))
+	assert.InDelta(t, 1.0, e.Values()["cost_current_hour"], 1e-9)
+}
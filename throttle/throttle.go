@@ -0,0 +1,189 @@
+// Package throttle decides which values are worth publishing, to avoid
+// flooding MQTT with unchanged readings.
+package throttle
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Aggregate is how the samples of a window are combined
+type Aggregate string
+
+const (
+	// Mean publishes the average of the samples of the window
+	Mean Aggregate = "mean"
+	// Min publishes the lowest sample of the window
+	Min Aggregate = "min"
+	// Max publishes the highest sample of the window
+	Max Aggregate = "max"
+)
+
+// Policy decides when a value is published
+type Policy struct {
+	// Deadband is how much a value must differ from the last published value
+	// to be published, negative publishes every value
+	Deadband float64
+	// MinInterval is the shortest time between two publishes
+	MinInterval time.Duration
+	// MaxInterval is the longest time without a publish, the value is
+	// published even if it is within the deadband. 0 disables.
+	MaxInterval time.Duration
+	// Window aggregates the samples over this time, 0 uses the raw samples
+	Window time.Duration
+	// Aggregate is used for Window, Mean if empty
+	Aggregate Aggregate
+}
+
+// Rule applies a Policy to the keys matching Pattern (see path.Match)
+type Rule struct {
+	Pattern string
+	Policy  Policy
+}
+
+// ParseRules parses rules like "phase*_voltage:deadband=0.5,min=10s;*:window=30s".
+// Rules are separated by ';', the first rule matching a key is used.
+//
+// The options are deadband, min, max, window and aggregate (mean, min or max).
+func ParseRules(s string) ([]Rule, error) {
+	var res []Rule
+	for _, r := range strings.Split(s, ";") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		idx := strings.Index(r, ":")
+		if idx < 0 {
+			return nil, fmt.Errorf("invalid rule %q, expected pattern:options", r)
+		}
+		rule := Rule{Pattern: r[:idx], Policy: Policy{Deadband: -1}}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", rule.Pattern, err)
+		}
+		for _, opt := range strings.Split(r[idx+1:], ",") {
+			kv := strings.SplitN(strings.TrimSpace(opt), "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid option %q in rule %q", opt, r)
+			}
+			var err error
+			p := &rule.Policy
+			switch kv[0] {
+			case "deadband":
+				p.Deadband, err = strconv.ParseFloat(kv[1], 64)
+			case "min":
+				p.MinInterval, err = time.ParseDuration(kv[1])
+			case "max":
+				p.MaxInterval, err = time.ParseDuration(kv[1])
+			case "window":
+				p.Window, err = time.ParseDuration(kv[1])
+			case "aggregate":
+				p.Aggregate = Aggregate(kv[1])
+				if p.Aggregate != Mean && p.Aggregate != Min && p.Aggregate != Max {
+					err = fmt.Errorf("expected mean, min or max")
+				}
+			default:
+				err = fmt.Errorf("unknown option")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid option %q in rule %q: %v", opt, r, err)
+			}
+		}
+		res = append(res, rule)
+	}
+	return res, nil
+}
+
+type field struct {
+	policy    *Policy
+	published bool
+	last      float64
+	lastTime  time.Time
+
+	// Current window
+	winStart      time.Time
+	sum, min, max float64
+	n             int
+}
+
+// Filter applies the rules to the values of each key
+type Filter struct {
+	rules  []Rule
+	fields map[string]*field
+}
+
+// New creates a Filter. Keys not matching any rule are always published.
+func New(rules []Rule) *Filter {
+	return &Filter{rules: rules, fields: map[string]*field{}}
+}
+
+func (f *Filter) field(key string) *field {
+	fl, ok := f.fields[key]
+	if !ok {
+		fl = &field{}
+		for i, r := range f.rules {
+			if ok, _ := path.Match(r.Pattern, key); ok {
+				fl.policy = &f.rules[i].Policy
+				break
+			}
+		}
+		f.fields[key] = fl
+	}
+	return fl
+}
+
+// Offer offers the sample v of key at time now. It returns the value to
+// publish and true if it is due, otherwise the last published value and
+// false. The returned value is only valid if Published(key) is true.
+func (f *Filter) Offer(key string, now time.Time, v float64) (float64, bool) {
+	fl := f.field(key)
+	p := fl.policy
+	if p == nil {
+		fl.published, fl.last, fl.lastTime = true, v, now
+		return v, true
+	}
+
+	if p.Window > 0 {
+		if fl.n == 0 {
+			fl.winStart, fl.sum, fl.min, fl.max = now, 0, v, v
+		}
+		fl.sum += v
+		fl.min = math.Min(fl.min, v)
+		fl.max = math.Max(fl.max, v)
+		fl.n++
+		if now.Sub(fl.winStart) < p.Window {
+			return fl.last, false
+		}
+		switch p.Aggregate {
+		case Min:
+			v = fl.min
+		case Max:
+			v = fl.max
+		default:
+			v = fl.sum / float64(fl.n)
+		}
+		fl.n = 0
+	}
+
+	due := !fl.published ||
+		p.Deadband < 0 ||
+		math.Abs(v-fl.last) > p.Deadband ||
+		(p.MaxInterval > 0 && now.Sub(fl.lastTime) >= p.MaxInterval)
+	if due && fl.published && p.MinInterval > 0 && now.Sub(fl.lastTime) < p.MinInterval {
+		due = false
+	}
+	if !due {
+		return fl.last, false
+	}
+	fl.published, fl.last, fl.lastTime = true, v, now
+	return v, true
+}
+
+// Published returns if a value of key has been published
+func (f *Filter) Published(key string) bool {
+	fl, ok := f.fields[key]
+	return ok && fl.published
+}
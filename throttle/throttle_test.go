@@ -0,0 +1,96 @@
+package throttle
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2020, 8, 20, 10, 0, 0, 0, time.UTC)
+
+func at(s int) time.Time {
+	return start.Add(time.Duration(s) * time.Second)
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("phase*_voltage:deadband=0.5,min=10s,max=5m; *:window=30s,aggregate=max")
+	assert.NoError(t, err)
+	assert.Equal(t, []Rule{
+		{Pattern: "phase*_voltage", Policy: Policy{Deadband: 0.5, MinInterval: 10 * time.Second, MaxInterval: 5 * time.Minute}},
+		{Pattern: "*", Policy: Policy{Deadband: -1, Window: 30 * time.Second, Aggregate: Max}},
+	}, rules)
+
+	rules, err = ParseRules("")
+	assert.NoError(t, err)
+	assert.Empty(t, rules)
+
+	for _, s := range []string{"voltage", "*:deadband", "*:foo=1", "*:aggregate=median", "[:min=1s"} {
+		_, err := ParseRules(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestUnmatched(t *testing.T) {
+	f := New(nil)
+	for i := 0; i < 3; i++ {
+		v, ok := f.Offer("power", at(i), 100)
+		assert.True(t, ok)
+		assert.Equal(t, 100.0, v)
+	}
+}
+
+func TestDeadband(t *testing.T) {
+	f := New([]Rule{{Pattern: "*", Policy: Policy{Deadband: 0.5, MaxInterval: time.Minute}}})
+
+	_, ok := f.Offer("voltage", at(0), 230)
+	assert.True(t, ok)
+	v, ok := f.Offer("voltage", at(10), 230.4)
+	assert.False(t, ok)
+	assert.Equal(t, 230.0, v)
+	v, ok = f.Offer("voltage", at(20), 229.2)
+	assert.True(t, ok)
+	assert.Equal(t, 229.2, v)
+
+	// Published after the max interval even if unchanged
+	_, ok = f.Offer("voltage", at(70), 229.2)
+	assert.False(t, ok)
+	_, ok = f.Offer("voltage", at(80), 229.2)
+	assert.True(t, ok)
+}
+
+func TestMinInterval(t *testing.T) {
+	f := New([]Rule{{Pattern: "*", Policy: Policy{Deadband: -1, MinInterval: 10 * time.Second}}})
+	_, ok := f.Offer("power", at(0), 100)
+	assert.True(t, ok)
+	_, ok = f.Offer("power", at(5), 200)
+	assert.False(t, ok)
+	v, ok := f.Offer("power", at(10), 300)
+	assert.True(t, ok)
+	assert.Equal(t, 300.0, v)
+}
+
+func TestWindow(t *testing.T) {
+	f := New([]Rule{
+		{Pattern: "min", Policy: Policy{Deadband: -1, Window: 30 * time.Second, Aggregate: Min}},
+		{Pattern: "*", Policy: Policy{Deadband: -1, Window: 30 * time.Second}},
+	})
+	for _, s := range []int{0, 10, 20} {
+		_, ok := f.Offer("mean", at(s), float64(s))
+		assert.False(t, ok)
+		f.Offer("min", at(s), float64(s))
+	}
+	assert.False(t, f.Published("mean"))
+
+	v, ok := f.Offer("mean", at(30), 30)
+	assert.True(t, ok)
+	assert.Equal(t, 15.0, v)
+	v, ok = f.Offer("min", at(30), 30)
+	assert.True(t, ok)
+	assert.Equal(t, 0.0, v)
+	assert.True(t, f.Published("mean"))
+
+	// Next window starts with the next sample
+	v, ok = f.Offer("mean", at(40), 40)
+	assert.False(t, ok)
+	assert.Equal(t, 15.0, v)
+}